@@ -0,0 +1,454 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
+	"golang.org/x/crypto/acme"
+)
+
+// Challenge types supported by ACMEClient.
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+)
+
+// ACMEClient obtains publicly trusted certificates from an ACME (RFC 8555)
+// CA such as Let's Encrypt, for the web-facing ezBastion endpoints.
+//
+// Challenges are answered either by listeners the client opens for the
+// duration of an order (HTTP01Addr, TLSALPN01Addr) or, when the ports are
+// already in use, by the front end itself through HTTPHandler and
+// GetCertificate.
+type ACMEClient struct {
+	// DirectoryURL is the ACME directory. Defaults to Let's Encrypt.
+	DirectoryURL string
+	// Email is the account contact.
+	Email string
+	// AcceptTOS is called with the URL of the terms of service of the CA
+	// before a new account is registered, and must return true to agree
+	// to them. Nothing is agreed on the operator's behalf: while it is nil
+	// no account is registered with a CA that has terms. Set it to
+	// acme.AcceptTOS once the terms have been reviewed.
+	AcceptTOS func(tosURL string) bool
+	// AccountKeyFilename holds the account key, created on first use.
+	AccountKeyFilename string
+	// Challenges lists the challenge types to try, in order. IP addresses
+	// can only be validated with HTTP-01.
+	Challenges []string
+	// HTTP01Addr and TLSALPN01Addr, when set, are listened on while
+	// challenges are pending, e.g. ":80" and ":443".
+	HTTP01Addr    string
+	TLSALPN01Addr string
+	// Roots are trust anchors for the chain returned by the CA, which
+	// usually stops below the root. When no root matches, it is fetched
+	// from the issuer URL of the topmost certificate.
+	Roots []*x509.Certificate
+	// Timeout bounds a whole order. Defaults to five minutes.
+	Timeout    time.Duration
+	HTTPClient *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string
+	certs  map[string]*tls.Certificate
+}
+
+// NewACMEClient returns a client for directoryURL storing its account key in
+// the cert folder created by setupmanager.CheckFolder under exPath.
+func NewACMEClient(exPath, directoryURL, email string) *ACMEClient {
+	return &ACMEClient{
+		DirectoryURL:       directoryURL,
+		Email:              email,
+		AccountKeyFilename: path.Join(exPath, "cert", "acme-account.key"),
+		Challenges:         []string{ChallengeHTTP01, ChallengeTLSALPN01},
+		Timeout:            5 * time.Minute,
+	}
+}
+
+// GenerateACME is Generate against an ACME CA: every DNS and IP SAN of
+// certificate is validated with a challenge and the result is saved in the
+// same files and layout as Generate, the certificate followed by the chain
+// served by the CA and the root in the CA file. The certificate must carry
+// the ServerAuth usage.
+func GenerateACME(certificate *x509.CertificateRequest, client *ACMEClient, certFilename, keyFilename, caFileName string, options ...GenerateOption) error {
+	_, err := GenerateACMEContext(context.Background(), certificate, client, certFilename, keyFilename, caFileName, options...)
+	return err
+}
+
+// GenerateACMEContext is GenerateACME bounded by ctx and reporting what it
+// saved, like GenerateContext. Each order is also bounded by the client
+// Timeout.
+func GenerateACMEContext(ctx context.Context, certificate *x509.CertificateRequest, client *ACMEClient, certFilename, keyFilename, caFileName string, options ...GenerateOption) (*EnrollResult, error) {
+	if len(certificate.DNSNames) == 0 && len(certificate.IPAddresses) == 0 {
+		return nil, errors.New("ACME needs at least one DNS name or IP address")
+	}
+	options = append(append([]GenerateOption{}, options...), func(c *generateConfig) {
+		c.usage = x509.ExtKeyUsageServerAuth
+	})
+	enroll := func(ctx context.Context, csr []byte) ([]byte, [][]byte, error) {
+		return client.order(ctx, certificate, csr)
+	}
+	return generate(ctx, certificate, enroll, nil, certFilename, keyFilename, caFileName, options)
+}
+
+func (c *ACMEClient) order(ctx context.Context, certificate *x509.CertificateRequest, csr []byte) ([]byte, [][]byte, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	client, err := c.client(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := acme.DomainIDs(certificate.DNSNames...)
+	for _, ip := range certificate.IPAddresses {
+		ids = append(ids, acme.IPIDs(ip.String())...)
+	}
+	order, err := client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to create ACME order: %v", err)
+	}
+
+	stop, err := c.listen()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stop()
+	for _, authzURL := range order.AuthzURLs {
+		if err = c.authorize(ctx, client, authzURL); err != nil {
+			return nil, nil, err
+		}
+	}
+	orderURL := order.URI
+	if order, err = client.WaitOrder(ctx, orderURL); err != nil {
+		return nil, nil, fmt.Errorf("ACME order failed: %v", err)
+	}
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		// CreateOrderCert waits for an order still processing on the
+		// Location of the finalize response, which CAs such as Pebble
+		// leave out: wait on the order itself.
+		if der, err = c.fetchOrderCert(ctx, client, orderURL, err); err != nil {
+			return nil, nil, fmt.Errorf("Failed to finalize ACME order: %v", err)
+		}
+	}
+	reportProgress(ctx, EnrollConnected, "Received new Certificate from ACME CA.")
+	chain, err := c.completeChain(ctx, der[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return der[0], chain, nil
+}
+
+// fetchOrderCert returns the certificate of the order at orderURL once
+// issued, or finalizeErr if the order does not become valid.
+func (c *ACMEClient) fetchOrderCert(ctx context.Context, client *acme.Client, orderURL string, finalizeErr error) ([][]byte, error) {
+	order, err := client.WaitOrder(ctx, orderURL)
+	if err != nil || order.Status != acme.StatusValid || order.CertURL == "" {
+		return nil, finalizeErr
+	}
+	return client.FetchCert(ctx, order.CertURL, true)
+}
+
+// client loads or creates the account key and registers it.
+func (c *ACMEClient) client(ctx context.Context) (*acme.Client, error) {
+	key, err := c.accountKey()
+	if err != nil {
+		return nil, err
+	}
+	directory := c.DirectoryURL
+	if directory == "" {
+		directory = acme.LetsEncryptURL
+	}
+	client := &acme.Client{Key: key, DirectoryURL: directory, HTTPClient: c.HTTPClient, UserAgent: "ezBastion"}
+	_, err = client.GetReg(ctx, "")
+	if err == nil {
+		return client, nil
+	}
+	if err != acme.ErrNoAccount {
+		return nil, fmt.Errorf("Failed to look up ACME account: %v", err)
+	}
+	dir, err := client.Discover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read ACME directory: %v", err)
+	}
+	if dir.Terms != "" && (c.AcceptTOS == nil || !c.AcceptTOS(dir.Terms)) {
+		return nil, fmt.Errorf("The terms of service of the ACME CA, %s, must be accepted to register an account, see ACMEClient.AcceptTOS", dir.Terms)
+	}
+	account := &acme.Account{}
+	if c.Email != "" {
+		account.Contact = []string{"mailto:" + c.Email}
+	}
+	agreed := func(string) bool { return true }
+	if _, err = client.Register(ctx, account, agreed); err != nil && err != acme.ErrAccountAlreadyExists {
+		return nil, fmt.Errorf("Failed to register ACME account: %v", err)
+	}
+	if dir.Terms != "" {
+		logmanager.Info(fmt.Sprintf("Registered ACME account, accepting the terms of service %s", dir.Terms))
+	}
+	return client, nil
+}
+
+func (c *ACMEClient) accountKey() (crypto.Signer, error) {
+	if _, err := os.Stat(c.AccountKeyFilename); err == nil {
+		return LoadPrivateKey(c.AccountKeyFilename, nil)
+	}
+	key, err := KeyECDSAP256.GenerateKey()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate private key: %v", err)
+	}
+	block, err := marshalPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal priv: %v", err)
+	}
+	if err = writePEM(c.AccountKeyFilename, block.Type, block.Bytes, 0600); err != nil {
+		return nil, err
+	}
+	logmanager.Info(fmt.Sprintf("Created ACME account key %s", c.AccountKeyFilename))
+	return key, nil
+}
+
+// authorize answers one challenge of the authorization at authzURL and
+// waits for the CA to validate it.
+func (c *ACMEClient) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	challenges := c.Challenges
+	if len(challenges) == 0 {
+		challenges = []string{ChallengeHTTP01, ChallengeTLSALPN01}
+	}
+	var chal *acme.Challenge
+	for _, typ := range challenges {
+		// golang.org/x/crypto/acme puts the identifier of TLS-ALPN-01
+		// certificates in a DNS SAN, which RFC 8738 forbids for IPs.
+		if typ == ChallengeTLSALPN01 && authz.Identifier.Type == "ip" {
+			continue
+		}
+		for _, ch := range authz.Challenges {
+			if ch.Type == typ {
+				chal = ch
+				break
+			}
+		}
+		if chal != nil {
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("No supported ACME challenge offered for %s", authz.Identifier.Value)
+	}
+
+	c.mu.Lock()
+	if c.tokens == nil {
+		c.tokens = make(map[string]string)
+		c.certs = make(map[string]*tls.Certificate)
+	}
+	c.mu.Unlock()
+	switch chal.Type {
+	case ChallengeHTTP01:
+		response, err := client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return err
+		}
+		p := client.HTTP01ChallengePath(chal.Token)
+		c.mu.Lock()
+		c.tokens[p] = response
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			delete(c.tokens, p)
+			c.mu.Unlock()
+		}()
+	case ChallengeTLSALPN01:
+		cert, err := client.TLSALPN01ChallengeCert(chal.Token, authz.Identifier.Value)
+		if err != nil {
+			return err
+		}
+		name := strings.ToLower(authz.Identifier.Value)
+		c.mu.Lock()
+		c.certs[name] = &cert
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			delete(c.certs, name)
+			c.mu.Unlock()
+		}()
+	}
+
+	if _, err = client.Accept(ctx, chal); err != nil {
+		return fmt.Errorf("ACME %s challenge for %s failed: %v", chal.Type, authz.Identifier.Value, err)
+	}
+	if _, err = client.WaitAuthorization(ctx, authz.URI); err != nil {
+		return fmt.Errorf("ACME %s challenge for %s failed: %v", chal.Type, authz.Identifier.Value, err)
+	}
+	logmanager.Info(fmt.Sprintf("ACME %s challenge for %s validated", chal.Type, authz.Identifier.Value))
+	return nil
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes other requests to next,
+// which may be nil.
+func (c *ACMEClient) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			c.mu.Lock()
+			response, ok := c.tokens[r.URL.Path]
+			c.mu.Unlock()
+			if ok {
+				w.Header().Set("Content-Type", "text/plain")
+				io.WriteString(w, response)
+				return
+			}
+		}
+		if next == nil {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GetCertificate is a tls.Config.GetCertificate hook answering TLS-ALPN-01
+// challenges. For other handshakes it returns nil so the config's own
+// certificates are used. The config must list acme.ALPNProto in NextProtos.
+func (c *ACMEClient) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			c.mu.Lock()
+			cert := c.certs[strings.ToLower(hello.ServerName)]
+			c.mu.Unlock()
+			if cert == nil {
+				return nil, fmt.Errorf("No ACME challenge pending for %s", hello.ServerName)
+			}
+			return cert, nil
+		}
+	}
+	return nil, nil
+}
+
+// listen opens the challenge listeners configured and returns a function
+// closing them.
+func (c *ACMEClient) listen() (func(), error) {
+	var servers []*http.Server
+	stop := func() {
+		for _, s := range servers {
+			s.Close()
+		}
+	}
+	if c.HTTP01Addr != "" {
+		l, err := net.Listen("tcp", c.HTTP01Addr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to listen for HTTP-01 challenges: %v", err)
+		}
+		s := &http.Server{Handler: c.HTTPHandler(nil)}
+		servers = append(servers, s)
+		go s.Serve(l)
+	}
+	if c.TLSALPN01Addr != "" {
+		config := &tls.Config{GetCertificate: c.GetCertificate, NextProtos: []string{acme.ALPNProto}}
+		l, err := tls.Listen("tcp", c.TLSALPN01Addr, config)
+		if err != nil {
+			stop()
+			return nil, fmt.Errorf("Failed to listen for TLS-ALPN-01 challenges: %v", err)
+		}
+		s := &http.Server{Handler: http.NotFoundHandler()}
+		servers = append(servers, s)
+		go s.Serve(l)
+	}
+	return stop, nil
+}
+
+// completeChain appends the root to the chain served by the CA, taken from
+// Roots or fetched from the issuer URL of the topmost certificate.
+func (c *ACMEClient) completeChain(ctx context.Context, chain [][]byte) ([][]byte, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("ACME CA returned no issuer certificate")
+	}
+	top, err := x509.ParseCertificate(chain[len(chain)-1])
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(top.RawSubject, top.RawIssuer) {
+		return chain, nil
+	}
+	for _, root := range c.Roots {
+		if top.CheckSignatureFrom(root) == nil {
+			return append(chain, root.Raw), nil
+		}
+	}
+	for _, u := range top.IssuingCertificateURL {
+		root, err := c.fetchIssuer(ctx, u)
+		if err != nil {
+			logmanager.Warning(fmt.Sprintf("Cannot fetch ACME root from %s: %v", u, err))
+			continue
+		}
+		if top.CheckSignatureFrom(root) == nil && bytes.Equal(root.RawSubject, root.RawIssuer) {
+			return append(chain, root.Raw), nil
+		}
+	}
+	return nil, fmt.Errorf("Root CA of %s not found, add it to ACMEClient.Roots", top.Subject.CommonName)
+}
+
+func (c *ACMEClient) fetchIssuer(ctx context.Context, url string) (*x509.Certificate, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxFrameSize))
+	if err != nil {
+		return nil, err
+	}
+	if certs, err := parsePEMCertificates(data); err == nil {
+		return certs[0], nil
+	}
+	return x509.ParseCertificate(data)
+}
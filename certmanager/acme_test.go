@@ -0,0 +1,202 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// freePort returns a local TCP port nobody listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// pebble is a running Pebble ACME test server.
+type pebble struct {
+	directory  string
+	management string
+	httpPort   int
+	client     *http.Client
+}
+
+// startPebble runs the pebble binary found in $PEBBLE or the PATH, skipping
+// the test when there is none. Its TLS certificate is issued by a test CA.
+func startPebble(t *testing.T) *pebble {
+	t.Helper()
+	bin := os.Getenv("PEBBLE")
+	if bin == "" {
+		var err error
+		if bin, err = exec.LookPath("pebble"); err != nil {
+			t.Skip("pebble not found, set PEBBLE or add it to the PATH")
+		}
+	}
+	dir := tempDir(t)
+	s := newServer(t, DefaultSignPolicy())
+	tlsConfig, err := s.tlsConfig("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock, err := marshalPrivateKey(tlsConfig.Certificates[0].PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certPEM []byte
+	for _, der := range tlsConfig.Certificates[0].Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	certFile, keyFile := filepath.Join(dir, "pebble.crt"), filepath.Join(dir, "pebble.key")
+	if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(keyBlock), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &pebble{httpPort: freePort(t)}
+	listen := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	management := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	config, _ := json.Marshal(map[string]interface{}{
+		"pebble": map[string]interface{}{
+			"listenAddress":           listen,
+			"managementListenAddress": management,
+			"certificate":             certFile,
+			"privateKey":              keyFile,
+			"httpPort":                p.httpPort,
+			"tlsPort":                 freePort(t),
+		},
+	})
+	configFile := filepath.Join(dir, "pebble.json")
+	if err = ioutil.WriteFile(configFile, config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin, "-config", configFile)
+	cmd.Env = append(os.Environ(), "PEBBLE_VA_NOSLEEP=1", "PEBBLE_WFE_NONCEREJECT=0")
+	if testing.Verbose() {
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.RootCertificate())
+	p.client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	p.directory = "https://" + listen + "/dir"
+	p.management = "https://" + management
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		resp, err := p.client.Get(p.directory)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pebble did not start: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return p
+}
+
+// root returns the root CA of the certificates pebble issues.
+func (p *pebble) root(t *testing.T) *x509.Certificate {
+	t.Helper()
+	resp, err := p.client.Get(p.management + "/roots/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := parsePEMCertificates(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs[0]
+}
+
+func TestGenerateACMEPebble(t *testing.T) {
+	p := startPebble(t)
+	files := newTestFiles(t)
+	client := &ACMEClient{
+		DirectoryURL:       p.directory,
+		AccountKeyFilename: filepath.Join(tempDir(t), "account.key"),
+		Challenges:         []string{ChallengeHTTP01},
+		HTTP01Addr:         fmt.Sprintf("127.0.0.1:%d", p.httpPort),
+		Roots:              []*x509.Certificate{p.root(t)},
+		Timeout:            time.Minute,
+		HTTPClient:         p.client,
+	}
+	request := func() *x509.CertificateRequest {
+		return NewCertificateRequest("", 0, []string{"127.0.0.1"}, WithExtKeyUsage(x509.ExtKeyUsageServerAuth))
+	}
+
+	err := GenerateACME(request(), client, files.cert, files.key, files.ca, WithProgress(quiet))
+	if err == nil || !strings.Contains(err.Error(), "terms of service") {
+		t.Fatalf("expected the terms of service to be refused, got %v", err)
+	}
+	if _, serr := os.Stat(client.AccountKeyFilename); serr != nil {
+		t.Fatal(serr)
+	}
+
+	client.AcceptTOS = acme.AcceptTOS
+	if err = GenerateACME(request(), client, files.cert, files.key, files.ca, WithProgress(quiet)); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := loadCertificates(files.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs[0].IPAddresses) != 1 || !certs[0].IPAddresses[0].Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("issued for %v", certs[0].IPAddresses)
+	}
+	if _, err = LoadX509KeyPair(files.cert, files.key, nil); err != nil {
+		t.Error(err)
+	}
+
+	// The account now exists: renewing needs no agreement.
+	client.AcceptTOS = nil
+	if err = GenerateACME(request(), client, files.cert, files.key, files.ca, WithProgress(quiet)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,348 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/ez_stdio"
+	"github.com/ezBastion/ezb_lib/logmanager"
+)
+
+// DefaultApprovalTimeout is how long Generate waits for a request held for
+// manual approval, see WithApprovalTimeout.
+const DefaultApprovalTimeout = 10 * time.Minute
+
+// ApprovalStatus is the state of a request in an ApprovalQueue.
+type ApprovalStatus string
+
+const (
+	ApprovalPending  ApprovalStatus = "pending"
+	ApprovalApproved ApprovalStatus = "approved"
+	ApprovalRejected ApprovalStatus = "rejected"
+)
+
+// PendingRequest is a CSR held in an ApprovalQueue.
+type PendingRequest struct {
+	ID        string         `json:"id"`
+	Status    ApprovalStatus `json:"status"`
+	Subject   string         `json:"subject"`
+	SANs      []string       `json:"sans"`
+	Requester string         `json:"requester"`
+	Received  time.Time      `json:"received"`
+	Decided   time.Time      `json:"decided,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+	CSR       []byte         `json:"csr"`
+	// Certificate is set once the server signed an approved request.
+	Certificate []byte `json:"certificate,omitempty"`
+}
+
+// ApprovalQueue holds the CSRs received by a Server until an operator
+// approves or rejects them. Set it as Server.Approval to turn manual
+// approval on. Each request is a JSON file in the queue folder, so the
+// queue survives restarts and can be reviewed from another process, such as
+// a CLI calling ReviewApprovals, while the server runs.
+//
+// Clients are not kept waiting on the connection: they are told to submit
+// the same CSR again later, and receive the certificate once the request
+// is approved. Protocol v1 clients cannot be told so and are refused.
+type ApprovalQueue struct {
+	// RetryAfter is the delay suggested to clients between submissions.
+	RetryAfter time.Duration
+
+	dir string
+	mu  sync.Mutex
+}
+
+// OpenApprovalQueue opens the queue in dir, creating the folder if needed.
+func OpenApprovalQueue(dir string) (*ApprovalQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &ApprovalQueue{RetryAfter: 15 * time.Second, dir: dir}, nil
+}
+
+// requestID identifies a CSR, so a resubmitted CSR finds its request.
+func requestID(csr []byte) string {
+	sum := sha256.Sum256(csr)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (q *ApprovalQueue) filename(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func (q *ApprovalQueue) load(id string) (*PendingRequest, error) {
+	if len(id) != 16 || strings.Trim(id, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("Invalid request ID %q", id)
+	}
+	data, err := ioutil.ReadFile(q.filename(id))
+	if err != nil {
+		return nil, err
+	}
+	var req PendingRequest
+	if err = json.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("Failed to read request %s: %v", id, err)
+	}
+	return &req, nil
+}
+
+func (q *ApprovalQueue) save(req *PendingRequest) error {
+	data, err := json.MarshalIndent(req, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(q.filename(req.ID), data, 0600)
+}
+
+// List returns the requests with status, all of them when status is empty,
+// oldest first.
+func (q *ApprovalQueue) List(status ApprovalStatus) ([]*PendingRequest, error) {
+	files, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var out []*PendingRequest
+	for _, f := range files {
+		req, err := q.load(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			logmanager.Warning(fmt.Sprintf("Approval queue: skipping %s: %v", f, err))
+			continue
+		}
+		if status == "" || req.Status == status {
+			out = append(out, req)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Received.Before(out[j].Received) })
+	return out, nil
+}
+
+// Get returns the request id.
+func (q *ApprovalQueue) Get(id string) (*PendingRequest, error) {
+	req, err := q.load(id)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unknown request %s", id)
+	}
+	return req, err
+}
+
+// Approve lets the server sign request id the next time its client submits
+// it.
+func (q *ApprovalQueue) Approve(id string) error {
+	return q.decide(id, ApprovalApproved, "")
+}
+
+// Reject refuses request id; its client receives reason.
+func (q *ApprovalQueue) Reject(id, reason string) error {
+	return q.decide(id, ApprovalRejected, reason)
+}
+
+func (q *ApprovalQueue) decide(id string, status ApprovalStatus, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	req, err := q.Get(id)
+	if err != nil {
+		return err
+	}
+	if req.Status != ApprovalPending {
+		return fmt.Errorf("Request %s is already %s", id, req.Status)
+	}
+	req.Status = status
+	req.Reason = reason
+	req.Decided = time.Now().UTC()
+	if err = q.save(req); err != nil {
+		return err
+	}
+	logmanager.Info(fmt.Sprintf("Approval queue: request %s for %s %s", id, req.Subject, status))
+	return nil
+}
+
+// Purge removes the decided requests older than age.
+func (q *ApprovalQueue) Purge(age time.Duration) error {
+	reqs, err := q.List("")
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, req := range reqs {
+		if req.Status != ApprovalPending && time.Since(req.Decided) > age {
+			if err = os.Remove(q.filename(req.ID)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteApprovalTable renders reqs as a human readable table.
+func WriteApprovalTable(w io.Writer, reqs []*PendingRequest) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tSUBJECT\tSANS\tREQUESTER\tRECEIVED")
+	for _, req := range reqs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", req.ID, req.Status, req.Subject,
+			strings.Join(req.SANs, ","), req.Requester, req.Received.Local().Format("2006-01-02 15:04:05"))
+	}
+	return tw.Flush()
+}
+
+// ReviewApprovals walks the operator through the pending requests of q on
+// the console, asking to approve, reject or skip each of them.
+func ReviewApprovals(q *ApprovalQueue) error {
+	reqs, err := q.List(ApprovalPending)
+	if err != nil {
+		return err
+	}
+	if len(reqs) == 0 {
+		fmt.Println("No request waiting for approval.")
+		return nil
+	}
+	for _, req := range reqs {
+		fmt.Println()
+		WriteApprovalTable(os.Stdout, []*PendingRequest{req})
+		switch ez_stdio.AskForValue("Approve, reject or skip? (a/r/s)", "s", "^[arsARS]$") {
+		case "a", "A":
+			err = q.Approve(req.ID)
+		case "r", "R":
+			err = q.Reject(req.ID, ez_stdio.AskForStringValue("Reason:"))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithApprovalTimeout sets how long Generate waits for a request the PKI
+// holds for manual approval, submitting it again as the PKI suggests. Zero
+// returns the *PendingError at once. The default is
+// DefaultApprovalTimeout.
+func WithApprovalTimeout(timeout time.Duration) GenerateOption {
+	return func(c *generateConfig) {
+		c.approvalTimeout = timeout
+	}
+}
+
+// enrollWaiting calls enroll until the request leaves the approval queue,
+// timeout expires or ctx ends.
+func enrollWaiting(ctx context.Context, enroll func(context.Context, []byte) ([]byte, [][]byte, error), csr []byte, timeout time.Duration) ([]byte, [][]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		cert, chain, err := enroll(ctx, csr)
+		pending, ok := err.(*PendingError)
+		if !ok {
+			return cert, chain, err
+		}
+		if timeout <= 0 {
+			return nil, nil, pending
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, nil, fmt.Errorf("%v, gave up after %s", pending, timeout)
+		}
+		wait := pending.RetryAfter
+		if wait <= 0 {
+			wait = 15 * time.Second
+		}
+		if wait > remaining {
+			wait = remaining
+		}
+		reportProgress(ctx, EnrollPending, "Request waits for approval, next try in %s.", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// enroll signs csrBytes, going through the approval queue when there is
+// one. The error is a *ProtocolError or a *PendingError.
+func (s *Server) enroll(csrBytes []byte, requester string) ([]byte, error) {
+	q := s.Approval
+	if q == nil {
+		certBytes, perr := s.sign(csrBytes, requester)
+		if perr != nil {
+			return nil, perr
+		}
+		return certBytes, nil
+	}
+	// Held for the whole call so concurrent submissions of one CSR are
+	// signed once.
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	id := requestID(csrBytes)
+	req, err := q.load(id)
+	if os.IsNotExist(err) {
+		csr, perr := s.checkRequest(csrBytes)
+		if perr != nil {
+			return nil, perr
+		}
+		req = &PendingRequest{
+			ID:        id,
+			Status:    ApprovalPending,
+			Subject:   csr.Subject.String(),
+			SANs:      sanList(csr.DNSNames, csr.IPAddresses, csr.EmailAddresses, csr.URIs),
+			Requester: requester,
+			Received:  time.Now().UTC(),
+			CSR:       csrBytes,
+		}
+		if err = q.save(req); err != nil {
+			return nil, &ProtocolError{Code: ErrCodeInternal, Message: err.Error()}
+		}
+		logmanager.Info(fmt.Sprintf("PKI signer: request %s for %s from %s waits for approval", id, req.Subject, requester))
+		return nil, &PendingError{ID: id, RetryAfter: q.RetryAfter}
+	}
+	if err != nil {
+		return nil, &ProtocolError{Code: ErrCodeInternal, Message: err.Error()}
+	}
+	switch req.Status {
+	case ApprovalRejected:
+		msg := "request rejected"
+		if req.Reason != "" {
+			msg += ": " + req.Reason
+		}
+		return nil, &ProtocolError{Code: ErrCodeRejected, Message: msg}
+	case ApprovalApproved:
+		if req.Certificate == nil {
+			certBytes, perr := s.sign(csrBytes, req.Requester)
+			if perr != nil {
+				return nil, perr
+			}
+			req.Certificate = certBytes
+			if err = q.save(req); err != nil {
+				return nil, &ProtocolError{Code: ErrCodeInternal, Message: err.Error()}
+			}
+		}
+		return req.Certificate, nil
+	}
+	return nil, &PendingError{ID: id, RetryAfter: q.RetryAfter}
+}
@@ -0,0 +1,356 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
+)
+
+// KeepBackups is the number of previous certificate sets kept next to the
+// files written by Generate and the import functions.
+var KeepBackups = 5
+
+const (
+	backupSuffix = ".bak"
+	backupStamp  = "20060102T150405.000000000Z"
+)
+
+// pendingFile is one file of a set written by replaceFiles.
+type pendingFile struct {
+	filename string
+	data     []byte
+	perm     os.FileMode
+}
+
+// replaceFiles replaces a set of files as a unit. Every file is first
+// written and fsynced under a temporary name, then the current files are
+// copied to <name>.<timestamp>.bak and the temporary files renamed over
+// them. If a rename fails the files already replaced are restored, so the
+// set on disk is always either the old one or the new one.
+func replaceFiles(files []pendingFile) error {
+	stamp := time.Now().UTC().Format(backupStamp)
+	tmp := make([]string, len(files))
+	defer func() {
+		for _, name := range tmp {
+			if name != "" {
+				os.Remove(name)
+			}
+		}
+	}()
+	for i, f := range files {
+		name, err := writeTemp(f)
+		if err != nil {
+			return err
+		}
+		tmp[i] = name
+	}
+
+	var backups []string
+	for _, f := range files {
+		backup, err := backupFile(f.filename, stamp)
+		if err != nil {
+			for _, name := range backups {
+				if name != "" {
+					os.Remove(name)
+				}
+			}
+			return err
+		}
+		backups = append(backups, backup)
+	}
+
+	for i, f := range files {
+		if err := os.Rename(tmp[i], f.filename); err != nil {
+			err = fmt.Errorf("Failed to replace %v: %v", f.filename, err)
+			if rerr := restoreSet(files[:i], stamp); rerr != nil {
+				err = fmt.Errorf("%v, and failed to restore the previous files: %v", err, rerr)
+			}
+			for _, backup := range backups[i:] {
+				if backup != "" {
+					os.Remove(backup)
+				}
+			}
+			return err
+		}
+		tmp[i] = ""
+		syncDir(filepath.Dir(f.filename))
+	}
+	filenames := make([]string, len(files))
+	for i, f := range files {
+		filenames[i] = f.filename
+	}
+	pruneBackups(filenames...)
+	return nil
+}
+
+func writeTemp(f pendingFile) (string, error) {
+	out, err := ioutil.TempFile(filepath.Dir(f.filename), "."+filepath.Base(f.filename)+".tmp")
+	if err != nil {
+		return "", fmt.Errorf("Failed to open %v for writing: %v", f.filename, err)
+	}
+	name := out.Name()
+	if err = out.Chmod(f.perm); err == nil {
+		if _, err = out.Write(f.data); err == nil {
+			err = out.Sync()
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", fmt.Errorf("Failed to write %v: %v", f.filename, err)
+	}
+	return name, nil
+}
+
+// writeFileAtomic replaces filename with data, readers seeing either the
+// old or the new content.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := writeTemp(pendingFile{filename: filename, data: data, perm: perm})
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// backupFile copies filename to its backup name for stamp. It returns "" if
+// filename does not exist.
+func backupFile(filename, stamp string) (string, error) {
+	fi, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("Failed to back up %v: %v", filename, err)
+	}
+	backup := filename + "." + stamp + backupSuffix
+	name, err := writeTemp(pendingFile{filename: backup, data: data, perm: fi.Mode().Perm()})
+	if err != nil {
+		return "", fmt.Errorf("Failed to back up %v: %v", filename, err)
+	}
+	if err = os.Rename(name, backup); err != nil {
+		os.Remove(name)
+		return "", fmt.Errorf("Failed to back up %v: %v", filename, err)
+	}
+	return backup, nil
+}
+
+// restoreSet puts back the files backed up under stamp, removing those which
+// did not exist then. The backups are consumed.
+func restoreSet(files []pendingFile, stamp string) error {
+	var failed []string
+	for _, f := range files {
+		backup := f.filename + "." + stamp + backupSuffix
+		var err error
+		if _, serr := os.Stat(backup); os.IsNotExist(serr) {
+			err = os.Remove(f.filename)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = os.Rename(backup, f.filename)
+		}
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+		syncDir(filepath.Dir(f.filename))
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Backups returns the timestamps of the backups kept for filename, newest
+// first.
+func Backups(filename string) ([]string, error) {
+	return backupSets(filename)
+}
+
+// backupSets returns the timestamps of the backups kept for any of
+// filenames, newest first. Files replaced together share a timestamp.
+func backupSets(filenames ...string) ([]string, error) {
+	seen := make(map[string]bool)
+	var stamps []string
+	for _, filename := range filenames {
+		matches, err := filepath.Glob(filename + ".*" + backupSuffix)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			stamp := strings.TrimSuffix(strings.TrimPrefix(m, filename+"."), backupSuffix)
+			if _, err := time.Parse(backupStamp, stamp); err == nil && !seen[stamp] {
+				seen[stamp] = true
+				stamps = append(stamps, stamp)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(stamps)))
+	return stamps, nil
+}
+
+// Rollback restores the certificate set that Generate or an import replaced
+// last, consuming its backup. Calling it again goes one set further back.
+// A set without a key backup, such as the one ImportFullChain leaves,
+// restores the certificate and CA files next to the current key. Unusable
+// sets are skipped with a warning.
+func Rollback(certFilename, keyFilename, caFilename string) error {
+	stamps, err := backupSets(certFilename, keyFilename, caFilename)
+	if err != nil {
+		return err
+	}
+	err = fmt.Errorf("No backup found for %s", certFilename)
+	for _, stamp := range stamps {
+		// Check the backed up key, or the current one, matches the
+		// backed up certificate before touching anything. A key backup
+		// alone is left over by pruning and restores nothing.
+		certBackup := certFilename + "." + stamp + backupSuffix
+		if _, serr := os.Stat(certBackup); serr != nil {
+			continue
+		}
+		keyBackup := keyFilename + "." + stamp + backupSuffix
+		files := []pendingFile{{filename: certFilename}}
+		if _, serr := os.Stat(keyBackup); serr == nil {
+			files = append([]pendingFile{{filename: keyFilename}}, files...)
+		} else {
+			keyBackup = keyFilename
+		}
+		if _, serr := os.Stat(caFilename + "." + stamp + backupSuffix); serr == nil {
+			files = append(files, pendingFile{filename: caFilename})
+		}
+		if err = checkBackupPair(certBackup, keyBackup); err != nil {
+			err = fmt.Errorf("Backup %s is unusable: %v", stamp, err)
+			logmanager.Warning(err.Error())
+			continue
+		}
+		return restoreSet(files, stamp)
+	}
+	return err
+}
+
+func checkBackupPair(certBackup, keyBackup string) error {
+	cert, err := loadCertificate(certBackup)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(keyBackup)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("No private key found in %s", keyBackup)
+	}
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		// Cannot be checked without the passphrase.
+		return nil
+	case pkcs11KeyBlockType:
+		// The reference holds the public key of the token key.
+		if !bytes.Equal(block.Bytes, cert.RawSubjectPublicKeyInfo) {
+			return errors.New("Issued certificate does not match the generated private key")
+		}
+		return nil
+	}
+	priv, err := parsePrivateKey(block)
+	if err != nil {
+		return err
+	}
+	return checkKeyMatch(cert, priv)
+}
+
+// pruneBackups keeps the KeepBackups newest backup sets of filenames,
+// removing the older sets whole.
+func pruneBackups(filenames ...string) {
+	stamps, err := backupSets(filenames...)
+	if err != nil || KeepBackups < 0 {
+		return
+	}
+	for i := KeepBackups; i < len(stamps); i++ {
+		for _, filename := range filenames {
+			os.Remove(filename + "." + stamps[i] + backupSuffix)
+		}
+	}
+}
+
+// syncDir flushes a directory entry so renames survive a crash. It is a
+// no-op where directories cannot be opened for sync, as on Windows.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// encodePrivateKey returns priv as PEM, encrypted with passphrase unless it
+// is nil.
+func encodePrivateKey(priv crypto.Signer, passphrase []byte, kdf KDF) ([]byte, error) {
+	var block *pem.Block
+	var err error
+	if passphrase != nil {
+		block, err = EncryptPrivateKey(priv, passphrase, kdf)
+	} else {
+		block, err = marshalPrivateKey(priv)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal priv: %v", err)
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// encodeCertificates returns certs as concatenated PEM blocks.
+func encodeCertificates(certs ...*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+// saveCertificateSet replaces the key, certificate and CA files as a unit.
+// The key goes first: should restoring fail half way, a new key next to the
+// old certificate is detected as unusable by LoadX509KeyPair and the Renewer.
+func saveCertificateSet(certFilename, keyFilename, caFilename string, keyData []byte, certs, caCerts []*x509.Certificate) error {
+	return replaceFiles([]pendingFile{
+		{filename: keyFilename, data: keyData, perm: 0600},
+		{filename: certFilename, data: encodeCertificates(certs...), perm: 0644},
+		{filename: caFilename, data: encodeCertificates(caCerts...), perm: 0644},
+	})
+}
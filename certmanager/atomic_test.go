@@ -0,0 +1,139 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// readSet returns the content of the cert, key and CA files of f.
+func (f testFiles) readSet(t *testing.T) [3][]byte {
+	t.Helper()
+	var set [3][]byte
+	for i, filename := range []string{f.cert, f.key, f.ca} {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		set[i] = data
+	}
+	return set
+}
+
+func sameSet(a, b [3][]byte) bool {
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRollback(t *testing.T) {
+	addr := serve(t, newServer(t, DefaultSignPolicy()))
+	files := newTestFiles(t)
+	var sets [][3][]byte
+	for i := 0; i < 3; i++ {
+		if _, err := files.generate(addr, "node1", nil); err != nil {
+			t.Fatal(err)
+		}
+		sets = append(sets, files.readSet(t))
+	}
+	if stamps, _ := Backups(files.cert); len(stamps) != 2 {
+		t.Fatalf("%d backups after replacing the files twice", len(stamps))
+	}
+
+	for i := 1; i >= 0; i-- {
+		if err := Rollback(files.cert, files.key, files.ca); err != nil {
+			t.Fatal(err)
+		}
+		if !sameSet(files.readSet(t), sets[i]) {
+			t.Errorf("rollback did not restore set %d", i+1)
+		}
+	}
+	if err := Rollback(files.cert, files.key, files.ca); err == nil {
+		t.Error("rolled back without a backup")
+	}
+	if _, err := LoadX509KeyPair(files.cert, files.key, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRollbackPartialSet(t *testing.T) {
+	addr := serve(t, newServer(t, DefaultSignPolicy()))
+	files := newTestFiles(t)
+	for i := 0; i < 2; i++ {
+		if _, err := files.generate(addr, "node1", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stamps, err := Backups(files.cert)
+	if err != nil || len(stamps) != 1 {
+		t.Fatalf("backups %v, %v", stamps, err)
+	}
+	certBackup := files.cert + "." + stamps[0] + backupSuffix
+	keyBackup := files.key + "." + stamps[0] + backupSuffix
+	if err = checkBackupPair(certBackup, keyBackup); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without its key, the backed up certificate does not match the
+	// current key and the set is refused, leaving the files alone.
+	if err = os.Remove(keyBackup); err != nil {
+		t.Fatal(err)
+	}
+	if err = checkBackupPair(certBackup, files.key); err == nil {
+		t.Fatal("certificate backup matched another key")
+	}
+	current := files.readSet(t)
+	if err = Rollback(files.cert, files.key, files.ca); err == nil {
+		t.Error("partial backup set restored")
+	}
+	if !sameSet(files.readSet(t), current) {
+		t.Error("files changed by a refused rollback")
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	saved := KeepBackups
+	KeepBackups = 2
+	defer func() { KeepBackups = saved }()
+
+	addr := serve(t, newServer(t, DefaultSignPolicy()))
+	files := newTestFiles(t)
+	for i := 0; i < 5; i++ {
+		if _, err := files.generate(addr, "node1", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stamps, err := backupSets(files.cert, files.key, files.ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stamps) != KeepBackups {
+		t.Fatalf("%d backup sets kept, expected %d", len(stamps), KeepBackups)
+	}
+	for _, stamp := range stamps {
+		for _, filename := range []string{files.cert, files.key, files.ca} {
+			if _, err = os.Stat(filename + "." + stamp + backupSuffix); err != nil {
+				t.Errorf("set %s is incomplete: %v", stamp, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,402 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
+)
+
+// AuditEntry records one certificate issued by a Server. Entries are chained:
+// PrevHash is the Hash of the previous entry and Hash covers every other
+// field but MAC, so editing, inserting or removing an entry breaks the chain.
+// MAC, set when the log has a key, seals Hash with it.
+type AuditEntry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	SANs      []string  `json:"sans"`
+	Requester string    `json:"requester"`
+	NotBefore time.Time `json:"notbefore"`
+	NotAfter  time.Time `json:"notafter"`
+	CSRHash   string    `json:"csrsha256"`
+	CertHash  string    `json:"certsha256"`
+	PrevHash  string    `json:"prevhash"`
+	Hash      string    `json:"hash"`
+	MAC       string    `json:"mac,omitempty"`
+}
+
+// computeHash returns the SHA-256 of the entry encoded with an empty Hash
+// and MAC.
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	e.MAC = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ErrAuditLogTorn is returned by VerifyAuditLog, with the last complete
+// entry, when the file ends with a partial line, as a crash while recording
+// leaves it. OpenAuditLog moves such a line aside and goes on.
+var ErrAuditLogTorn = errors.New("Audit log ends with a partial entry")
+
+// auditHead is the last entry of a keyed log, sealed with the key in the
+// file next to the log, so entries removed from its end are noticed. An
+// anchor given to VerifyAuditLog has the same form without MAC.
+type auditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
+	MAC  string `json:"mac,omitempty"`
+}
+
+func auditHeadFilename(filename string) string {
+	return filename + ".head"
+}
+
+// auditMAC seals hash with key. The purpose keeps the MAC of an entry from
+// being replayed as the MAC of a head.
+func auditMAC(key []byte, purpose, hash string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose + ":" + hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func checkAuditMAC(key []byte, purpose, hash, sum string) bool {
+	return hmac.Equal([]byte(auditMAC(key, purpose, hash)), []byte(sum))
+}
+
+func readAuditHead(filename string, key []byte) (*auditHead, error) {
+	data, err := ioutil.ReadFile(auditHeadFilename(filename))
+	if err != nil {
+		return nil, err
+	}
+	var head auditHead
+	if err = json.Unmarshal(data, &head); err != nil {
+		return nil, fmt.Errorf("Failed to read audit log head: %v", err)
+	}
+	if !checkAuditMAC(key, "head", head.Hash, head.MAC) {
+		return nil, errors.New("Audit log head altered or sealed with another key")
+	}
+	return &head, nil
+}
+
+func writeAuditHead(filename string, key []byte, seq int64, hash string) error {
+	data, err := json.Marshal(auditHead{Seq: seq, Hash: hash, MAC: auditMAC(key, "head", hash)})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(auditHeadFilename(filename), data, 0600)
+}
+
+type auditConfig struct {
+	key     []byte
+	anchors []auditHead
+}
+
+// AuditOption configures OpenAuditLog and VerifyAuditLog.
+type AuditOption func(*auditConfig)
+
+// WithAuditKey seals the log with key: every entry carries an HMAC of its
+// hash and the last one is kept in filename.head, so neither rewriting the
+// file nor removing entries from its end goes unnoticed by whoever holds
+// the key. A log started without a key must be sealed by SealAuditLog
+// first.
+func WithAuditKey(key []byte) AuditOption {
+	return func(c *auditConfig) {
+		c.key = key
+	}
+}
+
+// WithAuditAnchor makes VerifyAuditLog require the entry seq with hash,
+// for instance the last one copied to the service log, so entries removed
+// after it are noticed without a key.
+func WithAuditAnchor(seq int64, hash string) AuditOption {
+	return func(c *auditConfig) {
+		c.anchors = append(c.anchors, auditHead{Seq: seq, Hash: hash})
+	}
+}
+
+// AuditLog is an append-only file of AuditEntry, one JSON document per line.
+// Set it as Server.Audit to record every issued certificate.
+type AuditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	filename string
+	key      []byte
+	// size is the length of the complete entries, where a failed write is
+	// cut back to.
+	size int64
+	last AuditEntry
+}
+
+// OpenAuditLog opens or creates the audit log in filename. The existing
+// entries are verified first: a server must not extend a broken chain. A
+// partial last line left by a crash is moved to a ".torn" file.
+func OpenAuditLog(filename string, options ...AuditOption) (*AuditLog, error) {
+	c := newAuditConfig(options)
+	last, size, err := verifyAuditLog(filename, c)
+	if err == ErrAuditLogTorn {
+		err = cutTornEntry(filename, size)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &AuditLog{file: f, filename: filename, key: c.key, size: size}
+	if last != nil {
+		l.last = *last
+		// Catch the head up with an entry recorded before a crash.
+		if l.key != nil {
+			if err = writeAuditHead(filename, l.key, last.Seq, last.Hash); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("Failed to write audit log head: %v", err)
+			}
+		}
+	}
+	return l, nil
+}
+
+// cutTornEntry moves what follows the first size bytes of filename to a
+// ".torn" file, for the record.
+func cutTornEntry(filename string, size int64) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	torn := fmt.Sprintf("%s.%s.torn", filename, time.Now().UTC().Format("20060102T150405Z"))
+	if err = writeFileAtomic(torn, data[size:], 0600); err != nil {
+		return fmt.Errorf("Failed to save partial audit entry: %v", err)
+	}
+	if err = os.Truncate(filename, size); err != nil {
+		return fmt.Errorf("Failed to cut partial audit entry: %v", err)
+	}
+	logmanager.Warning(fmt.Sprintf("PKI audit: partial last entry of %s moved to %s", filename, torn))
+	return nil
+}
+
+// SealAuditLog verifies the audit log in filename, written without a key,
+// and seals its last entry with key so it can be opened WithAuditKey.
+func SealAuditLog(filename string, key []byte) error {
+	last, _, err := verifyAuditLog(filename, auditConfig{})
+	if err != nil {
+		return err
+	}
+	if last == nil {
+		return writeAuditHead(filename, key, 0, "")
+	}
+	return writeAuditHead(filename, key, last.Seq, last.Hash)
+}
+
+func newAuditConfig(options []AuditOption) auditConfig {
+	var c auditConfig
+	for _, option := range options {
+		option(&c)
+	}
+	return c
+}
+
+// Close closes the log file.
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Record appends the issuance of cert, requested by requester with the DER
+// encoded csr, and syncs it to disk.
+func (l *AuditLog) Record(cert *x509.Certificate, csr []byte, requester string) (*AuditEntry, error) {
+	csrSum := sha256.Sum256(csr)
+	certSum := sha256.Sum256(cert.Raw)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := AuditEntry{
+		Seq:       l.last.Seq + 1,
+		Time:      time.Now().UTC(),
+		Serial:    formatSerial(cert.SerialNumber),
+		Subject:   cert.Subject.String(),
+		SANs:      sanList(cert.DNSNames, cert.IPAddresses, cert.EmailAddresses, cert.URIs),
+		Requester: requester,
+		NotBefore: cert.NotBefore.UTC(),
+		NotAfter:  cert.NotAfter.UTC(),
+		CSRHash:   hex.EncodeToString(csrSum[:]),
+		CertHash:  hex.EncodeToString(certSum[:]),
+		PrevHash:  l.last.Hash,
+	}
+	var err error
+	if e.Hash, err = e.computeHash(); err != nil {
+		return nil, err
+	}
+	if l.key != nil {
+		e.MAC = auditMAC(l.key, "entry", e.Hash)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	line = append(line, '\n')
+	if _, err = l.file.Write(line); err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// Do not leave a partial line for the next entry to follow.
+		if terr := l.file.Truncate(l.size); terr != nil {
+			logmanager.Error(fmt.Sprintf("PKI audit: cannot cut failed entry %d: %v", e.Seq, terr))
+		}
+		return nil, fmt.Errorf("Failed to write audit log: %v", err)
+	}
+	l.size += int64(len(line))
+	l.last = e
+	if l.key != nil {
+		// The entry is sealed already: a head lagging behind it is caught
+		// up by the next OpenAuditLog.
+		if err = writeAuditHead(l.filename, l.key, e.Seq, e.Hash); err != nil {
+			logmanager.Error(fmt.Sprintf("PKI audit: cannot write head of entry %d: %v", e.Seq, err))
+		}
+	}
+	// The copy in the service log can be given to VerifyAuditLog as an
+	// anchor, to notice a truncated file when the log has no key.
+	logmanager.Info(fmt.Sprintf("PKI audit: entry %d serial %s hash %s", e.Seq, e.Serial, e.Hash))
+	return &e, nil
+}
+
+// VerifyAuditLog checks every entry of the audit log in filename and returns
+// the last one, nil for an empty log. Without a key, entries removed from
+// the end of the file, or a file rewritten as a whole, leave a valid chain:
+// give WithAuditKey, or the last hash recorded in the service log
+// WithAuditAnchor, to detect it.
+func VerifyAuditLog(filename string, options ...AuditOption) (*AuditEntry, error) {
+	last, _, err := verifyAuditLog(filename, newAuditConfig(options))
+	return last, err
+}
+
+// verifyAuditLog also returns the length of the complete entries.
+func verifyAuditLog(filename string, c auditConfig) (*AuditEntry, int64, error) {
+	anchors := c.anchors
+	var head *auditHead
+	var err error
+	if c.key != nil {
+		head, err = readAuditHead(filename, c.key)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, 0, err
+		}
+		if head != nil {
+			anchors = append(anchors, *head)
+		}
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) && head != nil && head.Seq > 0 {
+		return nil, 0, fmt.Errorf("Audit log %s is missing, its head is at entry %d", filename, head.Seq)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	last, size, err := verifyAuditEntries(f, c.key, head, anchors)
+	if err != nil && err != ErrAuditLogTorn {
+		return nil, 0, err
+	}
+	if c.key != nil && head == nil && last != nil {
+		return nil, 0, fmt.Errorf("Audit log %s has no head, seal it with SealAuditLog", filename)
+	}
+	for _, a := range anchors {
+		if last == nil || last.Seq < a.Seq {
+			return nil, 0, fmt.Errorf("Audit log ends before entry %d: entries removed", a.Seq)
+		}
+	}
+	return last, size, err
+}
+
+// verifyAuditEntries checks the chain and, with a key, the MAC of the
+// entries following head. Each entry of anchors must be found unchanged.
+func verifyAuditEntries(r io.Reader, key []byte, head *auditHead, anchors []auditHead) (*AuditEntry, int64, error) {
+	var last *AuditEntry
+	var size int64
+	reader := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return last, size, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		if err == io.EOF {
+			return last, size, ErrAuditLogTorn
+		}
+		var e AuditEntry
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		if err = dec.Decode(&e); err != nil {
+			return nil, 0, fmt.Errorf("Audit log line %d: %v", n, err)
+		}
+		if err = checkAuditEntry(e, last); err != nil {
+			return nil, 0, fmt.Errorf("Audit log line %d: %v", n, err)
+		}
+		if key != nil && (e.MAC != "" || head == nil || e.Seq > head.Seq) && !checkAuditMAC(key, "entry", e.Hash, e.MAC) {
+			return nil, 0, fmt.Errorf("Audit log line %d: entry not sealed with the audit key", n)
+		}
+		for _, a := range anchors {
+			if e.Seq == a.Seq && e.Hash != a.Hash {
+				return nil, 0, fmt.Errorf("Audit log line %d: entry differs from the one expected", n)
+			}
+		}
+		size += int64(len(line))
+		last = &e
+	}
+}
+
+func checkAuditEntry(e AuditEntry, prev *AuditEntry) error {
+	wantSeq, wantPrev := int64(1), ""
+	if prev != nil {
+		wantSeq, wantPrev = prev.Seq+1, prev.Hash
+	}
+	if e.Seq != wantSeq {
+		return fmt.Errorf("sequence %d, expected %d", e.Seq, wantSeq)
+	}
+	if e.PrevHash != wantPrev {
+		return errors.New("chain broken, previous entry missing or altered")
+	}
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	if hash != e.Hash {
+		return errors.New("entry altered, hash mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordAudit appends n entries to the log in filename.
+func recordAudit(t *testing.T, filename string, n int, options ...AuditOption) *AuditEntry {
+	t.Helper()
+	l, err := OpenAuditLog(filename, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var e *AuditEntry
+	for i := 0; i < n; i++ {
+		cert := &x509.Certificate{
+			Raw:          []byte{byte(i)},
+			SerialNumber: big.NewInt(int64(1000 + i)),
+			Subject:      pkix.Name{CommonName: "node"},
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		if e, err = l.Record(cert, []byte("csr"), "127.0.0.1:1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return e
+}
+
+// dropLastLine removes the last entry of the log in filename.
+func dropLastLine(t *testing.T, filename string) {
+	t.Helper()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = data[:bytes.LastIndexByte(data[:len(data)-1], '\n')+1]
+	if err = ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditLogAnchor(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "audit.log")
+	last := recordAudit(t, filename, 3)
+	// Serials are written as everywhere else in the package.
+	if last.Serial != "3EA" {
+		t.Errorf("serial %s recorded for 1002", last.Serial)
+	}
+	if e, err := VerifyAuditLog(filename, WithAuditAnchor(last.Seq, last.Hash)); err != nil || e.Seq != 3 {
+		t.Fatalf("verify: %v, %v", e, err)
+	}
+	dropLastLine(t, filename)
+	if _, err := VerifyAuditLog(filename); err != nil {
+		t.Errorf("truncated chain without an anchor: %v", err)
+	}
+	if _, err := VerifyAuditLog(filename, WithAuditAnchor(last.Seq, last.Hash)); err == nil {
+		t.Errorf("truncated log matched its anchor")
+	}
+}
+
+func TestAuditLogTornEntry(t *testing.T) {
+	dir := tempDir(t)
+	filename := filepath.Join(dir, "audit.log")
+	recordAudit(t, filename, 2)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":3,"time":`)
+	f.Close()
+
+	if e, err := VerifyAuditLog(filename); err != ErrAuditLogTorn || e == nil || e.Seq != 2 {
+		t.Fatalf("expected a torn log ending at entry 2, got %v, %v", e, err)
+	}
+	if e := recordAudit(t, filename, 1); e.Seq != 3 {
+		t.Errorf("recorded entry %d after the torn one", e.Seq)
+	}
+	if _, err = VerifyAuditLog(filename); err != nil {
+		t.Error(err)
+	}
+	torn, _ := filepath.Glob(filepath.Join(dir, "audit.log.*.torn"))
+	if len(torn) != 1 {
+		t.Errorf("partial entry saved to %v", torn)
+	}
+}
+
+func TestAuditLogKey(t *testing.T) {
+	key := []byte("audit key")
+	filename := filepath.Join(tempDir(t), "audit.log")
+	recordAudit(t, filename, 2)
+	if _, err := OpenAuditLog(filename, WithAuditKey(key)); err == nil {
+		t.Fatal("unsealed log opened with a key")
+	}
+	if err := SealAuditLog(filename, key); err != nil {
+		t.Fatal(err)
+	}
+	recordAudit(t, filename, 2, WithAuditKey(key))
+	if e, err := VerifyAuditLog(filename, WithAuditKey(key)); err != nil || e.Seq != 4 {
+		t.Fatalf("verify: %v, %v", e, err)
+	}
+	if _, err := VerifyAuditLog(filename, WithAuditKey([]byte("other key"))); err == nil {
+		t.Error("verified with another key")
+	}
+	original, _ := ioutil.ReadFile(filename)
+	head, _ := ioutil.ReadFile(auditHeadFilename(filename))
+
+	// Removing the last entry is caught by the head.
+	dropLastLine(t, filename)
+	if _, err := VerifyAuditLog(filename, WithAuditKey(key)); err == nil {
+		t.Error("truncated log verified")
+	}
+
+	// An entry appended without the key is refused.
+	ioutil.WriteFile(filename, original, 0600)
+	l, err := OpenAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := l.last
+	l.Close()
+	forged := AuditEntry{Seq: last.Seq + 1, Time: time.Now().UTC(), Serial: "01", PrevHash: last.Hash}
+	forged.Hash, _ = forged.computeHash()
+	line, _ := json.Marshal(forged)
+	ioutil.WriteFile(filename, append(append(original, line...), '\n'), 0600)
+	if _, err = VerifyAuditLog(filename, WithAuditKey(key)); err == nil {
+		t.Error("unsealed entry verified")
+	}
+
+	// A head lagging behind a sealed entry, as after a crash, is caught up.
+	ioutil.WriteFile(filename, original, 0600)
+	dropLastLine(t, filename)
+	previous, err := VerifyAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAuditHead(filename, key, previous.Seq, previous.Hash)
+	ioutil.WriteFile(filename, original, 0600)
+	if _, err = VerifyAuditLog(filename, WithAuditKey(key)); err != nil {
+		t.Errorf("lagging head: %v", err)
+	}
+	if l, err = OpenAuditLog(filename, WithAuditKey(key)); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if data, _ := ioutil.ReadFile(auditHeadFilename(filename)); !bytes.Equal(data, head) {
+		t.Error("head not caught up")
+	}
+
+	// Removing the whole log is caught too.
+	os.Remove(filename)
+	if _, err = OpenAuditLog(filename, WithAuditKey(key)); err == nil {
+		t.Error("missing log recreated")
+	}
+}
@@ -0,0 +1,179 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// ExportPKCS12 writes the key, certificate and CA chain saved by Generate to
+// a PKCS#12 file protected by password. keyPassphrase decrypts an encrypted
+// key and may be nil.
+func ExportPKCS12(certFilename, keyFilename, caFilename string, keyPassphrase []byte, p12Filename, password string) error {
+	if password == "" {
+		return errors.New("A PKCS#12 export password is required")
+	}
+	certs, err := loadCertificates(certFilename)
+	if err != nil {
+		return err
+	}
+	caCerts, err := loadCertificates(caFilename)
+	if err != nil {
+		return err
+	}
+	priv, err := LoadPrivateKey(keyFilename, keyPassphrase)
+	if err != nil {
+		return err
+	}
+	pfx, err := EncodePKCS12(priv, certs[0], dedupCertificates(append(certs[1:], caCerts...)), password, certs[0].Subject.CommonName)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p12Filename, pfx, 0600)
+}
+
+// ImportPKCS12 reads a PKCS#12 file and saves its content with the same
+// files and layout as Generate. Options such as WithKeyPassphrase apply to
+// the saved key. The CA certificates may come in any order: the chain is
+// built and verified up to a self-signed root before anything is saved.
+func ImportPKCS12(p12Filename, password, certFilename, keyFilename, caFilename string, options ...GenerateOption) error {
+	pfx, err := ioutil.ReadFile(p12Filename)
+	if err != nil {
+		return err
+	}
+	priv, leaf, caCerts, err := DecodePKCS12(pfx, password)
+	if err != nil {
+		return err
+	}
+	intermediates, root, err := orderChain(leaf, caCerts)
+	if err != nil {
+		return fmt.Errorf("Failed to import %s: %v", p12Filename, err)
+	}
+	config := newGenerateConfig(options)
+	passphrase, err := config.keyPassphrase()
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodePrivateKey(priv, passphrase, config.kdf)
+	if err != nil {
+		return err
+	}
+	// The intermediates stay with the leaf, as Generate saves them.
+	return saveCertificateSet(certFilename, keyFilename, caFilename, keyPEM,
+		append([]*x509.Certificate{leaf}, intermediates...), []*x509.Certificate{root})
+}
+
+// ExportFullChain writes the certificate saved by Generate followed by its CA
+// chain to a single PEM file, the form expected by load balancers and most
+// web servers.
+func ExportFullChain(certFilename, caFilename, fullchainFilename string) error {
+	certs, err := loadCertificates(certFilename)
+	if err != nil {
+		return err
+	}
+	caCerts, err := loadCertificates(caFilename)
+	if err != nil {
+		return err
+	}
+	return writeCertificates(fullchainFilename, dedupCertificates(append(certs, caCerts...)))
+}
+
+// ImportFullChain splits a full chain PEM file into the certificate and CA
+// files used by Generate. The leaf is the first certificate that is not a
+// CA, the others are ordered by verifying the chain, so the CA certificates
+// may come in any order; the intermediates stay with the leaf.
+func ImportFullChain(fullchainFilename, certFilename, caFilename string) error {
+	certs, err := loadCertificates(fullchainFilename)
+	if err != nil {
+		return err
+	}
+	leaf := certs[0]
+	for _, cert := range certs {
+		if !cert.IsCA {
+			leaf = cert
+			break
+		}
+	}
+	var caCerts []*x509.Certificate
+	for _, cert := range certs {
+		if cert != leaf {
+			caCerts = append(caCerts, cert)
+		}
+	}
+	intermediates, root, err := orderChain(leaf, caCerts)
+	if err != nil {
+		return fmt.Errorf("Failed to import %s: %v", fullchainFilename, err)
+	}
+	return replaceFiles([]pendingFile{
+		{filename: certFilename, data: encodeCertificates(append([]*x509.Certificate{leaf}, intermediates...)...), perm: 0644},
+		{filename: caFilename, data: encodeCertificates(root), perm: 0644},
+	})
+}
+
+// orderChain builds the chain of leaf from caCerts, in any order, with the
+// self-signed ones as roots. It returns the intermediates, leaf issuer
+// first, and the root. Certificates off the chain are dropped.
+func orderChain(leaf *x509.Certificate, caCerts []*x509.Certificate) ([]*x509.Certificate, *x509.Certificate, error) {
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	hasRoot := false
+	for _, cert := range caCerts {
+		if bytes.Equal(cert.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(cert) == nil {
+			roots.AddCert(cert)
+			hasRoot = true
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if !hasRoot {
+		return nil, nil, errors.New("No root CA certificate in the chain")
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid certificate chain for %s: %v", leaf.Subject, err)
+	}
+	chain := chains[0]
+	if len(chain) < 2 {
+		return nil, nil, fmt.Errorf("Certificate %s is self-signed", leaf.Subject)
+	}
+	return chain[1 : len(chain)-1], chain[len(chain)-1], nil
+}
+
+func writeCertificates(filename string, certs []*x509.Certificate) error {
+	if err := ioutil.WriteFile(filename, encodeCertificates(certs...), 0644); err != nil {
+		return fmt.Errorf("Failed to write %v: %v", filename, err)
+	}
+	return nil
+}
+
+func dedupCertificates(certs []*x509.Certificate) []*x509.Certificate {
+	var out []*x509.Certificate
+	seen := make(map[string]bool)
+	for _, cert := range certs {
+		if !seen[string(cert.Raw)] {
+			seen[string(cert.Raw)] = true
+			out = append(out, cert)
+		}
+	}
+	return out
+}
@@ -17,19 +17,27 @@ package certmanager
 
 import (
 	"bufio"
-	"crypto/ecdsa"
-	"crypto/elliptic"
+	"context"
 	"crypto/rand"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/binary"
-	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"net"
-	"os"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
 )
 
-func NewCertificateRequest(commonName string, duration int, addresses []string) *x509.CertificateRequest {
+// RequestOption customizes the request built by NewCertificateRequest.
+type RequestOption func(*x509.CertificateRequest)
+
+// NewCertificateRequest builds a request for commonName in the ezBastion
+// organization. addresses become IP or DNS SANs and duration, in days, the
+// requested validity when positive. options add subject fields, other SANs
+// and usages.
+func NewCertificateRequest(commonName string, duration int, addresses []string, options ...RequestOption) *x509.CertificateRequest {
 	certificate := x509.CertificateRequest{
 		Subject: pkix.Name{
 			Organization: []string{"ezBastion"},
@@ -45,131 +53,398 @@ func NewCertificateRequest(commonName string, duration int, addresses []string)
 			certificate.DNSNames = append(certificate.DNSNames, addresses[i])
 		}
 	}
+	if duration > 0 {
+		WithValidity(time.Duration(duration) * 24 * time.Hour)(&certificate)
+	}
+	for _, option := range options {
+		option(&certificate)
+	}
 
 	return &certificate
 }
 
-func Generate(certificate *x509.CertificateRequest, ezbpki, certFilename, keyFilename, caFileName string) error {
-	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		return fmt.Errorf("Failed to generate private key: %v", err)
+// GenerateOption customizes what Generate accepts and how it stores it.
+type GenerateOption func(*generateConfig)
+
+type generateConfig struct {
+	passphrase     *PassphraseSource
+	kdf            KDF
+	productionOnly bool
+	store          KeyStore
+	// approvalTimeout bounds the wait for a manual approval.
+	approvalTimeout time.Duration
+	// usage is the extended key usage the enrolled certificate must
+	// carry. The zero value, ExtKeyUsageAny, stands for ClientAuth.
+	usage x509.ExtKeyUsage
+	// progress receives the progress reports, printed when nil.
+	progress func(EnrollEvent)
+	// protocolVersion is the pinned enrollment protocol, 0 to negotiate.
+	protocolVersion int
+}
+
+func newGenerateConfig(options []GenerateOption) generateConfig {
+	config := generateConfig{approvalTimeout: DefaultApprovalTimeout}
+	for _, option := range options {
+		option(&config)
 	}
+	return config
+}
 
-	derBytes, err := x509.CreateCertificateRequest(rand.Reader, certificate, priv)
-	if err != nil {
-		return err
+// keyPassphrase returns the passphrase protecting the saved key, nil when
+// the key is stored in clear.
+func (c generateConfig) keyPassphrase() ([]byte, error) {
+	if c.passphrase == nil {
+		return nil, nil
 	}
-	fmt.Println("Created Certificate Signing Request for client.")
-	conn, err := net.Dial("tcp", ezbpki)
-	if err != nil {
-		return err
+	passphrase := c.passphrase.Get()
+	if passphrase == nil {
+		return nil, errors.New("No passphrase available to encrypt the private key")
 	}
-	defer conn.Close()
-	fmt.Println("Successfully connected to Root Certificate Authority.")
-	writer := bufio.NewWriter(conn)
-	// Send two-byte header containing the number of ASN1 bytes transmitted.
-	header := make([]byte, 2)
-	binary.LittleEndian.PutUint16(header, uint16(len(derBytes)))
-	_, err = writer.Write(header)
+	return passphrase, nil
+}
+
+const (
+	// DefaultDialTimeout bounds the connection to the PKI.
+	DefaultDialTimeout = 10 * time.Second
+	// DefaultIOTimeout bounds each exchange with the PKI once connected.
+	DefaultIOTimeout = 30 * time.Second
+	// DefaultHelloTimeout bounds the wait for the v2 answer of a PKI whose
+	// protocol version is not pinned, see WithProtocolVersion.
+	DefaultHelloTimeout = 5 * time.Second
+)
+
+// WithProtocolVersion pins the enrollment protocol to ProtocolV1 or
+// ProtocolV2. By default v2 is tried first and v1 used when the PKI closes
+// the connection or does not answer the v2 hello within
+// DefaultHelloTimeout: some v1 PKIs read the hello as the length of a v1
+// request and wait for the rest. Pin ProtocolV2 once the PKI is known to
+// speak it, so that a dropped connection cannot downgrade the exchange, or
+// ProtocolV1 to skip the probe with an old PKI.
+func WithProtocolVersion(version int) GenerateOption {
+	return func(c *generateConfig) {
+		c.protocolVersion = version
+	}
+}
+
+// EnrollResult describes the certificate saved by an enrollment.
+type EnrollResult struct {
+	Certificate *x509.Certificate
+	// Intermediates are the CA certificates between Certificate and Root,
+	// saved after Certificate in CertFilename.
+	Intermediates []*x509.Certificate
+	Root          *x509.Certificate
+	CertFilename  string
+	KeyFilename   string
+	CAFilename    string
+}
+
+// Generate enrolls certificate with the PKI at ezbpki and saves the key,
+// certificate and CA files. The three files are replaced as a unit and the
+// previous set is kept as a backup, see Rollback.
+func Generate(certificate *x509.CertificateRequest, ezbpki, certFilename, keyFilename, caFileName string, options ...GenerateOption) error {
+	_, err := GenerateContext(context.Background(), certificate, ezbpki, certFilename, keyFilename, caFileName, options...)
+	return err
+}
+
+// GenerateContext is Generate for GUIs and unattended installers: ctx bounds
+// and cancels the whole enrollment, including the wait for a manual
+// approval, each connection and exchange is also bounded by
+// DefaultDialTimeout and DefaultIOTimeout, and the result describes what was
+// saved. Progress is printed unless WithProgress is given.
+func GenerateContext(ctx context.Context, certificate *x509.CertificateRequest, ezbpki, certFilename, keyFilename, caFileName string, options ...GenerateOption) (*EnrollResult, error) {
+	dial := func(ctx context.Context) (net.Conn, error) {
+		return dialContext(ctx, ezbpki)
+	}
+	return generate(ctx, certificate, dialEnroll(dial), nil, certFilename, keyFilename, caFileName, options)
+}
+
+// dialContext connects to the PKI at addr within DefaultDialTimeout.
+func dialContext(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: DefaultDialTimeout}
+	return dialer.DialContext(ctx, "tcp", addr)
+}
+
+// generate creates the key and CSR, enrolls it with enroll, which returns
+// the issued certificate and its CA chain, root last, and saves the result.
+// checkRoot, when set, must accept the root certificate returned by the PKI
+// before anything is written.
+func generate(ctx context.Context, certificate *x509.CertificateRequest, enroll func(ctx context.Context, csr []byte) ([]byte, [][]byte, error), checkRoot func(*x509.Certificate) error, certFilename, keyFilename, caFileName string, options []GenerateOption) (*EnrollResult, error) {
+	config := newGenerateConfig(options)
+	ctx = withProgress(ctx, config.progress)
+	ctx = context.WithValue(ctx, protocolVersionKey{}, config.protocolVersion)
+	// Ask before enrolling so a missing passphrase does not waste a
+	// certificate.
+	store, err := config.keyStore()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// Now send the certificate request data
-	_, err = writer.Write(derBytes)
+	keyType, err := KeyTypeForSignatureAlgorithm(certificate.SignatureAlgorithm)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = writer.Flush()
+	priv, err := store.GenerateKey(keyType)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Failed to generate private key: %v", err)
 	}
-	fmt.Println("Transmitted Certificate Signing Request to RootCA.")
-	// The RootCA will now send our signed certificate back for us to read.
-	reader := bufio.NewReader(conn)
-	// Read header containing the size of the ASN1 data.
-	certHeader := make([]byte, 2)
-	_, err = reader.Read(certHeader)
+	// Keys living in a token must not pile up when enrollment fails.
+	saved := false
+	defer func() {
+		if saved {
+			return
+		}
+		if err := store.DeleteKey(priv); err != nil {
+			logmanager.Warning(fmt.Sprintf("Failed to delete unused private key: %v", err))
+		}
+	}()
+
+	derBytes, err := x509.CreateCertificateRequest(rand.Reader, certificate, priv)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	certSize := binary.LittleEndian.Uint16(certHeader)
-	// Now read the certificate data.
-	certBytes := make([]byte, certSize)
-	_, err = reader.Read(certBytes)
+	reportProgress(ctx, EnrollRequestCreated, "Created Certificate Signing Request for client.")
+	certBytes, chain, err := enrollWaiting(ctx, enroll, derBytes, config.approvalTimeout)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Println("Received new Certificate from RootCA.")
+	reportProgress(ctx, EnrollCertificateReceived, "Received new Certificate from RootCA.")
 	newCert, err := x509.ParseCertificate(certBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	// Finally, the RootCA will send its own certificate back so that we can validate the new certificate.
-	rootCertHeader := make([]byte, 2)
-	_, err = reader.Read(rootCertHeader)
-	if err != nil {
-		return err
+	if len(chain) == 0 {
+		return nil, errors.New("PKI returned no CA certificate")
 	}
-	rootCertSize := binary.LittleEndian.Uint16(rootCertHeader)
-	// Now read the certificate data.
-	rootCertBytes := make([]byte, rootCertSize)
-	_, err = reader.Read(rootCertBytes)
-	if err != nil {
-		return err
+	chainCerts := make([]*x509.Certificate, len(chain))
+	for i, b := range chain {
+		if chainCerts[i], err = x509.ParseCertificate(b); err != nil {
+			return nil, err
+		}
 	}
-	fmt.Println("Received Root Certificate from RootCA.")
-	rootCert, err := x509.ParseCertificate(rootCertBytes)
-	if err != nil {
-		return err
+	rootCert := chainCerts[len(chainCerts)-1]
+	intermediates := chainCerts[:len(chainCerts)-1]
+	reportProgress(ctx, EnrollChainReceived, "Received Root Certificate from RootCA.")
+	if len(intermediates) > 0 {
+		reportProgress(ctx, EnrollChainReceived, "Received %d intermediate CA certificate(s).", len(intermediates))
 	}
 
-	err = ValidateCertificate(newCert, rootCert)
+	if checkRoot != nil {
+		if err = checkRoot(rootCert); err != nil {
+			return nil, err
+		}
+	}
+	usage := config.usage
+	if usage == x509.ExtKeyUsageAny {
+		usage = x509.ExtKeyUsageClientAuth
+	}
+	if _, err = verifyChain(newCert, intermediates, rootCert, usage); err != nil {
+		reportProgress(ctx, EnrollVerified, "Failed to verify chain of trust.")
+		return nil, err
+	}
+	reportProgress(ctx, EnrollVerified, "Successfully verified chain of trust.")
+	if config.productionOnly {
+		if err = CheckProduction(chainCerts...); err != nil {
+			return nil, err
+		}
+	}
+	if err = checkKeyMatch(newCert, priv); err != nil {
+		return nil, err
+	}
+	keyData, err := store.MarshalKey(priv)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// all good save the files
-	keyOut, err := os.OpenFile(keyFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	err = saveCertificateSet(certFilename, keyFilename, caFileName, keyData,
+		append([]*x509.Certificate{newCert}, intermediates...), []*x509.Certificate{rootCert})
 	if err != nil {
-		return fmt.Errorf("Failed to open key %v for writing: %v", keyFilename, err)
+		return nil, err
 	}
-	b, err := x509.MarshalECPrivateKey(priv)
-	if err != nil {
-		return fmt.Errorf("Failed to marshal priv: %v", err)
+	saved = true
+	reportProgress(ctx, EnrollSaved, "Saved certificate in %s.", certFilename)
+	return &EnrollResult{
+		Certificate:   newCert,
+		Intermediates: intermediates,
+		Root:          rootCert,
+		CertFilename:  certFilename,
+		KeyFilename:   keyFilename,
+		CAFilename:    caFileName,
+	}, nil
+}
+
+// dialEnroll returns an enroll function for generate speaking the ezb_pki
+// protocol over connections from dial.
+func dialEnroll(dial func(context.Context) (net.Conn, error)) func(context.Context, []byte) ([]byte, [][]byte, error) {
+	return func(ctx context.Context, csr []byte) ([]byte, [][]byte, error) {
+		return enroll(ctx, dial, csr)
 	}
-	pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
-	keyOut.Close()
+}
 
-	certOut, err := os.Create(certFilename)
-	if err != nil {
-		return fmt.Errorf("Failed to open %v for writing: %v", certFilename, err)
+type protocolVersionKey struct{}
+
+// enroll sends the DER encoded csr to the PKI reached through dial and
+// returns the issued certificate and the CA chain. Unless the version is
+// pinned in ctx, protocol v2 is tried first, falling back to v1 on a new
+// connection when the PKI does not understand it.
+func enroll(ctx context.Context, dial func(context.Context) (net.Conn, error), csr []byte) ([]byte, [][]byte, error) {
+	switch version, _ := ctx.Value(protocolVersionKey{}).(int); version {
+	case 0:
+	case ProtocolV1:
+		return enrollWith(ctx, dial, csr, exchangeV1, false)
+	case ProtocolV2:
+		return enrollWith(ctx, dial, csr, exchangeV2, false)
+	default:
+		return nil, nil, fmt.Errorf("Unsupported enrollment protocol version %d", version)
 	}
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
-	certOut.Close()
+	certBytes, chain, err := enrollWith(ctx, dial, csr, exchangeV2, true)
+	if err == errNotV2 {
+		reportProgress(ctx, EnrollFallback, "Root Certificate Authority does not speak protocol v2, retrying with v1.")
+		certBytes, chain, err = enrollWith(ctx, dial, csr, exchangeV1, false)
+	}
+	return certBytes, chain, err
+}
 
-	caOut, err := os.Create(caFileName)
+// enrollWith runs exchange on a new connection. probe bounds the wait for
+// the first answer by DefaultHelloTimeout, see probeConn.
+func enrollWith(ctx context.Context, dial func(context.Context) (net.Conn, error), csr []byte, exchange func(io.ReadWriter, []byte) ([]byte, [][]byte, error), probe bool) ([]byte, [][]byte, error) {
+	conn, err := dial(ctx)
 	if err != nil {
-		return fmt.Errorf("Failed to open %v for writing: %v", caFileName, err)
+		return nil, nil, contextError(ctx, err)
 	}
-	pem.Encode(caOut, &pem.Block{Type: "CERTIFICATE", Bytes: rootCertBytes})
-	caOut.Close()
-	return nil
+	defer conn.Close()
+	reportProgress(ctx, EnrollConnected, "Successfully connected to Root Certificate Authority.")
+	deadline := ioDeadline(ctx, DefaultIOTimeout)
+	stop := watchConn(ctx, conn, DefaultIOTimeout)
+	defer stop()
+	var reader io.Reader = conn
+	if hello := time.Now().Add(DefaultHelloTimeout); probe && (deadline.IsZero() || hello.Before(deadline)) {
+		conn.SetReadDeadline(hello)
+		if ctx.Err() != nil {
+			conn.SetDeadline(time.Now())
+		}
+		reader = &probeConn{Conn: conn, ctx: ctx, deadline: deadline}
+	}
+	rw := &bufferedConn{bufio.NewReader(reader), bufio.NewWriter(conn)}
+	certBytes, chain, err := exchange(rw, csr)
+	return certBytes, chain, contextError(ctx, err)
 }
 
-func ValidateCertificate(newCert *x509.Certificate, rootCert *x509.Certificate) error {
-	roots := x509.NewCertPool()
-	roots.AddCert(rootCert)
-	verifyOptions := x509.VerifyOptions{
-		Roots:     roots,
-		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+// probeConn reads from a PKI which may only speak v1, whose read deadline
+// is DefaultHelloTimeout away. Such a PKI takes the v2 hello for the length
+// of a v1 request and waits for bytes that never come instead of closing
+// the connection, so a timeout of the first read is errHelloTimeout. The
+// first read then restores the deadline of watchConn.
+type probeConn struct {
+	net.Conn
+	ctx      context.Context
+	deadline time.Time
+	done     bool
+}
+
+func (c *probeConn) Read(b []byte) (int, error) {
+	if c.done {
+		return c.Conn.Read(b)
+	}
+	c.done = true
+	n, err := c.Conn.Read(b)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && c.ctx.Err() == nil {
+		return n, errHelloTimeout
+	}
+	c.Conn.SetReadDeadline(c.deadline)
+	if c.ctx.Err() != nil {
+		c.Conn.SetDeadline(time.Now())
+	}
+	return n, err
+}
+
+// ioDeadline returns the deadline set by watchConn for timeout and ctx,
+// zero for none.
+func ioDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
 	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline
+}
+
+// watchConn bounds the I/O on conn by timeout, when positive, and the
+// deadline of ctx, and interrupts it when ctx is cancelled. stop must be
+// called once done with conn.
+func watchConn(ctx context.Context, conn net.Conn, timeout time.Duration) (stop func()) {
+	conn.SetDeadline(ioDeadline(ctx, timeout))
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// contextError returns the error of ctx instead of err when ctx ended, as
+// the I/O errors caused by watchConn do not tell why.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+type bufferedConn struct {
+	*bufio.Reader
+	*bufio.Writer
+}
+
+// ValidateCertificate verifies newCert chains to rootCert for client
+// authentication and, when revocation checkers are given, that it is not
+// revoked.
+func ValidateCertificate(newCert *x509.Certificate, rootCert *x509.Certificate, revocation ...*RevocationChecker) error {
+	return ValidateChain(newCert, nil, rootCert, revocation...)
+}
 
-	_, err := newCert.Verify(verifyOptions)
+// ValidateChain is ValidateCertificate for a certificate issued by an
+// intermediate CA: newCert must chain to rootCert through intermediates.
+func ValidateChain(newCert *x509.Certificate, intermediates []*x509.Certificate, rootCert *x509.Certificate, revocation ...*RevocationChecker) error {
+	return validateChain(newCert, intermediates, rootCert, x509.ExtKeyUsageClientAuth, revocation...)
+}
+
+func validateChain(newCert *x509.Certificate, intermediates []*x509.Certificate, rootCert *x509.Certificate, usage x509.ExtKeyUsage, revocation ...*RevocationChecker) error {
+	chains, err := verifyChain(newCert, intermediates, rootCert, usage)
 	if err != nil {
-		fmt.Println("Failed to verify chain of trust.")
 		return err
 	}
-	fmt.Println("Successfully verified chain of trust.")
+
+	for _, checker := range revocation {
+		if checker == nil {
+			continue
+		}
+		if err = checker.VerifyPeerCertificate()(nil, chains); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
+
+// verifyChain verifies newCert chains to rootCert through intermediates for
+// usage and returns the chains.
+func verifyChain(newCert *x509.Certificate, intermediates []*x509.Certificate, rootCert *x509.Certificate, usage x509.ExtKeyUsage) ([][]*x509.Certificate, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(rootCert)
+	pool := x509.NewCertPool()
+	for _, cert := range intermediates {
+		pool.AddCert(cert)
+	}
+	verifyOptions := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: pool,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	return newCert.Verify(verifyOptions)
+}
@@ -0,0 +1,608 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
+)
+
+// CRL reason codes of RFC 5280.
+const (
+	ReasonUnspecified          = 0
+	ReasonKeyCompromise        = 1
+	ReasonCACompromise         = 2
+	ReasonAffiliationChanged   = 3
+	ReasonSuperseded           = 4
+	ReasonCessationOfOperation = 5
+	ReasonCertificateHold      = 6
+	// ReasonRemoveFromCRL releases a certificate on hold.
+	ReasonRemoveFromCRL      = 8
+	ReasonPrivilegeWithdrawn = 9
+	ReasonAACompromise       = 10
+)
+
+var reasonNames = map[int]string{
+	ReasonUnspecified:          "unspecified",
+	ReasonKeyCompromise:        "keyCompromise",
+	ReasonCACompromise:         "cACompromise",
+	ReasonAffiliationChanged:   "affiliationChanged",
+	ReasonSuperseded:           "superseded",
+	ReasonCessationOfOperation: "cessationOfOperation",
+	ReasonCertificateHold:      "certificateHold",
+	ReasonRemoveFromCRL:        "removeFromCRL",
+	ReasonPrivilegeWithdrawn:   "privilegeWithdrawn",
+	ReasonAACompromise:         "aACompromise",
+}
+
+// RevocationReasonString returns the RFC 5280 name of reason.
+func RevocationReasonString(reason int) string {
+	if name, ok := reasonNames[reason]; ok {
+		return name
+	}
+	return strconv.Itoa(reason)
+}
+
+// ParseRevocationReason parses a reason code given by its RFC 5280 name,
+// in any case, or its number.
+func ParseRevocationReason(s string) (int, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if _, ok := reasonNames[n]; ok {
+			return n, nil
+		}
+	}
+	for reason, name := range reasonNames {
+		if strings.EqualFold(name, s) {
+			return reason, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown revocation reason %q", s)
+}
+
+// DefaultCRLValidity is the time between the issue of a CRL and its next
+// update, see Server.CRLValidity.
+const DefaultCRLValidity = 24 * time.Hour
+
+// IssuedCertificate is a certificate recorded in a RevocationDB.
+type IssuedCertificate struct {
+	// Serial is the serial number in uppercase hex.
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	SANs      []string  `json:"sans"`
+	NotBefore time.Time `json:"notbefore"`
+	NotAfter  time.Time `json:"notafter"`
+	// RevokedAt is zero while the certificate is not revoked.
+	RevokedAt time.Time `json:"revokedat,omitempty"`
+	Reason    int       `json:"reason,omitempty"`
+}
+
+// Status returns "revoked", "expired" or "valid".
+func (c *IssuedCertificate) Status() string {
+	switch {
+	case !c.RevokedAt.IsZero():
+		return "revoked"
+	case time.Now().After(c.NotAfter):
+		return "expired"
+	}
+	return "valid"
+}
+
+// RevocationDB records the certificates issued by a Server so they can be
+// revoked. Set it as Server.Revocations. Like ApprovalQueue, each
+// certificate is a JSON file in the database folder, so an operator can
+// revoke from another process while the server runs; the server notices
+// and issues a new CRL.
+type RevocationDB struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// OpenRevocationDB opens the database in dir, creating the folder if needed.
+func OpenRevocationDB(dir string) (*RevocationDB, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &RevocationDB{dir: dir}, nil
+}
+
+// normalizeSerial accepts a serial number in hex, in any case, with or
+// without colons, and returns it in the form of IssuedCertificate.Serial.
+func normalizeSerial(serial string) (string, error) {
+	clean := strings.NewReplacer(":", "", " ", "").Replace(serial)
+	n, ok := new(big.Int).SetString(clean, 16)
+	if !ok || n.Sign() <= 0 {
+		return "", fmt.Errorf("Invalid serial number %q", serial)
+	}
+	return formatSerial(n), nil
+}
+
+// formatSerial is the one form of serial numbers in the package, in the
+// revocation database, the audit log, inventories and errors alike: upper
+// case hex without leading zeros.
+func formatSerial(n *big.Int) string {
+	return strings.ToUpper(n.Text(16))
+}
+
+func (db *RevocationDB) filename(serial string) string {
+	return filepath.Join(db.dir, serial+".json")
+}
+
+func (db *RevocationDB) load(serial string) (*IssuedCertificate, error) {
+	data, err := ioutil.ReadFile(db.filename(serial))
+	if err != nil {
+		return nil, err
+	}
+	var c IssuedCertificate
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("Failed to read certificate %s: %v", serial, err)
+	}
+	return &c, nil
+}
+
+func (db *RevocationDB) save(c *IssuedCertificate) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(db.filename(c.Serial), data, 0600)
+}
+
+// add records cert, just issued.
+func (db *RevocationDB) add(cert *x509.Certificate) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.save(&IssuedCertificate{
+		Serial:    formatSerial(cert.SerialNumber),
+		Subject:   cert.Subject.String(),
+		SANs:      sanList(cert.DNSNames, cert.IPAddresses, cert.EmailAddresses, cert.URIs),
+		NotBefore: cert.NotBefore.UTC(),
+		NotAfter:  cert.NotAfter.UTC(),
+	})
+}
+
+// remove forgets cert, issued but never handed out.
+func (db *RevocationDB) remove(cert *x509.Certificate) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return os.Remove(db.filename(formatSerial(cert.SerialNumber)))
+}
+
+// Get returns the certificate with serial.
+func (db *RevocationDB) Get(serial string) (*IssuedCertificate, error) {
+	serial, err := normalizeSerial(serial)
+	if err != nil {
+		return nil, err
+	}
+	c, err := db.load(serial)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Unknown certificate %s", serial)
+	}
+	return c, err
+}
+
+// List returns the recorded certificates, oldest first.
+func (db *RevocationDB) List() ([]*IssuedCertificate, error) {
+	files, err := filepath.Glob(filepath.Join(db.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var out []*IssuedCertificate
+	for _, f := range files {
+		c, err := db.load(strings.TrimSuffix(filepath.Base(f), ".json"))
+		if err != nil {
+			logmanager.Warning(fmt.Sprintf("Revocation database: skipping %s: %v", f, err))
+			continue
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].NotBefore.Before(out[j].NotBefore) })
+	return out, nil
+}
+
+// Revoke revokes the certificate with serial for reason, a RFC 5280 reason
+// code. A certificate on hold, ReasonCertificateHold, can be revoked again
+// with a final reason or released with ReasonRemoveFromCRL. The change is
+// published by the next CRL, see Server.Revoke.
+func (db *RevocationDB) Revoke(serial string, reason int) error {
+	if _, ok := reasonNames[reason]; !ok {
+		return fmt.Errorf("Invalid revocation reason %d", reason)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	c, err := db.Get(serial)
+	if err != nil {
+		return err
+	}
+	onHold := !c.RevokedAt.IsZero() && c.Reason == ReasonCertificateHold
+	switch {
+	case reason == ReasonRemoveFromCRL:
+		if !onHold {
+			return fmt.Errorf("Certificate %s is not on hold", c.Serial)
+		}
+		c.RevokedAt, c.Reason = time.Time{}, 0
+	case !c.RevokedAt.IsZero() && !onHold:
+		return fmt.Errorf("Certificate %s is already revoked", c.Serial)
+	default:
+		if !onHold {
+			c.RevokedAt = time.Now().UTC().Truncate(time.Second)
+		}
+		c.Reason = reason
+	}
+	if err = db.save(c); err != nil {
+		return err
+	}
+	logmanager.Warning(fmt.Sprintf("Revocation database: certificate %s for %s %s (%s)", c.Serial, c.Subject, c.Status(), RevocationReasonString(reason)))
+	return nil
+}
+
+// revoked returns the CRL entries of the revoked certificates not expired
+// at now. Expired certificates leave the CRL, as RFC 5280 allows.
+func (db *RevocationDB) revoked(now time.Time) ([]pkix.RevokedCertificate, error) {
+	certs, err := db.List()
+	if err != nil {
+		return nil, err
+	}
+	var out []pkix.RevokedCertificate
+	for _, c := range certs {
+		if c.RevokedAt.IsZero() || now.After(c.NotAfter) {
+			continue
+		}
+		serial, _ := new(big.Int).SetString(c.Serial, 16)
+		entry := pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: c.RevokedAt}
+		if c.Reason != ReasonUnspecified {
+			value, err := asn1.Marshal(asn1.Enumerated(c.Reason))
+			if err != nil {
+				return nil, err
+			}
+			entry.Extensions = []pkix.Extension{{Id: oidCRLReasonCode, Value: value}}
+		}
+		out = append(out, entry)
+	}
+	return out, nil
+}
+
+// nextCRLNumber returns the number of the next CRL, increasing across
+// restarts as RFC 5280 requires.
+func (db *RevocationDB) nextCRLNumber() (int64, error) {
+	filename := filepath.Join(db.dir, "crlnumber")
+	var n int64
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		if n, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return 0, fmt.Errorf("Invalid CRL number in %s", filename)
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	n++
+	if err = writeFileAtomic(filename, []byte(strconv.FormatInt(n, 10)+"\n"), 0600); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// WriteRevocationTable renders certs as a human readable table.
+func WriteRevocationTable(w io.Writer, certs []*IssuedCertificate) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERIAL\tSTATUS\tSUBJECT\tNOT AFTER\tREVOKED\tREASON")
+	for _, c := range certs {
+		revoked, reason := "-", "-"
+		if !c.RevokedAt.IsZero() {
+			revoked = c.RevokedAt.Local().Format("2006-01-02 15:04:05")
+			reason = RevocationReasonString(c.Reason)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Serial, c.Status(), c.Subject,
+			c.NotAfter.Local().Format("2006-01-02"), revoked, reason)
+	}
+	return tw.Flush()
+}
+
+var (
+	oidCRLNumber                = asn1.ObjectIdentifier{2, 5, 29, 20}
+	oidAuthorityKeyIdentifier   = asn1.ObjectIdentifier{2, 5, 29, 35}
+	oidSignatureECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidSignatureECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidSignatureECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidSignatureSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSignatureEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// signatureAlgorithmFor returns the algorithm identifier and the hash of
+// the signatures made with the private key of pub.
+func signatureAlgorithmFor(pub crypto.PublicKey) (pkix.AlgorithmIdentifier, crypto.Hash, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA256}, crypto.SHA256, nil
+		case elliptic.P384():
+			return pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA384}, crypto.SHA384, nil
+		case elliptic.P521():
+			return pkix.AlgorithmIdentifier{Algorithm: oidSignatureECDSAWithSHA512}, crypto.SHA512, nil
+		}
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSignatureSHA256WithRSA, Parameters: asn1.NullRawValue}, crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSignatureEd25519}, crypto.Hash(0), nil
+	}
+	return pkix.AlgorithmIdentifier{}, 0, fmt.Errorf("Unsupported CA key type %T", pub)
+}
+
+// createCRL returns a DER encoded v2 CRL of issuer listing revoked, with a
+// CRL number and the authority key identifier, which x509.CreateCRL does
+// not add.
+func createCRL(issuer *x509.Certificate, key crypto.Signer, revoked []pkix.RevokedCertificate, number int64, thisUpdate, nextUpdate time.Time) ([]byte, error) {
+	sigAlg, hash, err := signatureAlgorithmFor(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	var issuerName pkix.RDNSequence
+	if _, err = asn1.Unmarshal(issuer.RawSubject, &issuerName); err != nil {
+		return nil, err
+	}
+	numberValue, err := asn1.Marshal(big.NewInt(number))
+	if err != nil {
+		return nil, err
+	}
+	tbs := pkix.TBSCertificateList{
+		Version:             1,
+		Signature:           sigAlg,
+		Issuer:              issuerName,
+		ThisUpdate:          thisUpdate.UTC(),
+		NextUpdate:          nextUpdate.UTC(),
+		RevokedCertificates: revoked,
+		Extensions:          []pkix.Extension{{Id: oidCRLNumber, Value: numberValue}},
+	}
+	if len(issuer.SubjectKeyId) > 0 {
+		aki, err := asn1.Marshal(struct {
+			ID []byte `asn1:"optional,tag:0"`
+		}{issuer.SubjectKeyId})
+		if err != nil {
+			return nil, err
+		}
+		tbs.Extensions = append(tbs.Extensions, pkix.Extension{Id: oidAuthorityKeyIdentifier, Value: aki})
+	}
+	tbsBytes, err := asn1.Marshal(tbs)
+	if err != nil {
+		return nil, err
+	}
+	digest := tbsBytes
+	if hash != 0 {
+		h := hash.New()
+		h.Write(tbsBytes)
+		digest = h.Sum(nil)
+	}
+	sig, err := key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign CRL: %v", err)
+	}
+	tbs.Raw = tbsBytes
+	return asn1.Marshal(pkix.CertificateList{
+		TBSCertList:        tbs,
+		SignatureAlgorithm: sigAlg,
+		SignatureValue:     asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)},
+	})
+}
+
+// CRL returns the current CRL of the server, DER encoded. A new one is
+// issued when the previous one is past half its validity or the revocation
+// database changed since.
+func (s *Server) CRL() ([]byte, error) {
+	if s.Revocations == nil {
+		return nil, errors.New("Server has no revocation database")
+	}
+	s.crlMu.Lock()
+	defer s.crlMu.Unlock()
+	stamp, err := stampOf(s.Revocations.dir)
+	if err != nil {
+		return nil, err
+	}
+	if s.crl != nil && time.Now().Before(s.crlRefresh) && stamp == s.crlStamp {
+		return s.crl, nil
+	}
+	return s.issueCRL()
+}
+
+// issueCRL signs a new CRL and writes it to the PublishCRL file. crlMu
+// must be held.
+func (s *Server) issueCRL() ([]byte, error) {
+	db := s.Revocations
+	validity := s.CRLValidity
+	if validity <= 0 {
+		validity = DefaultCRLValidity
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	revoked, err := db.revoked(now)
+	if err != nil {
+		return nil, err
+	}
+	number, err := db.nextCRLNumber()
+	if err != nil {
+		return nil, err
+	}
+	crl, err := createCRL(s.caCert, s.caKey, revoked, number, now, now.Add(validity))
+	if err != nil {
+		return nil, err
+	}
+	if s.crlFilename != "" {
+		if err = writeFileAtomic(s.crlFilename, crl, 0644); err != nil {
+			return nil, err
+		}
+	}
+	// Taken after nextCRLNumber, which changes the folder too.
+	if s.crlStamp, err = stampOf(db.dir); err != nil {
+		return nil, err
+	}
+	s.crl = crl
+	s.crlRefresh = now.Add(validity / 2)
+	logmanager.Info(fmt.Sprintf("PKI signer: issued CRL %d with %d revoked certificate(s)", number, len(revoked)))
+	return crl, nil
+}
+
+// Revoke revokes serial in the revocation database and issues a new CRL at
+// once.
+func (s *Server) Revoke(serial string, reason int) error {
+	if s.Revocations == nil {
+		return errors.New("Server has no revocation database")
+	}
+	if err := s.Revocations.Revoke(serial, reason); err != nil {
+		return err
+	}
+	s.crlMu.Lock()
+	defer s.crlMu.Unlock()
+	_, err := s.issueCRL()
+	return err
+}
+
+// checkNotRevoked returns an error if cert is revoked or on hold in the
+// revocation database. Certificates the database does not know, issued
+// before it was set up, pass.
+func (s *Server) checkNotRevoked(cert *x509.Certificate) error {
+	if s.Revocations == nil {
+		return nil
+	}
+	c, err := s.Revocations.load(formatSerial(cert.SerialNumber))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !c.RevokedAt.IsZero() {
+		return fmt.Errorf("Certificate %s is revoked (%s)", c.Serial, RevocationReasonString(c.Reason))
+	}
+	return nil
+}
+
+// PublishCRL writes the CRL to filename now, then keeps it current until
+// Close is called: a new CRL is written after every revocation and before
+// the previous one is past half its validity. Use it to publish the CRL
+// through another web server, or CRLHandler to serve it directly.
+func (s *Server) PublishCRL(filename string) error {
+	s.crlMu.Lock()
+	s.crlFilename = filename
+	s.crl = nil
+	s.crlMu.Unlock()
+	if _, err := s.CRL(); err != nil {
+		return err
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(crlCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-ticker.C:
+				if _, err := s.CRL(); err != nil {
+					logmanager.Error(fmt.Sprintf("PKI signer: cannot issue CRL: %v", err))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// crlCheckInterval is how often PublishCRL looks for revocations made by
+// other processes.
+const crlCheckInterval = 10 * time.Second
+
+// CRLHandler serves the current CRL, DER encoded, as named in
+// SignPolicy.CRLDistributionPoints.
+func (s *Server) CRLHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		crl, err := s.CRL()
+		if err != nil {
+			logmanager.Error(fmt.Sprintf("PKI signer: cannot issue CRL: %v", err))
+			http.Error(w, "CRL unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Header().Set("Content-Length", strconv.Itoa(len(crl)))
+		w.Write(crl)
+	})
+}
+
+// ListenAndServeCRL serves CRLHandler over plain HTTP on addr until Close
+// is called. CRLs are signed, and fetching them over TLS would make
+// checking the server certificate depend on the CRL itself.
+func (s *Server) ListenAndServeCRL(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return fmt.Errorf("server closed")
+	}
+	s.crlListener = l
+	s.mu.Unlock()
+	logmanager.Info(fmt.Sprintf("CRL server listening on %s", l.Addr()))
+
+	srv := &http.Server{Handler: s.CRLHandler(), ReadHeaderTimeout: 10 * time.Second}
+	err = srv.Serve(l)
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil
+	}
+	return err
+}
+
+// CRLAddr returns the CRL listening address, or nil before
+// ListenAndServeCRL is called.
+func (s *Server) CRLAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.crlListener == nil {
+		return nil
+	}
+	return s.crlListener.Addr()
+}
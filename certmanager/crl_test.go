@@ -0,0 +1,191 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"path/filepath"
+	"testing"
+)
+
+// parseTestCRL checks the CRL of s is signed by its CA and returns it with
+// its CRL number.
+func parseTestCRL(t *testing.T, s *Server) (*pkix.CertificateList, int64) {
+	t.Helper()
+	der, err := s.CRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseCRL(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.CACertificate().CheckCRLSignature(crl); err != nil {
+		t.Fatal(err)
+	}
+	var number int64 = -1
+	for _, ext := range crl.TBSCertList.Extensions {
+		if ext.Id.Equal(oidCRLNumber) {
+			if _, err = asn1.Unmarshal(ext.Value, &number); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if number < 0 {
+		t.Fatal("CRL has no number")
+	}
+	return crl, number
+}
+
+// listedReason returns the reason listed for serial in crl, or -1 when
+// serial is not listed.
+func listedReason(crl *pkix.CertificateList, serial string) int {
+	for _, entry := range crl.TBSCertList.RevokedCertificates {
+		if formatSerial(entry.SerialNumber) == serial {
+			return crlReason(entry.Extensions)
+		}
+	}
+	return -1
+}
+
+// newRevokingServer returns a server with a revocation database, keeping
+// its CA and database in dir so it can be restarted.
+func newRevokingServer(t *testing.T, dir string) *Server {
+	t.Helper()
+	s, err := NewServer(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), "test root", DefaultSignPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if s.Revocations, err = OpenRevocationDB(filepath.Join(dir, "revocations")); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRevokeHoldRelease(t *testing.T) {
+	s := newRevokingServer(t, tempDir(t))
+	addr := serve(t, s)
+	var serials []string
+	for _, cn := range []string{"node1", "node2"} {
+		result, err := newTestFiles(t).generate(addr, cn, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serials = append(serials, formatSerial(result.Certificate.SerialNumber))
+	}
+	held, revoked := serials[0], serials[1]
+
+	if err := s.Revoke(held, ReasonRemoveFromCRL); err == nil {
+		t.Error("released a certificate not on hold")
+	}
+	if err := s.Revoke(held, ReasonCertificateHold); err != nil {
+		t.Fatal(err)
+	}
+	crl, _ := parseTestCRL(t, s)
+	if reason := listedReason(crl, held); reason != ReasonCertificateHold {
+		t.Errorf("held certificate listed with reason %d", reason)
+	}
+	if err := s.Revoke(held, ReasonRemoveFromCRL); err != nil {
+		t.Fatal(err)
+	}
+	crl, _ = parseTestCRL(t, s)
+	if reason := listedReason(crl, held); reason != -1 {
+		t.Errorf("released certificate still listed with reason %d", reason)
+	}
+
+	// A certificate on hold can be revoked for good, once.
+	if err := s.Revoke(revoked, ReasonCertificateHold); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Revoke(revoked, ReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Revoke(revoked, ReasonSuperseded); err == nil {
+		t.Error("revoked a certificate twice")
+	}
+	if err := s.Revoke(revoked, ReasonRemoveFromCRL); err == nil {
+		t.Error("released a revoked certificate")
+	}
+	crl, _ = parseTestCRL(t, s)
+	if reason := listedReason(crl, revoked); reason != ReasonKeyCompromise {
+		t.Errorf("revoked certificate listed with reason %d", reason)
+	}
+	if c, err := s.Revocations.Get(revoked); err != nil || c.Status() != "revoked" {
+		t.Errorf("database holds %+v, %v", c, err)
+	}
+}
+
+func TestCRLNumberAcrossRestarts(t *testing.T) {
+	dir := tempDir(t)
+	s := newRevokingServer(t, dir)
+	_, first := parseTestCRL(t, s)
+	result, err := newTestFiles(t).generate(serve(t, s), "node1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Revoke(formatSerial(result.Certificate.SerialNumber), ReasonUnspecified); err != nil {
+		t.Fatal(err)
+	}
+	_, second := parseTestCRL(t, s)
+	if second <= first {
+		t.Errorf("CRL number %d after %d", second, first)
+	}
+	s.Close()
+
+	restarted := newRevokingServer(t, dir)
+	crl, third := parseTestCRL(t, restarted)
+	if third <= second {
+		t.Errorf("CRL number %d after a restart, following %d", third, second)
+	}
+	if listedReason(crl, formatSerial(result.Certificate.SerialNumber)) != ReasonUnspecified {
+		t.Error("revocation lost across a restart")
+	}
+}
+
+func TestESTReenrollRevoked(t *testing.T) {
+	s := newRevokingServer(t, tempDir(t))
+	url, _ := serveEST(t, s, map[string]string{"node": "secret"})
+	roots := x509.NewCertPool()
+	roots.AddCert(s.RootCertificate())
+	client := &ESTClient{Server: url, RootCAs: roots, Username: "node", Password: "secret"}
+	defer client.CloseIdleConnections()
+
+	files := newTestFiles(t)
+	result, err := GenerateESTContext(context.Background(), NewCertificateRequest("node1", 0, nil), client, files.cert, files.key, files.ca, WithProgress(quiet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Revoke(formatSerial(result.Certificate.SerialNumber), ReasonCertificateHold); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.checkNotRevoked(result.Certificate); err == nil {
+		t.Fatal("certificate on hold passed")
+	}
+	if err = ReenrollEST(client, files.cert, files.key, files.ca, nil, WithProgress(quiet)); err == nil {
+		t.Fatal("certificate on hold reenrolled")
+	}
+	current, err := loadCertificate(files.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !current.Equal(result.Certificate) {
+		t.Error("files replaced by a refused reenrollment")
+	}
+}
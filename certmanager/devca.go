@@ -0,0 +1,134 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
+)
+
+// OIDDevelopmentCA marks certificates of a development CA and everything it
+// issues. Like OIDRequestedValidity it lives in the IANA experimental arc.
+var OIDDevelopmentCA = asn1.ObjectIdentifier{1, 3, 6, 1, 3, 4242, 2}
+
+// ErrDevelopmentCA is returned when a development certificate is refused.
+var ErrDevelopmentCA = errors.New("Certificate issued by an ezBastion development CA, refused in production")
+
+// developmentMarker is appended to the common name of a development CA and
+// is the value of its OIDDevelopmentCA extension.
+const developmentMarker = "DEVELOPMENT ONLY - NOT FOR PRODUCTION"
+
+func developmentExtension() pkix.Extension {
+	value, _ := asn1.Marshal(developmentMarker)
+	return pkix.Extension{Id: OIDDevelopmentCA, Value: value}
+}
+
+// CreateDevCA creates a self-signed development root CA. Its certificate
+// carries the OIDDevelopmentCA extension, copied into every certificate it
+// issues, so CheckProduction and WithProductionCA can refuse them.
+func CreateDevCA(caCertFilename, caKeyFilename, commonName string) error {
+	_, errCert := os.Stat(caCertFilename)
+	_, errKey := os.Stat(caKeyFilename)
+	if !os.IsNotExist(errCert) || !os.IsNotExist(errKey) {
+		return fmt.Errorf("%s or %s already exists", caCertFilename, caKeyFilename)
+	}
+	return createRootCA(caCertFilename, caKeyFilename, commonName+" ("+developmentMarker+")", developmentExtension())
+}
+
+// GenerateOffline is Generate without a PKI: the certificate is issued by
+// the development CA in caCertFilename and caKeyFilename, created with
+// commonName "ezBastion dev CA" if missing, and saved with the same files
+// and layout as Generate.
+func GenerateOffline(certificate *x509.CertificateRequest, caCertFilename, caKeyFilename, certFilename, keyFilename, caFileName string, options ...GenerateOption) error {
+	_, err := GenerateOfflineContext(context.Background(), certificate, caCertFilename, caKeyFilename, certFilename, keyFilename, caFileName, options...)
+	return err
+}
+
+// GenerateOfflineContext is GenerateOffline bounded by ctx and reporting
+// what it saved, like GenerateContext.
+func GenerateOfflineContext(ctx context.Context, certificate *x509.CertificateRequest, caCertFilename, caKeyFilename, certFilename, keyFilename, caFileName string, options ...GenerateOption) (*EnrollResult, error) {
+	_, errCert := os.Stat(caCertFilename)
+	_, errKey := os.Stat(caKeyFilename)
+	if os.IsNotExist(errCert) && os.IsNotExist(errKey) {
+		if err := CreateDevCA(caCertFilename, caKeyFilename, "ezBastion dev CA"); err != nil {
+			return nil, err
+		}
+		logmanager.Warning(fmt.Sprintf("Created development CA %s, not for production use", caCertFilename))
+	}
+	s, err := NewServer(caCertFilename, caKeyFilename, "", DefaultSignPolicy())
+	if err != nil {
+		return nil, err
+	}
+	if !IsDevelopmentCertificate(s.caCert) {
+		return nil, fmt.Errorf("%s is not a development CA", caCertFilename)
+	}
+	// Run the regular enrollment against the local signer over an
+	// in-memory connection so files and checks are the same as Generate.
+	dial := func(context.Context) (net.Conn, error) {
+		client, server := net.Pipe()
+		go s.handle(server)
+		return client, nil
+	}
+	return generate(ctx, certificate, dialEnroll(dial), nil, certFilename, keyFilename, caFileName, options)
+}
+
+// IsDevelopmentCertificate reports whether cert was created by CreateDevCA
+// or issued from such a CA.
+func IsDevelopmentCertificate(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(OIDDevelopmentCA) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckProduction returns ErrDevelopmentCA if any certificate of chain comes
+// from a development CA.
+func CheckProduction(chain ...*x509.Certificate) error {
+	for _, cert := range chain {
+		if IsDevelopmentCertificate(cert) {
+			return ErrDevelopmentCA
+		}
+	}
+	return nil
+}
+
+// RefuseDevelopmentCA is a tls.Config.VerifyPeerCertificate hook refusing
+// peers whose verified chain comes from a development CA.
+func RefuseDevelopmentCA(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		if err := CheckProduction(chain...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithProductionCA makes Generate refuse certificates from a development CA.
+func WithProductionCA() GenerateOption {
+	return func(c *generateConfig) {
+		c.productionOnly = true
+	}
+}
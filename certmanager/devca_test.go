@@ -0,0 +1,79 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func hasExtension(cert *x509.Certificate, id asn1.ObjectIdentifier) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGenerateOfflineDevelopmentCA(t *testing.T) {
+	dir := tempDir(t)
+	caCert, caKey := filepath.Join(dir, "dev-ca.crt"), filepath.Join(dir, "dev-ca.key")
+	request := NewCertificateRequest("node1", 0, nil)
+	files := newTestFiles(t)
+	result, err := GenerateOfflineContext(context.Background(), request, caCert, caKey, files.cert, files.key, files.ca, WithProgress(quiet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cert := range []*x509.Certificate{result.Certificate, result.Root} {
+		if !hasExtension(cert, OIDDevelopmentCA) {
+			t.Errorf("%s does not carry the development marker", cert.Subject.CommonName)
+		}
+	}
+	chain := []*x509.Certificate{result.Certificate, result.Root}
+	if err = CheckProduction(chain...); err != ErrDevelopmentCA {
+		t.Errorf("CheckProduction: %v", err)
+	}
+	if err = RefuseDevelopmentCA(nil, [][]*x509.Certificate{chain}); err != ErrDevelopmentCA {
+		t.Errorf("RefuseDevelopmentCA: %v", err)
+	}
+
+	// The same enrollment is refused, and nothing written, in production.
+	refused := newTestFiles(t)
+	_, err = GenerateOfflineContext(context.Background(), request, caCert, caKey, refused.cert, refused.key, refused.ca, WithProgress(quiet), WithProductionCA())
+	if err != ErrDevelopmentCA {
+		t.Fatalf("expected ErrDevelopmentCA, got %v", err)
+	}
+	for _, filename := range []string{refused.cert, refused.key, refused.ca} {
+		if _, err = os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("%s written for a development certificate", filename)
+		}
+	}
+
+	// A production CA is not mistaken for a development one.
+	production, err := newTestFiles(t).generate(serve(t, newServer(t, DefaultSignPolicy())), "node1", nil, WithProductionCA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain = []*x509.Certificate{production.Certificate, production.Root}
+	if err = RefuseDevelopmentCA(nil, [][]*x509.Certificate{chain}); err != nil {
+		t.Errorf("production chain refused: %v", err)
+	}
+}
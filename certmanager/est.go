@@ -0,0 +1,306 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ESTClient enrolls with an EST (RFC 7030) server, as an alternative to the
+// ezb_pki protocol for sites running an enterprise CA.
+type ESTClient struct {
+	// Server is the base URL of the EST server, e.g. https://est.example.com.
+	Server string
+	// Label selects one of several CAs served by the same server.
+	Label string
+	// Username and Password enable HTTP basic authentication.
+	Username string
+	Password string
+	// Certificate authenticates the client with TLS; simplereenroll needs
+	// the certificate being renewed here.
+	Certificate *tls.Certificate
+	// RootCAs authenticates the EST server. The system pool is used when
+	// nil.
+	RootCAs    *x509.CertPool
+	HTTPClient *http.Client
+
+	// mu guards the client built from Certificate and RootCAs when
+	// HTTPClient is nil, kept so connections are reused between requests.
+	mu          sync.Mutex
+	httpClient  *http.Client
+	clientCert  *tls.Certificate
+	clientRoots *x509.CertPool
+}
+
+// CACerts returns the current CA certificates of the EST server.
+func (c *ESTClient) CACerts() ([]*x509.Certificate, error) {
+	return c.caCerts(context.Background())
+}
+
+func (c *ESTClient) caCerts(ctx context.Context) ([]*x509.Certificate, error) {
+	body, err := c.do(ctx, http.MethodGet, "cacerts", nil)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeCertsOnly(body)
+}
+
+// SimpleEnroll requests a certificate for the DER encoded csr.
+func (c *ESTClient) SimpleEnroll(csr []byte) (*x509.Certificate, error) {
+	return c.enroll(context.Background(), "simpleenroll", csr)
+}
+
+// SimpleReenroll renews the certificate set in c.Certificate. csr must carry
+// the same subject and SANs.
+func (c *ESTClient) SimpleReenroll(csr []byte) (*x509.Certificate, error) {
+	if c.Certificate == nil {
+		return nil, errors.New("EST reenrollment needs the current certificate")
+	}
+	return c.enroll(context.Background(), "simplereenroll", csr)
+}
+
+func (c *ESTClient) enroll(ctx context.Context, operation string, csr []byte) (*x509.Certificate, error) {
+	body, err := c.do(ctx, http.MethodPost, operation, csr)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := DecodeCertsOnly(body)
+	if err != nil {
+		return nil, err
+	}
+	return certs[0], nil
+}
+
+func (c *ESTClient) url(operation string) string {
+	u := strings.TrimSuffix(c.Server, "/") + "/.well-known/est/"
+	if c.Label != "" {
+		u += c.Label + "/"
+	}
+	return u + operation
+}
+
+// client returns HTTPClient, or a client built once for Certificate and
+// RootCAs and built again if they change.
+func (c *ESTClient) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.httpClient != nil && c.clientCert == c.Certificate && c.clientRoots == c.RootCAs {
+		return c.httpClient
+	}
+	if c.httpClient != nil {
+		c.httpClient.CloseIdleConnections()
+	}
+	config := &tls.Config{RootCAs: c.RootCAs, MinVersion: tls.VersionTLS12}
+	if c.Certificate != nil {
+		config.Certificates = []tls.Certificate{*c.Certificate}
+	}
+	c.httpClient = &http.Client{
+		Timeout:   time.Minute,
+		Transport: &http.Transport{TLSClientConfig: config, IdleConnTimeout: 90 * time.Second},
+	}
+	c.clientCert, c.clientRoots = c.Certificate, c.RootCAs
+	return c.httpClient
+}
+
+// CloseIdleConnections closes the connections kept open to the EST server.
+func (c *ESTClient) CloseIdleConnections() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.httpClient != nil {
+		c.httpClient.CloseIdleConnections()
+	}
+}
+
+// withCertificate returns a client of the same server authenticating with
+// cert.
+func (c *ESTClient) withCertificate(cert *tls.Certificate) *ESTClient {
+	return &ESTClient{
+		Server:      c.Server,
+		Label:       c.Label,
+		Username:    c.Username,
+		Password:    c.Password,
+		Certificate: cert,
+		RootCAs:     c.RootCAs,
+		HTTPClient:  c.HTTPClient,
+	}
+}
+
+func (c *ESTClient) do(ctx context.Context, method, operation string, payload []byte) ([]byte, error) {
+	var body io.Reader
+	if payload != nil {
+		body = strings.NewReader(encodeBase64Lines(payload))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.url(operation), body)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/pkcs10")
+		req.Header.Set("Content-Transfer-Encoding", "base64")
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("EST %s failed: %v", operation, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxFrameSize))
+	if err != nil {
+		return nil, fmt.Errorf("EST %s failed: %v", operation, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusAccepted:
+		retry := time.Minute
+		if secs, err := time.ParseDuration(resp.Header.Get("Retry-After") + "s"); err == nil {
+			retry = secs
+		}
+		return nil, &PendingError{RetryAfter: retry}
+	default:
+		return nil, fmt.Errorf("EST %s failed: %s: %s", operation, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return decodeBase64Body(data), nil
+}
+
+// encodeBase64Lines encodes b in base64 with 64 character lines.
+func encodeBase64Lines(b []byte) string {
+	s := base64.StdEncoding.EncodeToString(b)
+	var buf strings.Builder
+	for len(s) > 64 {
+		buf.WriteString(s[:64])
+		buf.WriteString("\r\n")
+		s = s[64:]
+	}
+	buf.WriteString(s)
+	return buf.String()
+}
+
+// decodeBase64Body decodes an EST body, which RFC 7030 sends in base64 but
+// some servers send as raw DER.
+func decodeBase64Body(data []byte) []byte {
+	clean := bytes.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, data)
+	if der, err := base64.StdEncoding.DecodeString(string(clean)); err == nil {
+		return der
+	}
+	return data
+}
+
+// GenerateEST is Generate against an EST server: certificate is enrolled
+// with simpleenroll and saved, with the CA chain from cacerts, in the same
+// files and layout as Generate.
+func GenerateEST(certificate *x509.CertificateRequest, client *ESTClient, certFilename, keyFilename, caFileName string, options ...GenerateOption) error {
+	_, err := GenerateESTContext(context.Background(), certificate, client, certFilename, keyFilename, caFileName, options...)
+	return err
+}
+
+// GenerateESTContext is GenerateEST bounded by ctx and reporting what it
+// saved, like GenerateContext.
+func GenerateESTContext(ctx context.Context, certificate *x509.CertificateRequest, client *ESTClient, certFilename, keyFilename, caFileName string, options ...GenerateOption) (*EnrollResult, error) {
+	return generate(ctx, certificate, client.enrollFunc("simpleenroll"), nil, certFilename, keyFilename, caFileName, options)
+}
+
+// ReenrollEST renews the certificate saved by GenerateEST with
+// simplereenroll, authenticating with it, and replaces the files like
+// Generate. keyPassphrase decrypts the current key and may be nil; a key
+// held by the WithKeyStore store is loaded from it instead.
+func ReenrollEST(client *ESTClient, certFilename, keyFilename, caFileName string, keyPassphrase []byte, options ...GenerateOption) error {
+	_, err := ReenrollESTContext(context.Background(), client, certFilename, keyFilename, caFileName, keyPassphrase, options...)
+	return err
+}
+
+// ReenrollESTContext is ReenrollEST bounded by ctx and reporting what it
+// saved, like GenerateContext.
+func ReenrollESTContext(ctx context.Context, client *ESTClient, certFilename, keyFilename, caFileName string, keyPassphrase []byte, options ...GenerateOption) (*EnrollResult, error) {
+	var current tls.Certificate
+	var err error
+	if store := newGenerateConfig(options).store; store != nil {
+		current, err = LoadX509KeyPairFrom(store, certFilename, keyFilename)
+	} else {
+		current, err = LoadX509KeyPair(certFilename, keyFilename, keyPassphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reenroll := client.withCertificate(&current)
+	defer reenroll.CloseIdleConnections()
+	return generate(ctx, requestFromCertificate(current.Leaf), reenroll.enrollFunc("simplereenroll"), nil, certFilename, keyFilename, caFileName, options)
+}
+
+func (c *ESTClient) enrollFunc(operation string) func(context.Context, []byte) ([]byte, [][]byte, error) {
+	return func(ctx context.Context, csr []byte) ([]byte, [][]byte, error) {
+		cert, err := c.enroll(ctx, operation, csr)
+		if err != nil {
+			return nil, nil, err
+		}
+		reportProgress(ctx, EnrollConnected, "Successfully enrolled with EST server.")
+		caCerts, err := c.caCerts(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain, err := buildChain(cert, caCerts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cert.Raw, chain, nil
+	}
+}
+
+// buildChain orders the CA certificates issuing cert, from its issuer up to
+// the self-signed root.
+func buildChain(cert *x509.Certificate, caCerts []*x509.Certificate) ([][]byte, error) {
+	var chain [][]byte
+	current := cert
+	for len(chain) <= len(caCerts) {
+		var issuer *x509.Certificate
+		for _, ca := range caCerts {
+			if bytes.Equal(ca.RawSubject, current.RawIssuer) && current.CheckSignatureFrom(ca) == nil {
+				issuer = ca
+				break
+			}
+		}
+		if issuer == nil {
+			return nil, fmt.Errorf("Issuer of %s not found in the CA certificates", current.Subject.CommonName)
+		}
+		chain = append(chain, issuer.Raw)
+		if bytes.Equal(issuer.RawSubject, issuer.RawIssuer) {
+			return chain, nil
+		}
+		current = issuer
+	}
+	return nil, errors.New("CA certificates do not lead to a root")
+}
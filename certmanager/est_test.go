@@ -0,0 +1,101 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// countingListener counts the connections it accepts.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+// serveEST runs the EST handler of s on a local port, as ListenAndServeEST
+// does, counting connections.
+func serveEST(t *testing.T, s *Server, users map[string]string) (string, *countingListener) {
+	t.Helper()
+	config, err := s.tlsConfig("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(s.RootCertificate())
+	config.ClientCAs = roots
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter := &countingListener{Listener: l}
+	go http.Serve(tls.NewListener(counter, config), s.ESTHandler(users))
+	t.Cleanup(func() { l.Close() })
+	return "https://" + l.Addr().String(), counter
+}
+
+func TestESTClientReusesConnections(t *testing.T) {
+	s := newServer(t, DefaultSignPolicy())
+	url, counter := serveEST(t, s, map[string]string{"node": "secret"})
+	roots := x509.NewCertPool()
+	roots.AddCert(s.RootCertificate())
+	client := &ESTClient{Server: url, RootCAs: roots, Username: "node", Password: "secret"}
+	defer client.CloseIdleConnections()
+
+	files := newTestFiles(t)
+	request := NewCertificateRequest("node1", 0, []string{"node1.local"})
+	for i := 0; i < 3; i++ {
+		if err := GenerateEST(request, client, files.cert, files.key, files.ca, WithProgress(quiet)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&counter.accepted); n != 1 {
+		t.Errorf("%d connections for 3 enrollments", n)
+	}
+
+	// Reenrollment authenticates with the certificate, on a client of its
+	// own.
+	if err := ReenrollEST(client, files.cert, files.key, files.ca, nil, WithProgress(quiet)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&counter.accepted); n != 2 {
+		t.Errorf("%d connections after reenrolling", n)
+	}
+
+	// A new certificate is used by the next request.
+	before := client.client()
+	current, err := LoadX509KeyPair(files.cert, files.key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Certificate = &current
+	if client.client() == before {
+		t.Error("client kept after the certificate changed")
+	}
+}
@@ -0,0 +1,250 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
+)
+
+// ESTHandler serves the cacerts, simpleenroll and simplereenroll EST
+// operations from the server's CA, under /.well-known/est/ with or without a
+// label. It is a stand-in for an enterprise EST server in tests and
+// development setups. When users is not empty simpleenroll requires either
+// one of its username/password pairs or a client certificate issued by the
+// CA. simplereenroll always requires the certificate being renewed.
+func (s *Server) ESTHandler(users map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/.well-known/est/") {
+			http.NotFound(w, r)
+			return
+		}
+		switch operation := path.Base(r.URL.Path); {
+		case operation == "cacerts" && r.Method == http.MethodGet:
+			s.estCACerts(w)
+		case operation == "simpleenroll" && r.Method == http.MethodPost:
+			if len(users) > 0 && !estBasicAuth(r, users) && !s.estClientAuth(r) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="est"`)
+				http.Error(w, "authentication required", http.StatusUnauthorized)
+				return
+			}
+			s.estEnroll(w, r, nil)
+		case operation == "simplereenroll" && r.Method == http.MethodPost:
+			current := estClientCertificate(r)
+			if current == nil {
+				http.Error(w, "client certificate required", http.StatusUnauthorized)
+				return
+			}
+			// A revoked node must not get a fresh certificate.
+			if err := s.checkNotRevoked(current); err != nil {
+				logmanager.Warning(fmt.Sprintf("EST server: refused reenrollment from %s: %v", r.RemoteAddr, err))
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			s.estEnroll(w, r, current)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// ListenAndServeEST serves ESTHandler over TLS on addr until Close is
+// called. The server certificate is issued on the fly like for
+// ListenAndServeTLS; clients trust the root returned by RootCertificate.
+func (s *Server) ListenAndServeEST(addr string, users map[string]string) error {
+	config, err := s.tlsConfig(addr)
+	if err != nil {
+		return err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(s.RootCertificate())
+	config.ClientCAs = roots
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	l, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return fmt.Errorf("server closed")
+	}
+	s.estListener = l
+	s.mu.Unlock()
+	logmanager.Info(fmt.Sprintf("EST server listening on %s", l.Addr()))
+
+	srv := &http.Server{Handler: s.ESTHandler(users), ReadHeaderTimeout: 10 * time.Second}
+	err = srv.Serve(l)
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return nil
+	}
+	return err
+}
+
+// ESTAddr returns the EST listening address, or nil before
+// ListenAndServeEST is called.
+func (s *Server) ESTAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.estListener == nil {
+		return nil
+	}
+	return s.estListener.Addr()
+}
+
+func (s *Server) estCACerts(w http.ResponseWriter) {
+	certs := make([]*x509.Certificate, len(s.chain))
+	for i, b := range s.chain {
+		certs[i], _ = x509.ParseCertificate(b)
+	}
+	p7, err := EncodeCertsOnly(certs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeESTBody(w, "application/pkcs7-mime", p7)
+}
+
+// estEnroll signs the CSR in the request body. For a reenrollment current is
+// the certificate being renewed, whose subject and SANs must not change.
+func (s *Server) estEnroll(w http.ResponseWriter, r *http.Request, current *x509.Certificate) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxFrameSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	csrBytes := decodeBase64Body(body)
+	if current != nil {
+		csr, err := x509.ParseCertificateRequest(csrBytes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !sameIdentity(current, csr) {
+			http.Error(w, "reenrollment must keep the subject and SANs", http.StatusBadRequest)
+			return
+		}
+	}
+	var certBytes []byte
+	if current != nil {
+		// Renewing a certificate the CA issued does not need a new
+		// approval.
+		var perr *ProtocolError
+		if certBytes, perr = s.sign(csrBytes, r.RemoteAddr); perr != nil {
+			err = perr
+		}
+	} else {
+		certBytes, err = s.enroll(csrBytes, r.RemoteAddr)
+	}
+	if pending, ok := err.(*PendingError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(pending.RetryAfter/time.Second)))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		perr := asProtocolError(err)
+		status := http.StatusInternalServerError
+		switch perr.Code {
+		case ErrCodeBadRequest:
+			status = http.StatusBadRequest
+		case ErrCodeRejected:
+			status = http.StatusForbidden
+		}
+		logmanager.Error(fmt.Sprintf("EST server: request from %s failed: %v", r.RemoteAddr, perr))
+		http.Error(w, perr.Message, status)
+		return
+	}
+	cert, _ := x509.ParseCertificate(certBytes)
+	p7, err := EncodeCertsOnly([]*x509.Certificate{cert})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logmanager.Info(fmt.Sprintf("EST server: issued certificate to %s", r.RemoteAddr))
+	writeESTBody(w, "application/pkcs7-mime; smime-type=certs-only", p7)
+}
+
+func writeESTBody(w http.ResponseWriter, contentType string, der []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	io.WriteString(w, encodeBase64Lines(der))
+}
+
+func estBasicAuth(r *http.Request, users map[string]string) bool {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	want, found := users[username]
+	return found && subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
+
+func estClientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// estClientAuth tells whether the client presented a certificate issued by
+// the CA and not revoked.
+func (s *Server) estClientAuth(r *http.Request) bool {
+	cert := estClientCertificate(r)
+	return cert != nil && s.checkNotRevoked(cert) == nil
+}
+
+func sameIdentity(cert *x509.Certificate, csr *x509.CertificateRequest) bool {
+	return cert.Subject.String() == csr.Subject.String() &&
+		reflect.DeepEqual(sanList(cert.DNSNames, cert.IPAddresses, cert.EmailAddresses, cert.URIs),
+			sanList(csr.DNSNames, csr.IPAddresses, csr.EmailAddresses, csr.URIs))
+}
+
+func sanList(dns []string, ips []net.IP, emails []string, uris []*url.URL) []string {
+	out := []string{}
+	for _, name := range dns {
+		out = append(out, "dns:"+strings.ToLower(name))
+	}
+	for _, ip := range ips {
+		out = append(out, "ip:"+ip.String())
+	}
+	for _, email := range emails {
+		out = append(out, "email:"+email)
+	}
+	for _, uri := range uris {
+		out = append(out, "uri:"+uri.String())
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,213 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Components of an ezBastion deployment, used as Identity.Component.
+const (
+	ComponentPKI    = "ezb_pki"
+	ComponentServer = "ezb_srv"
+	ComponentWorker = "ezb_wks"
+	ComponentSTA    = "ezb_sta"
+	ComponentDB     = "ezb_db"
+	ComponentAdmin  = "ezb_admin"
+)
+
+// Identity is what a certificate tells about the ezBastion node presenting
+// it. By convention, set up by WithIdentity, the subject O is the
+// organization, the OU the component and the CN the node name. A SPIFFE
+// URI SAN spiffe://<trust domain>/<component>/<node>, when present, must
+// agree with them.
+//
+// An identity is only as trustworthy as the CA that signed it: the signer
+// copies the subject and the URIs from the CSR, so unless its SignPolicy
+// restricts them (AllowedComponents, AllowedCommonNames, AllowedURIs) or
+// every request goes through manual approval, any node able to enroll can
+// claim any component, ezb_admin included.
+type Identity struct {
+	Organization string
+	Component    string
+	Node         string
+	// TrustDomain is the host of the SPIFFE ID, empty without one.
+	TrustDomain string
+}
+
+// String returns the identity as organization/component/node.
+func (id Identity) String() string {
+	return id.Organization + "/" + id.Component + "/" + id.Node
+}
+
+// WithIdentity marks the request as component running on the node named
+// by its common name, following the Identity conventions. A non empty
+// trustDomain also adds the matching SPIFFE ID.
+func WithIdentity(component, trustDomain string) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		r.Subject.OrganizationalUnit = []string{component}
+		if trustDomain != "" {
+			WithSPIFFEID(trustDomain, component+"/"+r.Subject.CommonName)(r)
+		}
+	}
+}
+
+// IdentityOf returns the identity of cert, which should be verified first.
+// It fails when the certificate carries no component or contradicts
+// itself, so such a certificate matches no authorization rule.
+func IdentityOf(cert *x509.Certificate) (Identity, error) {
+	var id Identity
+	subject := cert.Subject
+	if len(subject.Organization) > 1 || len(subject.OrganizationalUnit) > 1 {
+		return id, fmt.Errorf("Certificate %q has several organizations or units", subject.CommonName)
+	}
+	if len(subject.Organization) == 1 {
+		id.Organization = subject.Organization[0]
+	}
+	if len(subject.OrganizationalUnit) == 1 {
+		id.Component = subject.OrganizationalUnit[0]
+	}
+	id.Node = subject.CommonName
+
+	found := false
+	for _, uri := range cert.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		if found {
+			return Identity{}, fmt.Errorf("Certificate %q has several SPIFFE IDs", subject.CommonName)
+		}
+		found = true
+		parts := strings.Split(strings.TrimPrefix(uri.Path, "/"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return Identity{}, fmt.Errorf("SPIFFE ID %s is not spiffe://<trust domain>/<component>/<node>", uri)
+		}
+		if (id.Component != "" && id.Component != parts[0]) || (id.Node != "" && id.Node != parts[1]) {
+			return Identity{}, fmt.Errorf("SPIFFE ID %s does not match subject %s", uri, subject)
+		}
+		id.TrustDomain = uri.Host
+		id.Component, id.Node = parts[0], parts[1]
+	}
+	if id.Component == "" || id.Node == "" {
+		return Identity{}, fmt.Errorf("Certificate %q carries no ezBastion identity", subject.CommonName)
+	}
+	return id, nil
+}
+
+// IdentityMatcher is an authorization rule on identities. Rules protect
+// nothing unless the CA restricts the identities it signs, see Identity.
+type IdentityMatcher func(Identity) bool
+
+// MatchComponent accepts the identities of the given components, e.g.
+// MatchComponent(ComponentWorker) for "only worker nodes".
+func MatchComponent(components ...string) IdentityMatcher {
+	return func(id Identity) bool {
+		return containsString(components, id.Component)
+	}
+}
+
+// MatchNode accepts the nodes whose name matches one of patterns, in the
+// syntax of path.Match, e.g. "wks-*".
+func MatchNode(patterns ...string) IdentityMatcher {
+	return func(id Identity) bool {
+		return matchAny(patterns, id.Node)
+	}
+}
+
+// MatchOrganization accepts the identities of the given organizations.
+func MatchOrganization(organizations ...string) IdentityMatcher {
+	return func(id Identity) bool {
+		return containsString(organizations, id.Organization)
+	}
+}
+
+// MatchTrustDomain accepts the identities whose SPIFFE ID is in one of the
+// given trust domains.
+func MatchTrustDomain(domains ...string) IdentityMatcher {
+	return func(id Identity) bool {
+		return id.TrustDomain != "" && containsString(domains, id.TrustDomain)
+	}
+}
+
+// MatchAll accepts the identities accepted by every matcher.
+func MatchAll(matchers ...IdentityMatcher) IdentityMatcher {
+	return func(id Identity) bool {
+		for _, m := range matchers {
+			if !m(id) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// MatchAny accepts the identities accepted by one of the matchers.
+func MatchAny(matchers ...IdentityMatcher) IdentityMatcher {
+	return func(id Identity) bool {
+		for _, m := range matchers {
+			if m(id) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ParseIdentityPattern returns the matcher of a rule read from a
+// configuration file: "component/node", both parts in the syntax of
+// path.Match, e.g. "ezb_wks/*". Several rules separated by commas match
+// when one of them does.
+func ParseIdentityPattern(pattern string) (IdentityMatcher, error) {
+	var matchers []IdentityMatcher
+	for _, rule := range strings.Split(pattern, ",") {
+		rule = strings.TrimSpace(rule)
+		parts := strings.Split(rule, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid identity pattern %q, expected component/node", rule)
+		}
+		for _, p := range parts {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("Invalid identity pattern %q: %v", rule, err)
+			}
+		}
+		component, node := parts[0], parts[1]
+		matchers = append(matchers, func(id Identity) bool {
+			return matchAny([]string{component}, id.Component) && matchAny([]string{node}, id.Node)
+		})
+	}
+	return MatchAny(matchers...), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
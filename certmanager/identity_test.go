@@ -0,0 +1,97 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+)
+
+func TestIdentityOf(t *testing.T) {
+	subject := func(ou []string, cn string) pkix.Name {
+		return pkix.Name{Organization: []string{"ezBastion"}, OrganizationalUnit: ou, CommonName: cn}
+	}
+	spiffe := func(ids ...string) []*url.URL {
+		var uris []*url.URL
+		for _, id := range ids {
+			u, err := url.Parse(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			uris = append(uris, u)
+		}
+		return uris
+	}
+	for _, tc := range []struct {
+		name string
+		cert x509.Certificate
+		want Identity
+		ok   bool
+	}{
+		{"subject", x509.Certificate{Subject: subject([]string{"ezb_wks"}, "wks1")},
+			Identity{Organization: "ezBastion", Component: "ezb_wks", Node: "wks1"}, true},
+		{"matching SPIFFE ID", x509.Certificate{Subject: subject([]string{"ezb_wks"}, "wks1"), URIs: spiffe("spiffe://ezb.local/ezb_wks/wks1")},
+			Identity{Organization: "ezBastion", Component: "ezb_wks", Node: "wks1", TrustDomain: "ezb.local"}, true},
+		{"SPIFFE ID only", x509.Certificate{URIs: spiffe("spiffe://ezb.local/ezb_sta/sta1")},
+			Identity{Component: "ezb_sta", Node: "sta1", TrustDomain: "ezb.local"}, true},
+		{"other URIs ignored", x509.Certificate{Subject: subject([]string{"ezb_wks"}, "wks1"), URIs: spiffe("https://wks1.ezb.local/")},
+			Identity{Organization: "ezBastion", Component: "ezb_wks", Node: "wks1"}, true},
+		{"SPIFFE ID contradicting OU", x509.Certificate{Subject: subject([]string{"ezb_sta"}, "wks1"), URIs: spiffe("spiffe://ezb.local/ezb_wks/wks1")}, Identity{}, false},
+		{"SPIFFE ID contradicting CN", x509.Certificate{Subject: subject([]string{"ezb_wks"}, "wks1"), URIs: spiffe("spiffe://ezb.local/ezb_wks/wks2")}, Identity{}, false},
+		{"several SPIFFE IDs", x509.Certificate{Subject: subject([]string{"ezb_wks"}, "wks1"), URIs: spiffe("spiffe://ezb.local/ezb_wks/wks1", "spiffe://ezb.local/ezb_wks/wks1")}, Identity{}, false},
+		{"SPIFFE ID without node", x509.Certificate{URIs: spiffe("spiffe://ezb.local/ezb_wks")}, Identity{}, false},
+		{"SPIFFE ID too deep", x509.Certificate{URIs: spiffe("spiffe://ezb.local/ezb_wks/wks1/extra")}, Identity{}, false},
+		{"no component", x509.Certificate{Subject: subject(nil, "wks1")}, Identity{}, false},
+		{"no node", x509.Certificate{Subject: subject([]string{"ezb_wks"}, "")}, Identity{}, false},
+		{"several units", x509.Certificate{Subject: subject([]string{"ezb_wks", "ezb_admin"}, "wks1")}, Identity{}, false},
+	} {
+		id, err := IdentityOf(&tc.cert)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: %v, %v", tc.name, id, err)
+			continue
+		}
+		if id != tc.want {
+			t.Errorf("%s: identity %+v, expected %+v", tc.name, id, tc.want)
+		}
+	}
+}
+
+func TestParseIdentityPattern(t *testing.T) {
+	m, err := ParseIdentityPattern("ezb_wks/*, ezb_sta/sta-0?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		id   Identity
+		want bool
+	}{
+		{Identity{Component: "ezb_wks", Node: "wks1"}, true},
+		{Identity{Component: "ezb_sta", Node: "sta-01"}, true},
+		{Identity{Component: "ezb_sta", Node: "sta-1"}, false},
+		{Identity{Component: "ezb_srv", Node: "wks1"}, false},
+	} {
+		if m(tc.id) != tc.want {
+			t.Errorf("%s: matched %v", tc.id, !tc.want)
+		}
+	}
+	for _, pattern := range []string{"", "ezb_wks", "ezb_wks/", "/wks1", "ezb_wks/wks1/extra", "ezb_wks/[wks", "ezb_wks/*,", "[ezb/*"} {
+		if _, err = ParseIdentityPattern(pattern); err == nil {
+			t.Errorf("pattern %q accepted", pattern)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CertificateInfo describes one certificate found by Inspect.
+type CertificateInfo struct {
+	File              string    `json:"file"`
+	Subject           string    `json:"subject"`
+	CommonName        string    `json:"commonname"`
+	Issuer            string    `json:"issuer"`
+	Serial            string    `json:"serial"`
+	DNSNames          []string  `json:"dnsnames,omitempty"`
+	IPAddresses       []string  `json:"ipaddresses,omitempty"`
+	URIs              []string  `json:"uris,omitempty"`
+	EmailAddresses    []string  `json:"emailaddresses,omitempty"`
+	SHA256Fingerprint string    `json:"sha256"`
+	SHA1Fingerprint   string    `json:"sha1"`
+	NotBefore         time.Time `json:"notbefore"`
+	NotAfter          time.Time `json:"notafter"`
+	DaysRemaining     int       `json:"daysremaining"`
+	KeyType           string    `json:"keytype"`
+	IsCA              bool      `json:"isca"`
+	// Development is set for certificates of a development CA.
+	Development bool `json:"development,omitempty"`
+	// KeyFile is the private key file matching this certificate, if any.
+	KeyFile string `json:"keyfile,omitempty"`
+}
+
+// KeyInfo describes one private key found by Inspect.
+type KeyInfo struct {
+	File      string `json:"file"`
+	KeyType   string `json:"keytype,omitempty"`
+	Encrypted bool   `json:"encrypted"`
+	// CertificateFiles lists the files holding a certificate for this key.
+	// It stays empty for an encrypted key inspected without passphrase.
+	CertificateFiles []string `json:"certificatefiles,omitempty"`
+}
+
+// InventoryError records a file Inspect could not parse.
+type InventoryError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// Inventory is the report returned by Inspect.
+type Inventory struct {
+	Dir          string            `json:"dir"`
+	GeneratedAt  time.Time         `json:"generatedat"`
+	Certificates []CertificateInfo `json:"certificates"`
+	Keys         []KeyInfo         `json:"keys"`
+	Errors       []InventoryError  `json:"errors,omitempty"`
+}
+
+// InspectCertFolder inspects the cert folder created by
+// setupmanager.CheckFolder under exPath.
+func InspectCertFolder(exPath string, passphrase []byte) (*Inventory, error) {
+	return Inspect(path.Join(exPath, "cert"), passphrase)
+}
+
+// Inspect parses every PEM file of dir and reports the certificates and
+// private keys it holds, matching keys to certificates. passphrase is tried
+// on encrypted keys and may be nil.
+func Inspect(dir string, passphrase []byte) (*Inventory, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	inv := &Inventory{Dir: dir, GeneratedAt: time.Now(), Certificates: []CertificateInfo{}, Keys: []KeyInfo{}}
+	var certs []*x509.Certificate
+	var keys []crypto.PublicKey
+
+	for _, fi := range files {
+		// Backups and temporary files of replaceFiles are not live material.
+		if fi.IsDir() || strings.HasSuffix(fi.Name(), backupSuffix) || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		filename := filepath.Join(dir, fi.Name())
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			inv.Errors = append(inv.Errors, InventoryError{File: filename, Error: err.Error()})
+			continue
+		}
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			switch {
+			case block.Type == "CERTIFICATE":
+				cert, err := x509.ParseCertificate(block.Bytes)
+				if err != nil {
+					inv.Errors = append(inv.Errors, InventoryError{File: filename, Error: err.Error()})
+					continue
+				}
+				certs = append(certs, cert)
+				inv.Certificates = append(inv.Certificates, describeCertificate(filename, cert))
+			case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+				info := KeyInfo{File: filename, Encrypted: block.Type == "ENCRYPTED PRIVATE KEY"}
+				var priv crypto.Signer
+				var err error
+				if info.Encrypted {
+					if len(passphrase) > 0 {
+						priv, err = DecryptPrivateKey(block, passphrase)
+					}
+				} else {
+					priv, err = parsePrivateKey(block)
+				}
+				var pub crypto.PublicKey
+				if err != nil {
+					inv.Errors = append(inv.Errors, InventoryError{File: filename, Error: err.Error()})
+				} else if priv != nil {
+					pub = priv.Public()
+					info.KeyType = keyTypeName(pub)
+				}
+				keys = append(keys, pub)
+				inv.Keys = append(inv.Keys, info)
+			}
+		}
+	}
+
+	for i, pub := range keys {
+		if pub == nil {
+			continue
+		}
+		want, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			continue
+		}
+		for j, cert := range certs {
+			got, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+			if err == nil && bytes.Equal(want, got) {
+				inv.Certificates[j].KeyFile = inv.Keys[i].File
+				inv.Keys[i].CertificateFiles = append(inv.Keys[i].CertificateFiles, inv.Certificates[j].File)
+			}
+		}
+	}
+	sort.SliceStable(inv.Certificates, func(i, j int) bool {
+		return inv.Certificates[i].NotAfter.Before(inv.Certificates[j].NotAfter)
+	})
+	return inv, nil
+}
+
+func describeCertificate(filename string, cert *x509.Certificate) CertificateInfo {
+	sha1sum := sha1.Sum(cert.Raw)
+	info := CertificateInfo{
+		File:              filename,
+		Subject:           cert.Subject.String(),
+		CommonName:        cert.Subject.CommonName,
+		Issuer:            cert.Issuer.String(),
+		Serial:            formatSerial(cert.SerialNumber),
+		DNSNames:          cert.DNSNames,
+		EmailAddresses:    cert.EmailAddresses,
+		SHA256Fingerprint: Fingerprint(cert),
+		SHA1Fingerprint:   strings.ToUpper(hex.EncodeToString(sha1sum[:])),
+		NotBefore:         cert.NotBefore,
+		NotAfter:          cert.NotAfter,
+		DaysRemaining:     int(math.Floor(time.Until(cert.NotAfter).Hours() / 24)),
+		KeyType:           keyTypeName(cert.PublicKey),
+		IsCA:              cert.IsCA,
+		Development:       IsDevelopmentCertificate(cert),
+	}
+	for _, ip := range cert.IPAddresses {
+		info.IPAddresses = append(info.IPAddresses, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		info.URIs = append(info.URIs, uri.String())
+	}
+	return info
+}
+
+func keyTypeName(pub crypto.PublicKey) string {
+	if k, err := KeyTypeOf(pub); err == nil {
+		return string(k)
+	}
+	if k, ok := pub.(*rsa.PublicKey); ok {
+		return fmt.Sprintf("rsa-%d", k.N.BitLen())
+	}
+	return fmt.Sprintf("%T", pub)
+}
+
+// JSON returns the inventory as indented JSON.
+func (inv *Inventory) JSON() ([]byte, error) {
+	return json.MarshalIndent(inv, "", "  ")
+}
+
+// WriteTable renders the inventory as a human readable table.
+func (inv *Inventory) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tCOMMON NAME\tSANS\tISSUER\tNOT AFTER\tDAYS\tKEY\tKEY FILE")
+	for _, c := range inv.Certificates {
+		sans := append(append(append([]string{}, c.DNSNames...), c.IPAddresses...), c.URIs...)
+		issuer := c.Issuer
+		if c.IsCA && c.Issuer == c.Subject {
+			issuer = "(self-signed CA)"
+		}
+		if c.Development {
+			issuer += " [DEV]"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			filepath.Base(c.File), c.CommonName, strings.Join(sans, ","), issuer,
+			c.NotAfter.Format("2006-01-02"), c.DaysRemaining, c.KeyType, baseName(c.KeyFile))
+	}
+	for _, k := range inv.Keys {
+		if len(k.CertificateFiles) == 0 {
+			state := "no matching certificate"
+			if k.Encrypted && k.KeyType == "" {
+				state = "encrypted, not inspected"
+			}
+			fmt.Fprintf(tw, "%s\t\t\t\t\t\t%s\t%s\n", filepath.Base(k.File), k.KeyType, state)
+		}
+	}
+	for _, e := range inv.Errors {
+		fmt.Fprintf(tw, "%s\tERROR: %s\t\t\t\t\t\t\n", filepath.Base(e.File), e.Error)
+	}
+	return tw.Flush()
+}
+
+func baseName(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	return filepath.Base(filename)
+}
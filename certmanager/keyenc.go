@@ -0,0 +1,392 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ezBastion/ezb_lib/ez_stdio"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted private keys are PKCS#8 EncryptedPrivateKeyInfo structures using
+// PBES2 (RFC 8018) with either scrypt (RFC 7914) or PBKDF2-HMAC-SHA256 as key
+// derivation function and AES-256-GCM (RFC 5084) as cipher.
+
+// KDF selects the key derivation function used to encrypt private keys.
+type KDF string
+
+const (
+	KDFScrypt KDF = "scrypt"
+	KDFPBKDF2 KDF = "pbkdf2"
+)
+
+const (
+	scryptN          = 1 << 15
+	scryptR          = 8
+	scryptP          = 1
+	pbkdf2Iterations = 600000
+	encKeyLen        = 32
+	gcmNonceLen      = 12
+)
+
+// Bounds of the parameters read from an encrypted key, so a crafted file
+// cannot make decryption run for hours or exhaust memory. They allow 16
+// times the cost of the defaults.
+const (
+	maxPBKDF2Iterations = 16 * pbkdf2Iterations
+	// maxScryptWork bounds 128*N*r*p, the bytes scrypt goes through.
+	maxScryptWork = 16 * 128 * scryptN * scryptR * scryptP
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidScrypt         = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+	oidAES256GCM      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+type gcmParams struct {
+	Nonce  []byte
+	ICVLen int `asn1:"optional,default:12"`
+}
+
+// ErrBadPassphrase is returned when an encrypted private key cannot be
+// decrypted with the supplied passphrase.
+var ErrBadPassphrase = errors.New("Wrong passphrase or corrupted private key")
+
+// EncryptPrivateKey returns priv as an "ENCRYPTED PRIVATE KEY" PEM block
+// protected by passphrase.
+func EncryptPrivateKey(priv crypto.Signer, passphrase []byte, kdf KDF) (*pem.Block, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("Empty passphrase")
+	}
+	plain, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	nonce := make([]byte, gcmNonceLen)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	var kdfAlg pkix.AlgorithmIdentifier
+	switch kdf {
+	case KDFScrypt, "":
+		key, err = scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, encKeyLen)
+		if err != nil {
+			return nil, err
+		}
+		kdfAlg, err = algorithmIdentifier(oidScrypt, scryptParams{
+			Salt:                     salt,
+			CostParameter:            scryptN,
+			BlockSize:                scryptR,
+			ParallelizationParameter: scryptP,
+			KeyLength:                encKeyLen,
+		})
+	case KDFPBKDF2:
+		key = pbkdf2.Key(passphrase, salt, pbkdf2Iterations, encKeyLen, sha256.New)
+		kdfAlg, err = algorithmIdentifier(oidPBKDF2, pbkdf2Params{
+			Salt:           salt,
+			IterationCount: pbkdf2Iterations,
+			KeyLength:      encKeyLen,
+			PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+		})
+	default:
+		return nil, fmt.Errorf("Unknown key derivation function %q", string(kdf))
+	}
+	if err != nil {
+		return nil, err
+	}
+	encAlg, err := algorithmIdentifier(oidAES256GCM, gcmParams{Nonce: nonce, ICVLen: 16})
+	if err != nil {
+		return nil, err
+	}
+	pbes2Alg, err := algorithmIdentifier(oidPBES2, pbes2Params{KeyDerivationFunc: kdfAlg, EncryptionScheme: encAlg})
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pbes2Alg,
+		EncryptedData: aead.Seal(nil, nonce, plain, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}, nil
+}
+
+// DecryptPrivateKey decrypts an "ENCRYPTED PRIVATE KEY" PEM block written by
+// EncryptPrivateKey.
+func DecryptPrivateKey(block *pem.Block, passphrase []byte) (crypto.Signer, error) {
+	if block.Type != "ENCRYPTED PRIVATE KEY" {
+		return nil, fmt.Errorf("Unexpected PEM block type %s", block.Type)
+	}
+	var info encryptedPrivateKeyInfo
+	if err := unmarshalStrict(block.Bytes, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported key encryption %s", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if err := unmarshalStrict(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	var err error
+	switch kdf := params.KeyDerivationFunc; {
+	case kdf.Algorithm.Equal(oidScrypt):
+		var p scryptParams
+		if err = unmarshalStrict(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, err
+		}
+		if err = checkScryptParams(p); err != nil {
+			return nil, err
+		}
+		key, err = scrypt.Key(passphrase, p.Salt, p.CostParameter, p.BlockSize, p.ParallelizationParameter, encKeyLen)
+		if err != nil {
+			return nil, err
+		}
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var p pbkdf2Params
+		if err = unmarshalStrict(kdf.Parameters.FullBytes, &p); err != nil {
+			return nil, err
+		}
+		if !p.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+			return nil, fmt.Errorf("Unsupported PBKDF2 PRF %s", p.PRF.Algorithm)
+		}
+		if err = checkIterations(p.IterationCount, maxPBKDF2Iterations); err != nil {
+			return nil, err
+		}
+		key = pbkdf2.Key(passphrase, p.Salt, p.IterationCount, encKeyLen, sha256.New)
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation function %s", kdf.Algorithm)
+	}
+
+	if !params.EncryptionScheme.Algorithm.Equal(oidAES256GCM) {
+		return nil, fmt.Errorf("Unsupported key cipher %s", params.EncryptionScheme.Algorithm)
+	}
+	var gp gcmParams
+	if err = unmarshalStrict(params.EncryptionScheme.Parameters.FullBytes, &gp); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(gp.Nonce) != aead.NonceSize() {
+		return nil, errors.New("Bad AES-GCM nonce length")
+	}
+	plain, err := aead.Open(nil, gp.Nonce, info.EncryptedData, nil)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	return parsePrivateKey(&pem.Block{Type: "PRIVATE KEY", Bytes: plain})
+}
+
+func checkScryptParams(p scryptParams) error {
+	n, r, q := int64(p.CostParameter), int64(p.BlockSize), int64(p.ParallelizationParameter)
+	err := fmt.Errorf("Unsupported scrypt parameters N=%d r=%d p=%d", n, r, q)
+	if n < 2 || r < 1 || q < 1 || n > maxScryptWork || r > maxScryptWork || q > maxScryptWork {
+		return err
+	}
+	// Multiplied one at a time so the product cannot overflow.
+	work := 128 * n
+	for _, f := range []int64{r, q} {
+		if work > maxScryptWork {
+			return err
+		}
+		work *= f
+	}
+	if work > maxScryptWork {
+		return err
+	}
+	return nil
+}
+
+func checkIterations(iterations, max int) error {
+	if iterations < 1 || iterations > max {
+		return fmt.Errorf("Unsupported iteration count %d, at most %d", iterations, max)
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func algorithmIdentifier(oid asn1.ObjectIdentifier, params interface{}) (pkix.AlgorithmIdentifier, error) {
+	b, err := asn1.Marshal(params)
+	if err != nil {
+		return pkix.AlgorithmIdentifier{}, err
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oid, Parameters: asn1.RawValue{FullBytes: b}}, nil
+}
+
+func unmarshalStrict(b []byte, v interface{}) error {
+	rest, err := asn1.Unmarshal(b, v)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return errors.New("Trailing data after ASN.1 structure")
+	}
+	return nil
+}
+
+// PassphraseSource tells where the private key passphrase comes from. The
+// first non empty source wins: Passphrase as read from configuration, the
+// environment variable named by Env, then an interactive prompt showing
+// Prompt.
+type PassphraseSource struct {
+	Passphrase string `json:"passphrase"`
+	Env        string `json:"passphraseenv"`
+	Prompt     string `json:"-"`
+}
+
+// Get returns the passphrase, or nil when no source provides one.
+func (s PassphraseSource) Get() []byte {
+	if s.Passphrase != "" {
+		return []byte(s.Passphrase)
+	}
+	if s.Env != "" {
+		if v := os.Getenv(s.Env); v != "" {
+			return []byte(v)
+		}
+	}
+	if s.Prompt != "" {
+		if v := ez_stdio.AskForSecret(s.Prompt); v != "" {
+			return []byte(v)
+		}
+	}
+	return nil
+}
+
+// WithKeyPassphrase makes Generate store the private key encrypted with the
+// passphrase from source, derived with kdf.
+func WithKeyPassphrase(source PassphraseSource, kdf KDF) GenerateOption {
+	return func(c *generateConfig) {
+		c.passphrase = &source
+		c.kdf = kdf
+	}
+}
+
+// LoadPrivateKey reads a PEM private key written by Generate, decrypting it
+// with passphrase when it is encrypted.
+func LoadPrivateKey(filename string, passphrase []byte) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKeyPEM(data, passphrase, filename)
+}
+
+// LoadX509KeyPair is tls.LoadX509KeyPair accepting private keys encrypted by
+// Generate. passphrase may be nil for plain keys.
+func LoadX509KeyPair(certFilename, keyFilename string, passphrase []byte) (tls.Certificate, error) {
+	return loadX509KeyPair(certFilename, keyFilename, func() (crypto.Signer, error) {
+		return LoadPrivateKey(keyFilename, passphrase)
+	})
+}
+
+func loadX509KeyPair(certFilename, keyFilename string, loadKey func() (crypto.Signer, error)) (tls.Certificate, error) {
+	var cert tls.Certificate
+	data, err := ioutil.ReadFile(certFilename)
+	if err != nil {
+		return cert, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return cert, fmt.Errorf("No certificate found in %s", certFilename)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return cert, err
+	}
+	priv, err := loadKey()
+	if err != nil {
+		return cert, err
+	}
+	if err = checkKeyMatch(cert.Leaf, priv); err != nil {
+		return cert, fmt.Errorf("%s does not match %s", keyFilename, certFilename)
+	}
+	cert.PrivateKey = priv
+	return cert, nil
+}
@@ -0,0 +1,104 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func TestEncryptPrivateKeyRoundTrip(t *testing.T) {
+	priv, err := KeyECDSAP256.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kdf := range []KDF{KDFScrypt, KDFPBKDF2} {
+		block, err := EncryptPrivateKey(priv, []byte("secret"), kdf)
+		if err != nil {
+			t.Fatalf("%s: %v", kdf, err)
+		}
+		if _, err = DecryptPrivateKey(block, []byte("wrong")); err != ErrBadPassphrase {
+			t.Errorf("%s: wrong passphrase gave %v", kdf, err)
+		}
+		got, err := DecryptPrivateKey(block, []byte("secret"))
+		if err != nil {
+			t.Fatalf("%s: %v", kdf, err)
+		}
+		want, _ := x509.MarshalPKIXPublicKey(priv.Public())
+		have, _ := x509.MarshalPKIXPublicKey(got.Public())
+		if !bytes.Equal(want, have) {
+			t.Errorf("%s: decrypted another key", kdf)
+		}
+	}
+}
+
+// encryptedKeyWith returns an encrypted key block using kdf, as a crafted
+// file would.
+func encryptedKeyWith(t *testing.T, kdf pkix.AlgorithmIdentifier) *pem.Block {
+	t.Helper()
+	encAlg, err := algorithmIdentifier(oidAES256GCM, gcmParams{Nonce: make([]byte, gcmNonceLen), ICVLen: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pbes2Alg, err := algorithmIdentifier(oidPBES2, pbes2Params{KeyDerivationFunc: kdf, EncryptionScheme: encAlg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: pbes2Alg, EncryptedData: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}
+}
+
+func TestDecryptPrivateKeyBounds(t *testing.T) {
+	salt := make([]byte, 16)
+	for _, p := range []scryptParams{
+		{Salt: salt, CostParameter: 1 << 30, BlockSize: 8, ParallelizationParameter: 1},
+		{Salt: salt, CostParameter: scryptN, BlockSize: 1 << 20, ParallelizationParameter: 1},
+		{Salt: salt, CostParameter: scryptN, BlockSize: 8, ParallelizationParameter: 1 << 20},
+		{Salt: salt, CostParameter: 1 << 20, BlockSize: 1 << 20, ParallelizationParameter: 1 << 20},
+		{Salt: salt, CostParameter: 0, BlockSize: 8, ParallelizationParameter: 1},
+	} {
+		kdf, err := algorithmIdentifier(oidScrypt, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = DecryptPrivateKey(encryptedKeyWith(t, kdf), []byte("secret"))
+		if err == nil || !strings.Contains(err.Error(), "Unsupported scrypt parameters") {
+			t.Errorf("N=%d r=%d p=%d: %v", p.CostParameter, p.BlockSize, p.ParallelizationParameter, err)
+		}
+	}
+	for _, iterations := range []int{0, -1, maxPBKDF2Iterations + 1, 1 << 40} {
+		kdf, err := algorithmIdentifier(oidPBKDF2, pbkdf2Params{
+			Salt:           salt,
+			IterationCount: iterations,
+			PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = DecryptPrivateKey(encryptedKeyWith(t, kdf), []byte("secret"))
+		if err == nil || !strings.Contains(err.Error(), "iteration count") {
+			t.Errorf("%d iterations: %v", iterations, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// KeyType names a private key algorithm and size. The string form is the one
+// used in configuration files.
+type KeyType string
+
+const (
+	KeyECDSAP256 KeyType = "ecdsa-p256"
+	KeyECDSAP384 KeyType = "ecdsa-p384"
+	KeyECDSAP521 KeyType = "ecdsa-p521"
+	KeyRSA3072   KeyType = "rsa-3072"
+	KeyRSA4096   KeyType = "rsa-4096"
+	KeyEd25519   KeyType = "ed25519"
+)
+
+// DefaultKeyType is the key generated when a request does not ask for one.
+const DefaultKeyType = KeyECDSAP256
+
+// ParseKeyType validates a key type read from configuration. An empty string
+// selects DefaultKeyType.
+func ParseKeyType(s string) (KeyType, error) {
+	switch k := KeyType(s); k {
+	case "":
+		return DefaultKeyType, nil
+	case KeyECDSAP256, KeyECDSAP384, KeyECDSAP521, KeyRSA3072, KeyRSA4096, KeyEd25519:
+		return k, nil
+	}
+	return "", fmt.Errorf("Unknown key type %q", s)
+}
+
+// SignatureAlgorithm returns the signature algorithm conventionally paired
+// with the key type.
+func (k KeyType) SignatureAlgorithm() x509.SignatureAlgorithm {
+	switch k {
+	case KeyECDSAP384:
+		return x509.ECDSAWithSHA384
+	case KeyECDSAP521:
+		return x509.ECDSAWithSHA512
+	case KeyRSA3072:
+		return x509.SHA256WithRSA
+	case KeyRSA4096:
+		return x509.SHA512WithRSA
+	case KeyEd25519:
+		return x509.PureEd25519
+	}
+	return x509.ECDSAWithSHA256
+}
+
+// GenerateKey creates a new private key of type k.
+func (k KeyType) GenerateKey() (crypto.Signer, error) {
+	switch k {
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyECDSAP521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case KeyRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("Unknown key type %q", string(k))
+}
+
+// KeyTypeForSignatureAlgorithm returns the key Generate creates for a request
+// signed with alg. The hash strength selects the ECDSA curve or RSA size.
+func KeyTypeForSignatureAlgorithm(alg x509.SignatureAlgorithm) (KeyType, error) {
+	switch alg {
+	case x509.UnknownSignatureAlgorithm, x509.ECDSAWithSHA256:
+		return KeyECDSAP256, nil
+	case x509.ECDSAWithSHA384:
+		return KeyECDSAP384, nil
+	case x509.ECDSAWithSHA512:
+		return KeyECDSAP521, nil
+	case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS:
+		return KeyRSA3072, nil
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS:
+		return KeyRSA4096, nil
+	case x509.PureEd25519:
+		return KeyEd25519, nil
+	}
+	return "", fmt.Errorf("Unsupported signature algorithm %s", alg)
+}
+
+// KeyTypeOf returns the key type of a public key, for instance to renew a
+// certificate with the same algorithm.
+func KeyTypeOf(pub crypto.PublicKey) (KeyType, error) {
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return KeyECDSAP256, nil
+		case elliptic.P384():
+			return KeyECDSAP384, nil
+		case elliptic.P521():
+			return KeyECDSAP521, nil
+		}
+		return "", fmt.Errorf("Unsupported curve %s", k.Curve.Params().Name)
+	case *rsa.PublicKey:
+		switch k.N.BitLen() {
+		case 3072:
+			return KeyRSA3072, nil
+		case 4096:
+			return KeyRSA4096, nil
+		}
+		return "", fmt.Errorf("Unsupported RSA key size %d", k.N.BitLen())
+	case ed25519.PublicKey:
+		return KeyEd25519, nil
+	}
+	return "", fmt.Errorf("Unsupported public key type %T", pub)
+}
+
+// WithKeyType makes the request use a key of type k, signed with the
+// matching algorithm.
+func WithKeyType(k KeyType) RequestOption {
+	return func(certificate *x509.CertificateRequest) {
+		certificate.SignatureAlgorithm = k.SignatureAlgorithm()
+	}
+}
+
+// WithSignatureAlgorithm sets the CSR signature algorithm explicitly, the key
+// type following from it (see KeyTypeForSignatureAlgorithm).
+func WithSignatureAlgorithm(alg x509.SignatureAlgorithm) RequestOption {
+	return func(certificate *x509.CertificateRequest) {
+		certificate.SignatureAlgorithm = alg
+	}
+}
+
+// marshalPrivateKey returns the PEM block for priv: SEC 1 for ECDSA, PKCS#1
+// for RSA and PKCS#8 for Ed25519, which has no dedicated format.
+func marshalPrivateKey(priv crypto.Signer) (*pem.Block, error) {
+	switch k := priv.(type) {
+	case *ecdsa.PrivateKey:
+		b, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}, nil
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	}
+	b, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: b}, nil
+}
+
+// checkKeyMatch returns an error unless cert certifies the public half of
+// priv.
+func checkKeyMatch(cert *x509.Certificate, priv crypto.Signer) error {
+	want, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return err
+	}
+	got, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(want, got) {
+		return errors.New("Issued certificate does not match the generated private key")
+	}
+	return nil
+}
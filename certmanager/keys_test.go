@@ -0,0 +1,99 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+)
+
+func TestParseKeyType(t *testing.T) {
+	for _, s := range []string{"ecdsa-p256", "ecdsa-p384", "ecdsa-p521", "rsa-3072", "rsa-4096", "ed25519"} {
+		if k, err := ParseKeyType(s); err != nil || string(k) != s {
+			t.Errorf("%s: parsed %q, %v", s, k, err)
+		}
+	}
+	if k, err := ParseKeyType(""); err != nil || k != DefaultKeyType {
+		t.Errorf("empty key type: parsed %q, %v", k, err)
+	}
+	for _, s := range []string{"rsa-2048", "RSA-3072", "ecdsa", "p256"} {
+		if _, err := ParseKeyType(s); err == nil {
+			t.Errorf("%s accepted", s)
+		}
+	}
+}
+
+// TestPrivateKeyBlocks checks the PEM block written for each key type reads
+// back as the same key type.
+func TestPrivateKeyBlocks(t *testing.T) {
+	for _, tc := range []struct {
+		keyType   KeyType
+		blockType string
+	}{
+		{KeyECDSAP256, "EC PRIVATE KEY"},
+		{KeyECDSAP384, "EC PRIVATE KEY"},
+		{KeyECDSAP521, "EC PRIVATE KEY"},
+		{KeyRSA3072, "RSA PRIVATE KEY"},
+		{KeyEd25519, "PRIVATE KEY"},
+	} {
+		priv, err := tc.keyType.GenerateKey()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.keyType, err)
+		}
+		block, err := marshalPrivateKey(priv)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.keyType, err)
+		}
+		if block.Type != tc.blockType {
+			t.Errorf("%s: written as %s", tc.keyType, block.Type)
+		}
+		parsed, err := parsePrivateKey(block)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.keyType, err)
+		}
+		if got, err := KeyTypeOf(parsed.Public()); err != nil || got != tc.keyType {
+			t.Errorf("%s: read back a %s key, %v", tc.keyType, got, err)
+		}
+	}
+}
+
+func TestKeyTypeOfRSASize(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, err := KeyTypeOf(priv.Public()); err == nil {
+		t.Errorf("2048-bit key labelled %s", k)
+	}
+	if name := keyTypeName(priv.Public()); name != "rsa-2048" {
+		t.Errorf("inventory labels a 2048-bit key %s", name)
+	}
+}
+
+func TestCheckKeyMatch(t *testing.T) {
+	leaf := issueTestCertificate(t, "leaf", 1, false, nil)
+	if err := checkKeyMatch(leaf.cert, leaf.key); err != nil {
+		t.Error(err)
+	}
+	other, err := KeyECDSAP256.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkKeyMatch(leaf.cert, other); err == nil {
+		t.Error("certificate matched another key")
+	}
+}
@@ -0,0 +1,128 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// KeyStore creates and holds the private keys of the certificates enrolled
+// by Generate. The key file written next to the certificate holds whatever
+// MarshalKey returns: the key itself for FileKeyStore, a reference to the
+// token object for PKCS11KeyStore.
+type KeyStore interface {
+	// GenerateKey creates a new key of type keyType.
+	GenerateKey(keyType KeyType) (crypto.Signer, error)
+	// MarshalKey returns the key file content for a key created by
+	// GenerateKey, once its certificate was issued.
+	MarshalKey(priv crypto.Signer) ([]byte, error)
+	// LoadKey returns the key described by a key file written with
+	// MarshalKey.
+	LoadKey(data []byte) (crypto.Signer, error)
+	// DeleteKey destroys a key created by GenerateKey. Generate calls it
+	// when the enrollment fails.
+	DeleteKey(priv crypto.Signer) error
+}
+
+// FileKeyStore is the default KeyStore: keys are generated in process and
+// saved as PEM, encrypted when Passphrase is set.
+type FileKeyStore struct {
+	Passphrase []byte
+	KDF        KDF
+}
+
+// GenerateKey implements KeyStore.
+func (s *FileKeyStore) GenerateKey(keyType KeyType) (crypto.Signer, error) {
+	return keyType.GenerateKey()
+}
+
+// MarshalKey implements KeyStore.
+func (s *FileKeyStore) MarshalKey(priv crypto.Signer) ([]byte, error) {
+	return encodePrivateKey(priv, s.Passphrase, s.KDF)
+}
+
+// LoadKey implements KeyStore.
+func (s *FileKeyStore) LoadKey(data []byte) (crypto.Signer, error) {
+	return parsePrivateKeyPEM(data, s.Passphrase, "key")
+}
+
+// DeleteKey implements KeyStore. There is nothing to clean up for keys
+// that were never written.
+func (s *FileKeyStore) DeleteKey(priv crypto.Signer) error {
+	return nil
+}
+
+// WithKeyStore makes Generate create the private key in store instead of
+// in process.
+func WithKeyStore(store KeyStore) GenerateOption {
+	return func(c *generateConfig) {
+		c.store = store
+	}
+}
+
+// keyStore returns the KeyStore selected by options, a FileKeyStore using
+// the WithKeyPassphrase passphrase by default.
+func (c generateConfig) keyStore() (KeyStore, error) {
+	if c.store != nil {
+		return c.store, nil
+	}
+	passphrase, err := c.keyPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return &FileKeyStore{Passphrase: passphrase, KDF: c.kdf}, nil
+}
+
+// LoadX509KeyPairFrom is LoadX509KeyPair for a key file written by store.
+func LoadX509KeyPairFrom(store KeyStore, certFilename, keyFilename string) (tls.Certificate, error) {
+	return loadX509KeyPair(certFilename, keyFilename, func() (crypto.Signer, error) {
+		data, err := ioutil.ReadFile(keyFilename)
+		if err != nil {
+			return nil, err
+		}
+		return store.LoadKey(data)
+	})
+}
+
+// parsePrivateKeyPEM decodes a PEM private key written by FileKeyStore.
+// name identifies the key in errors.
+func parsePrivateKeyPEM(data []byte, passphrase []byte, name string) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No private key found in %s", name)
+	}
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("%s is encrypted and no passphrase was given", name)
+		}
+		return DecryptPrivateKey(block, passphrase)
+	case pkcs11KeyBlockType:
+		return nil, fmt.Errorf("%s references a PKCS#11 key, load it with its KeyStore", name)
+	}
+	return parsePrivateKey(block)
+}
+
+// pkcs11KeyBlockType is the PEM type of the key files written by
+// PKCS11KeyStore.
+const pkcs11KeyBlockType = "PKCS11 KEY REFERENCE"
+
+var errKeyNotFound = errors.New("Private key not found in the key store")
@@ -0,0 +1,386 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+// +build cgo
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11KeyStore is a KeyStore keeping keys in a PKCS#11 token such as an
+// HSM or a SoftHSM token. Keys are generated on the token and cannot be
+// extracted; the key file only holds the token label, the key identifier
+// and the public key.
+//
+// Keys replaced by a renewal stay on the token so Rollback can use them.
+// Remove them with DeleteKey once their backup is gone.
+type PKCS11KeyStore struct {
+	token string
+	ctx   *pkcs11.Ctx
+
+	// mu serializes the use of session, PKCS#11 sessions are not safe
+	// for concurrent use.
+	mu      sync.Mutex
+	session pkcs11.SessionHandle
+}
+
+type pkcs11Curve struct {
+	curve elliptic.Curve
+	oid   asn1.ObjectIdentifier
+}
+
+var pkcs11Curves = map[KeyType]pkcs11Curve{
+	KeyECDSAP256: {elliptic.P256(), asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}},
+	KeyECDSAP384: {elliptic.P384(), asn1.ObjectIdentifier{1, 3, 132, 0, 34}},
+	KeyECDSAP521: {elliptic.P521(), asn1.ObjectIdentifier{1, 3, 132, 0, 35}},
+}
+
+var pkcs11RSABits = map[KeyType]int{
+	KeyRSA3072: 3072,
+	KeyRSA4096: 4096,
+}
+
+// NewPKCS11KeyStore loads the PKCS#11 module, e.g.
+// /usr/lib/softhsm/libsofthsm2.so, and logs in to the token labelled
+// tokenLabel with pin. Close releases the module.
+func NewPKCS11KeyStore(module, tokenLabel, pin string) (*PKCS11KeyStore, error) {
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("Failed to load PKCS#11 module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("Failed to initialize PKCS#11 module %s: %v", module, err)
+	}
+	s := &PKCS11KeyStore{token: tokenLabel, ctx: ctx}
+	if err := s.open(pin); err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PKCS11KeyStore) open(pin string) error {
+	slots, err := s.ctx.GetSlotList(true)
+	if err != nil {
+		return fmt.Errorf("Failed to list PKCS#11 slots: %v", err)
+	}
+	for _, slot := range slots {
+		info, err := s.ctx.GetTokenInfo(slot)
+		if err != nil || info.Label != s.token {
+			continue
+		}
+		s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return fmt.Errorf("Failed to open PKCS#11 session: %v", err)
+		}
+		err = s.ctx.Login(s.session, pkcs11.CKU_USER, pin)
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			s.ctx.CloseSession(s.session)
+			return fmt.Errorf("Failed to log in to PKCS#11 token %s: %v", s.token, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("PKCS#11 token %s not found", s.token)
+}
+
+// Close logs out of the token and unloads the module. Keys loaded from the
+// store cannot sign anymore.
+func (s *PKCS11KeyStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx.Logout(s.session)
+	err := s.ctx.CloseSession(s.session)
+	s.ctx.Finalize()
+	s.ctx.Destroy()
+	return err
+}
+
+// GenerateKey implements KeyStore. Ed25519 keys are not supported.
+func (s *PKCS11KeyStore) GenerateKey(keyType KeyType) (crypto.Signer, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	label := "ezBastion " + hex.EncodeToString(id)
+	public := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+	}
+	private := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+	}
+	var mechanism uint
+	if c, ok := pkcs11Curves[keyType]; ok {
+		params, err := asn1.Marshal(c.oid)
+		if err != nil {
+			return nil, err
+		}
+		mechanism = pkcs11.CKM_EC_KEY_PAIR_GEN
+		public = append(public, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params))
+	} else if bits, ok := pkcs11RSABits[keyType]; ok {
+		mechanism = pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN
+		public = append(public,
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, bits),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}))
+	} else {
+		return nil, fmt.Errorf("Key type %s is not supported by PKCS#11 key stores", keyType)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pubHandle, privHandle, err := s.ctx.GenerateKeyPair(s.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(mechanism, nil)}, public, private)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 key generation failed: %v", err)
+	}
+	pub, err := s.publicKey(pubHandle, keyType)
+	if err != nil {
+		s.ctx.DestroyObject(s.session, privHandle)
+		s.ctx.DestroyObject(s.session, pubHandle)
+		return nil, err
+	}
+	return &pkcs11Key{store: s, handle: privHandle, id: id, pub: pub}, nil
+}
+
+// publicKey reads the public key object created with a key of keyType.
+func (s *PKCS11KeyStore) publicKey(handle pkcs11.ObjectHandle, keyType KeyType) (crypto.PublicKey, error) {
+	if c, ok := pkcs11Curves[keyType]; ok {
+		attrs, err := s.ctx.GetAttributeValue(s.session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read PKCS#11 public key: %v", err)
+		}
+		// CKA_EC_POINT is a DER OCTET STRING, but some modules return the
+		// bare point.
+		point := attrs[0].Value
+		var inner []byte
+		if rest, err := asn1.Unmarshal(point, &inner); err == nil && len(rest) == 0 {
+			point = inner
+		}
+		x, y := elliptic.Unmarshal(c.curve, point)
+		if x == nil {
+			return nil, errors.New("Invalid PKCS#11 EC public key")
+		}
+		return &ecdsa.PublicKey{Curve: c.curve, X: x, Y: y}, nil
+	}
+	attrs, err := s.ctx.GetAttributeValue(s.session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read PKCS#11 public key: %v", err)
+	}
+	e := new(big.Int).SetBytes(attrs[1].Value)
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("Invalid PKCS#11 RSA public exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(attrs[0].Value), E: int(e.Int64())}, nil
+}
+
+// MarshalKey implements KeyStore. The key file is a PEM block of type
+// pkcs11KeyBlockType holding the public key, with the token label and key
+// identifier in its headers.
+func (s *PKCS11KeyStore) MarshalKey(priv crypto.Signer) ([]byte, error) {
+	key, ok := priv.(*pkcs11Key)
+	if !ok || key.store != s {
+		return nil, errors.New("Private key does not belong to this PKCS#11 key store")
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.pub)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:    pkcs11KeyBlockType,
+		Headers: map[string]string{"Token": s.token, "Id": hex.EncodeToString(key.id)},
+		Bytes:   der,
+	}), nil
+}
+
+// LoadKey implements KeyStore.
+func (s *PKCS11KeyStore) LoadKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pkcs11KeyBlockType {
+		return nil, errors.New("No PKCS#11 key reference found")
+	}
+	if token := block.Headers["Token"]; token != s.token {
+		return nil, fmt.Errorf("Key belongs to PKCS#11 token %s, not %s", token, s.token)
+	}
+	id, err := hex.DecodeString(block.Headers["Id"])
+	if err != nil || len(id) == 0 {
+		return nil, errors.New("Invalid PKCS#11 key identifier")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	handles, err := s.find(pkcs11.CKO_PRIVATE_KEY, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(handles) == 0 {
+		return nil, errKeyNotFound
+	}
+	return &pkcs11Key{store: s, handle: handles[0], id: id, pub: pub}, nil
+}
+
+// DeleteKey implements KeyStore, destroying both halves of the key pair.
+func (s *PKCS11KeyStore) DeleteKey(priv crypto.Signer) error {
+	key, ok := priv.(*pkcs11Key)
+	if !ok || key.store != s {
+		return errors.New("Private key does not belong to this PKCS#11 key store")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+		handles, err := s.find(class, key.id)
+		if err != nil {
+			return err
+		}
+		for _, handle := range handles {
+			if err = s.ctx.DestroyObject(s.session, handle); err != nil {
+				return fmt.Errorf("Failed to delete PKCS#11 key: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// find returns the objects of class with identifier id. s.mu must be held.
+func (s *PKCS11KeyStore) find(class uint, id []byte) ([]pkcs11.ObjectHandle, error) {
+	err := s.ctx.FindObjectsInit(s.session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 search failed: %v", err)
+	}
+	defer s.ctx.FindObjectsFinal(s.session)
+	handles, _, err := s.ctx.FindObjects(s.session, 16)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 search failed: %v", err)
+	}
+	return handles, nil
+}
+
+func (s *PKCS11KeyStore) sign(mechanism *pkcs11.Mechanism, handle pkcs11.ObjectHandle, data []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{mechanism}, handle); err != nil {
+		return nil, fmt.Errorf("PKCS#11 signature failed: %v", err)
+	}
+	sig, err := s.ctx.Sign(s.session, data)
+	if err != nil {
+		return nil, fmt.Errorf("PKCS#11 signature failed: %v", err)
+	}
+	return sig, nil
+}
+
+// pkcs11Key is a crypto.Signer for a private key held by a PKCS11KeyStore.
+type pkcs11Key struct {
+	store  *PKCS11KeyStore
+	handle pkcs11.ObjectHandle
+	id     []byte
+	pub    crypto.PublicKey
+}
+
+func (k *pkcs11Key) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// DigestInfo prefixes of RSA PKCS #1 v1.5 signatures, which the token
+// expects in front of the digest with CKM_RSA_PKCS.
+var pkcs1Prefixes = map[crypto.Hash][]byte{
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pssMechanisms maps a hash to its PKCS#11 hash mechanism and MGF1 function.
+var pssMechanisms = map[crypto.Hash][2]uint{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
+func (k *pkcs11Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	hash := opts.HashFunc()
+	if len(digest) != hash.Size() {
+		return nil, errors.New("Digest length does not match the hash function")
+	}
+	switch k.pub.(type) {
+	case *ecdsa.PublicKey:
+		sig, err := k.store.sign(pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil), k.handle, digest)
+		if err != nil {
+			return nil, err
+		}
+		// PKCS#11 returns r || s, Go expects an ASN.1 sequence.
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	case *rsa.PublicKey:
+		if pss, ok := opts.(*rsa.PSSOptions); ok {
+			mechanisms, ok := pssMechanisms[hash]
+			if !ok {
+				return nil, fmt.Errorf("Unsupported hash function %v", hash)
+			}
+			saltLength := pss.SaltLength
+			if saltLength <= 0 {
+				saltLength = hash.Size()
+			}
+			params := pkcs11.NewPSSParams(mechanisms[0], mechanisms[1], uint(saltLength))
+			return k.store.sign(pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS, params), k.handle, digest)
+		}
+		prefix, ok := pkcs1Prefixes[hash]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported hash function %v", hash)
+		}
+		data := append(append([]byte{}, prefix...), digest...)
+		return k.store.sign(pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), k.handle, data)
+	}
+	return nil, errors.New("Unsupported PKCS#11 key type")
+}
@@ -0,0 +1,37 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !cgo
+// +build !cgo
+
+package certmanager
+
+import "errors"
+
+// PKCS11KeyStore needs cgo to load the PKCS#11 module. In builds without
+// cgo NewPKCS11KeyStore always fails.
+type PKCS11KeyStore struct {
+	KeyStore
+}
+
+// NewPKCS11KeyStore returns an error: this build has no PKCS#11 support.
+func NewPKCS11KeyStore(module, tokenLabel, pin string) (*PKCS11KeyStore, error) {
+	return nil, errors.New("PKCS#11 support requires a build with cgo enabled")
+}
+
+// Close does nothing.
+func (s *PKCS11KeyStore) Close() error {
+	return nil
+}
@@ -0,0 +1,150 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build cgo
+// +build cgo
+
+package certmanager
+
+import (
+	"crypto"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// The SoftHSM test runs against a token initialized beforehand with
+//
+//	softhsm2-util --init-token --free --label ezbtest --pin 1234 --so-pin 1234
+//
+// SOFTHSM2_CONF must point to its configuration, and SOFTHSM2_MODULE to the
+// module unless it is at the default path.
+const (
+	softHSMToken  = "ezbtest"
+	softHSMPIN    = "1234"
+	softHSMModule = "/usr/lib/softhsm/libsofthsm2.so"
+)
+
+func openSoftHSM(t *testing.T) *PKCS11KeyStore {
+	t.Helper()
+	if os.Getenv("SOFTHSM2_CONF") == "" {
+		t.Skip("SOFTHSM2_CONF not set")
+	}
+	module := os.Getenv("SOFTHSM2_MODULE")
+	if module == "" {
+		module = softHSMModule
+	}
+	if _, err := os.Stat(module); err != nil {
+		t.Skipf("SoftHSM module not found: %v", err)
+	}
+	store, err := NewPKCS11KeyStore(module, softHSMToken, softHSMPIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// signCounter counts the signatures made with a key of the token.
+type signCounter struct {
+	crypto.Signer
+	signs *int32
+}
+
+func (k signCounter) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	atomic.AddInt32(k.signs, 1)
+	return k.Signer.Sign(rand, digest, opts)
+}
+
+// countingStore is a PKCS11KeyStore counting the signatures of the keys it
+// generates.
+type countingStore struct {
+	*PKCS11KeyStore
+	signs int32
+}
+
+func (s *countingStore) GenerateKey(keyType KeyType) (crypto.Signer, error) {
+	priv, err := s.PKCS11KeyStore.GenerateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	return signCounter{priv, &s.signs}, nil
+}
+
+func (s *countingStore) MarshalKey(priv crypto.Signer) ([]byte, error) {
+	return s.PKCS11KeyStore.MarshalKey(priv.(signCounter).Signer)
+}
+
+func (s *countingStore) DeleteKey(priv crypto.Signer) error {
+	return s.PKCS11KeyStore.DeleteKey(priv.(signCounter).Signer)
+}
+
+func TestPKCS11SoftHSM(t *testing.T) {
+	store := &countingStore{PKCS11KeyStore: openSoftHSM(t)}
+	addr := serve(t, newServer(t, DefaultSignPolicy()))
+	for _, keyType := range []KeyType{KeyECDSAP256, KeyECDSAP384, KeyRSA3072} {
+		files := newTestFiles(t)
+		before := atomic.LoadInt32(&store.signs)
+		result, err := files.generate(addr, "hsm-"+string(keyType), nil, WithKeyStore(store))
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if atomic.LoadInt32(&store.signs) == before {
+			t.Errorf("%s: CSR not signed on the token", keyType)
+		}
+
+		// The key file only references the token key.
+		data, err := ioutil.ReadFile(files.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rest := data; ; {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+			if block.Type != pkcs11KeyBlockType {
+				t.Errorf("%s: key file holds a %s block", keyType, block.Type)
+			}
+		}
+		matches, _ := filepath.Glob(filepath.Join(filepath.Dir(files.key), "*"))
+		for _, filename := range matches {
+			content, _ := ioutil.ReadFile(filename)
+			if strings.Contains(string(content), "PRIVATE KEY") {
+				t.Errorf("%s: private key written to %s", keyType, filename)
+			}
+		}
+
+		pair, err := LoadX509KeyPairFrom(store, files.cert, files.key)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		priv, ok := pair.PrivateKey.(*pkcs11Key)
+		if !ok {
+			t.Fatalf("%s: loaded a %T key", keyType, pair.PrivateKey)
+		}
+		if err = checkKeyMatch(result.Certificate, priv); err != nil {
+			t.Errorf("%s: %v", keyType, err)
+		}
+		if err = store.PKCS11KeyStore.DeleteKey(priv); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+// Minimal PKCS#12 (RFC 7292) codec. Encode writes what current OpenSSL, Java
+// and Windows import: certificates in a plain SafeContents, the key in a
+// pkcs8ShroudedKeyBag encrypted with PBES2 (PBKDF2-HMAC-SHA256, AES-256-CBC)
+// and an HMAC-SHA256 integrity MAC. Decode reads the same, plus certificate
+// SafeContents encrypted with PBES2 as produced by OpenSSL 3. Legacy RC2 and
+// 3DES files are not supported.
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	pkcs12Iterations = 100000
+	pkcs12MacIter    = 2048
+	// maxPKCS12Iterations bounds the iteration counts read from a file, see
+	// maxPBKDF2Iterations.
+	maxPKCS12Iterations = 16 * pkcs12Iterations
+)
+
+var (
+	oidDataContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+	oidCertBag                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidPKCS8ShroudedKeyBag      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertTypeX509             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidLocalKeyID               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 21}
+	oidSHA256                   = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA1                     = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidAES256CBC                = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+// EncodePKCS12 returns a PKCS#12 file holding priv, its certificate and the
+// CA chain, protected by password.
+func EncodePKCS12(priv crypto.Signer, cert *x509.Certificate, caCerts []*x509.Certificate, password string, friendlyName string) ([]byte, error) {
+	if err := checkKeyMatch(cert, priv); err != nil {
+		return nil, err
+	}
+	localKeyID := sha1.Sum(cert.Raw)
+	leafAttributes, err := bagAttributes(localKeyID[:], friendlyName)
+	if err != nil {
+		return nil, err
+	}
+
+	var certBags []safeBag
+	for i, c := range append([]*x509.Certificate{cert}, caCerts...) {
+		bag, err := asn1.Marshal(certBag{ID: oidCertTypeX509, Data: c.Raw})
+		if err != nil {
+			return nil, err
+		}
+		sb := safeBag{ID: oidCertBag, Value: explicitValue(bag)}
+		if i == 0 {
+			sb.Attributes = leafAttributes
+		}
+		certBags = append(certBags, sb)
+	}
+
+	shrouded, err := encryptPKCS8CBC(priv, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+	keyBags := []safeBag{{ID: oidPKCS8ShroudedKeyBag, Value: explicitValue(shrouded), Attributes: leafAttributes}}
+
+	var authSafe []contentInfo
+	for _, bags := range [][]safeBag{certBags, keyBags} {
+		ci, err := dataContentInfo(bags)
+		if err != nil {
+			return nil, err
+		}
+		authSafe = append(authSafe, ci)
+	}
+	authSafeBytes, err := asn1.Marshal(authSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	mac := pkcs12MAC(sha256.New, authSafeBytes, password, salt, pkcs12MacIter)
+	outer, err := asn1.Marshal(authSafeBytes)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pfxPdu{
+		Version:  3,
+		AuthSafe: contentInfo{ContentType: oidDataContentType, Content: explicitValue(outer)},
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+				Digest:    mac,
+			},
+			MacSalt:    salt,
+			Iterations: pkcs12MacIter,
+		},
+	})
+}
+
+// DecodePKCS12 extracts the private key, its certificate and the remaining
+// certificates from a PKCS#12 file.
+func DecodePKCS12(pfxData []byte, password string) (crypto.Signer, *x509.Certificate, []*x509.Certificate, error) {
+	var pfx pfxPdu
+	if err := unmarshalStrict(pfxData, &pfx); err != nil {
+		return nil, nil, nil, fmt.Errorf("Not a PKCS#12 file: %v", err)
+	}
+	if pfx.Version != 3 || !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		return nil, nil, nil, errors.New("Unsupported PKCS#12 file")
+	}
+	var authSafeBytes []byte
+	if err := unmarshalStrict(pfx.AuthSafe.Content.Bytes, &authSafeBytes); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := verifyPKCS12MAC(pfx.MacData, authSafeBytes, password); err != nil {
+		return nil, nil, nil, err
+	}
+	var authSafe []contentInfo
+	if err := unmarshalStrict(authSafeBytes, &authSafe); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var priv crypto.Signer
+	var certs []*x509.Certificate
+	for _, ci := range authSafe {
+		var contents []byte
+		switch {
+		case ci.ContentType.Equal(oidDataContentType):
+			if err := unmarshalStrict(ci.Content.Bytes, &contents); err != nil {
+				return nil, nil, nil, err
+			}
+		case ci.ContentType.Equal(oidEncryptedDataContentType):
+			var ed encryptedData
+			if err := unmarshalStrict(ci.Content.Bytes, &ed); err != nil {
+				return nil, nil, nil, err
+			}
+			var err error
+			contents, err = decryptPBES2CBC(ed.EncryptedContentInfo.ContentEncryptionAlgorithm, ed.EncryptedContentInfo.EncryptedContent, []byte(password))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		default:
+			return nil, nil, nil, fmt.Errorf("Unsupported PKCS#12 content type %s", ci.ContentType)
+		}
+
+		var bags []safeBag
+		if err := unmarshalStrict(contents, &bags); err != nil {
+			return nil, nil, nil, err
+		}
+		for _, bag := range bags {
+			switch {
+			case bag.ID.Equal(oidCertBag):
+				var cb certBag
+				if err := unmarshalStrict(bag.Value.Bytes, &cb); err != nil {
+					return nil, nil, nil, err
+				}
+				cert, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				certs = append(certs, cert)
+			case bag.ID.Equal(oidPKCS8ShroudedKeyBag):
+				if priv != nil {
+					return nil, nil, nil, errors.New("PKCS#12 file holds more than one private key")
+				}
+				var info encryptedPrivateKeyInfo
+				if err := unmarshalStrict(bag.Value.Bytes, &info); err != nil {
+					return nil, nil, nil, err
+				}
+				plain, err := decryptPBES2CBC(info.Algorithm, info.EncryptedData, []byte(password))
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				if priv, err = parsePrivateKey(&pem.Block{Type: "PRIVATE KEY", Bytes: plain}); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+		}
+	}
+	if priv == nil {
+		return nil, nil, nil, errors.New("No private key found in PKCS#12 file")
+	}
+
+	var leaf *x509.Certificate
+	var caCerts []*x509.Certificate
+	for _, cert := range certs {
+		if leaf == nil && checkKeyMatch(cert, priv) == nil {
+			leaf = cert
+		} else {
+			caCerts = append(caCerts, cert)
+		}
+	}
+	if leaf == nil {
+		return nil, nil, nil, errors.New("No certificate matching the private key found in PKCS#12 file")
+	}
+	return priv, leaf, caCerts, nil
+}
+
+func explicitValue(b []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: b}
+}
+
+func dataContentInfo(bags []safeBag) (contentInfo, error) {
+	b, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	octets, err := asn1.Marshal(b)
+	if err != nil {
+		return contentInfo{}, err
+	}
+	return contentInfo{ContentType: oidDataContentType, Content: explicitValue(octets)}, nil
+}
+
+func bagAttributes(localKeyID []byte, friendlyName string) ([]pkcs12Attribute, error) {
+	id, err := asn1.Marshal(localKeyID)
+	if err != nil {
+		return nil, err
+	}
+	attributes := []pkcs12Attribute{{ID: oidLocalKeyID, Value: asn1.RawValue{Tag: asn1.TagSet, Class: asn1.ClassUniversal, IsCompound: true, Bytes: id}}}
+	if friendlyName != "" {
+		name, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagBMPString, Class: asn1.ClassUniversal, Bytes: bmpString(friendlyName, false)})
+		if err != nil {
+			return nil, err
+		}
+		attributes = append(attributes, pkcs12Attribute{ID: oidFriendlyName, Value: asn1.RawValue{Tag: asn1.TagSet, Class: asn1.ClassUniversal, IsCompound: true, Bytes: name}})
+	}
+	return attributes, nil
+}
+
+// bmpString encodes s as big endian UTF-16, with the terminating NUL the
+// PKCS#12 key derivation expects when nul is set.
+func bmpString(s string, nul bool) []byte {
+	var buf bytes.Buffer
+	for _, r := range utf16.Encode([]rune(s)) {
+		buf.WriteByte(byte(r >> 8))
+		buf.WriteByte(byte(r))
+	}
+	if nul {
+		buf.Write([]byte{0, 0})
+	}
+	return buf.Bytes()
+}
+
+// pkcs12KDF is the key derivation of RFC 7292 appendix B.2.
+func pkcs12KDF(h func() hash.Hash, id byte, password, salt []byte, iterations, size int) []byte {
+	u := h().Size()
+	v := h().BlockSize()
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+	D := bytes.Repeat([]byte{id}, v)
+	I := append(fill(salt), fill(password)...)
+
+	var out []byte
+	for len(out) < size {
+		A := append(append([]byte{}, D...), I...)
+		for i := 0; i < iterations; i++ {
+			hh := h()
+			hh.Write(A)
+			A = hh.Sum(nil)
+		}
+		out = append(out, A...)
+		B := make([]byte, v)
+		for i := range B {
+			B[i] = A[i%u]
+		}
+		for j := 0; j < len(I); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(I[j+k]) + int(B[k]) + carry
+				I[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return out[:size]
+}
+
+func pkcs12MAC(h func() hash.Hash, data []byte, password string, salt []byte, iterations int) []byte {
+	key := pkcs12KDF(h, 3, bmpString(password, true), salt, iterations, h().Size())
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func verifyPKCS12MAC(md macData, data []byte, password string) error {
+	var h func() hash.Hash
+	switch alg := md.Mac.Algorithm.Algorithm; {
+	case alg.Equal(oidSHA256):
+		h = sha256.New
+	case alg.Equal(oidSHA1):
+		h = sha1.New
+	default:
+		return fmt.Errorf("Unsupported PKCS#12 MAC algorithm %s", alg)
+	}
+	if err := checkIterations(md.Iterations, maxPKCS12Iterations); err != nil {
+		return err
+	}
+	if !hmac.Equal(pkcs12MAC(h, data, password, md.MacSalt, md.Iterations), md.Mac.Digest) {
+		return ErrBadPassphrase
+	}
+	return nil
+}
+
+// encryptPKCS8CBC returns priv as a DER EncryptedPrivateKeyInfo using PBES2
+// with PBKDF2-HMAC-SHA256 and AES-256-CBC, the most widely readable PBES2
+// profile.
+func encryptPKCS8CBC(priv crypto.Signer, password []byte) ([]byte, error) {
+	plain, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	iv := make([]byte, aes.BlockSize)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	kdfAlg, err := algorithmIdentifier(oidPBKDF2, pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pkcs12Iterations,
+		KeyLength:      encKeyLen,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encAlg, err := algorithmIdentifier(oidAES256CBC, iv)
+	if err != nil {
+		return nil, err
+	}
+	pbes2Alg, err := algorithmIdentifier(oidPBES2, pbes2Params{KeyDerivationFunc: kdfAlg, EncryptionScheme: encAlg})
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key(password, salt, pkcs12Iterations, encKeyLen, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	pad := aes.BlockSize - len(plain)%aes.BlockSize
+	data := append(plain, bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: pbes2Alg, EncryptedData: data})
+}
+
+// decryptPBES2CBC decrypts data encrypted with PBES2, PBKDF2 and AES-CBC.
+func decryptPBES2CBC(alg pkix.AlgorithmIdentifier, data, password []byte) ([]byte, error) {
+	if !alg.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported PKCS#12 encryption %s, only PBES2 is supported", alg.Algorithm)
+	}
+	var params pbes2Params
+	if err := unmarshalStrict(alg.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("Unsupported key derivation function %s", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if err := unmarshalStrict(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	h := sha1.New
+	if len(kdf.PRF.Algorithm) > 0 {
+		if !kdf.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+			return nil, fmt.Errorf("Unsupported PBKDF2 PRF %s", kdf.PRF.Algorithm)
+		}
+		h = sha256.New
+	}
+	if !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, fmt.Errorf("Unsupported cipher %s", params.EncryptionScheme.Algorithm)
+	}
+	var iv []byte
+	if err := unmarshalStrict(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if err := checkIterations(kdf.IterationCount, maxPKCS12Iterations); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pbkdf2.Key(password, kdf.Salt, kdf.IterationCount, encKeyLen, h))
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errors.New("Malformed AES-CBC ciphertext")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, ErrBadPassphrase
+	}
+	return plain[:len(plain)-pad], nil
+}
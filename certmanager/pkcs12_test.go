@@ -0,0 +1,223 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/asn1"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fixturePassword protects the files of testdata/pkcs12, see gen.sh there.
+const fixturePassword = "ezbastion"
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "pkcs12", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPKCS12RoundTrip(t *testing.T) {
+	s := newServer(t, DefaultSignPolicy())
+	addr := serve(t, s)
+	for _, keyType := range []KeyType{KeyECDSAP256, KeyECDSAP384, KeyRSA3072, KeyEd25519} {
+		files := newTestFiles(t)
+		request := NewCertificateRequest("node1", 0, nil, WithKeyType(keyType))
+		if _, err := GenerateContext(context.Background(), request, addr, files.cert, files.key, files.ca, WithProgress(quiet)); err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		p12 := filepath.Join(tempDir(t), "node.p12")
+		if err := ExportPKCS12(files.cert, files.key, files.ca, nil, p12, "secret"); err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		pfx, err := ioutil.ReadFile(p12)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err = DecodePKCS12(pfx, "wrong"); err == nil {
+			t.Errorf("%s: decoded with a wrong password", keyType)
+		}
+		priv, leaf, caCerts, err := DecodePKCS12(pfx, "secret")
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if got, _ := KeyTypeOf(priv.Public()); got != keyType {
+			t.Errorf("%s: decoded a %s key", keyType, got)
+		}
+		if leaf.Subject.CommonName != "node1" || len(caCerts) != 1 || !caCerts[0].Equal(s.RootCertificate()) {
+			t.Errorf("%s: decoded %s and %d CA certificates", keyType, leaf.Subject, len(caCerts))
+		}
+
+		imported := newTestFiles(t)
+		if err = ImportPKCS12(p12, "secret", imported.cert, imported.key, imported.ca); err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if _, err = LoadX509KeyPair(imported.cert, imported.key, nil); err != nil {
+			t.Errorf("%s: %v", keyType, err)
+		}
+	}
+}
+
+// TestPKCS12OpenSSLFixtures decodes files written by openssl pkcs12 -export.
+func TestPKCS12OpenSSLFixtures(t *testing.T) {
+	for _, tc := range []struct {
+		file    string
+		keyType KeyType
+		leaf    string
+	}{
+		{"ec.p12", KeyECDSAP256, "node1-ec"},
+		{"rsa.p12", "", "node1-rsa"},
+		{"macsha1.p12", KeyECDSAP256, "node1-ec"},
+		{"rootfirst.p12", KeyECDSAP256, "node1-ec"},
+	} {
+		priv, leaf, caCerts, err := DecodePKCS12(readFixture(t, tc.file), fixturePassword)
+		if err != nil {
+			t.Errorf("%s: %v", tc.file, err)
+			continue
+		}
+		if err = checkKeyMatch(leaf, priv); err != nil {
+			t.Errorf("%s: %v", tc.file, err)
+		}
+		if got, _ := KeyTypeOf(priv.Public()); tc.keyType != "" && got != tc.keyType {
+			t.Errorf("%s: decoded a %s key", tc.file, got)
+		}
+		if leaf.Subject.CommonName != tc.leaf || len(caCerts) != 2 {
+			t.Errorf("%s: decoded %s and %d CA certificates", tc.file, leaf.Subject, len(caCerts))
+		}
+	}
+	if _, _, _, err := DecodePKCS12(readFixture(t, "ec.p12"), "wrong"); err == nil {
+		t.Errorf("decoded with a wrong password")
+	}
+	if _, _, _, err := DecodePKCS12(readFixture(t, "legacy.p12"), fixturePassword); err == nil {
+		t.Errorf("legacy RC2/3DES file decoded")
+	}
+
+	// A crafted iteration count is refused before running the KDF.
+	var pfx pfxPdu
+	if err := unmarshalStrict(readFixture(t, "ec.p12"), &pfx); err != nil {
+		t.Fatal(err)
+	}
+	pfx.MacData.Iterations = 1 << 30
+	crafted, err := asn1.Marshal(pfx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = DecodePKCS12(crafted, fixturePassword); err == nil || !strings.Contains(err.Error(), "iteration count") {
+		t.Errorf("MAC with 2^30 iterations: %v", err)
+	}
+}
+
+// TestImportPKCS12ChainOrder checks the chain is ordered by verification,
+// not by the order of the bags.
+func TestImportPKCS12ChainOrder(t *testing.T) {
+	for _, name := range []string{"ec.p12", "rootfirst.p12"} {
+		p12 := filepath.Join(tempDir(t), name)
+		if err := ioutil.WriteFile(p12, readFixture(t, name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		files := newTestFiles(t)
+		if err := ImportPKCS12(p12, fixturePassword, files.cert, files.key, files.ca); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		certs, err := loadCertificates(files.cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(certs) != 2 || certs[0].Subject.CommonName != "node1-ec" || certs[1].Subject.CommonName != "fixture intermediate" {
+			t.Errorf("%s: saved certificates %v", name, certificateNames(certs))
+		}
+		roots, err := loadCertificates(files.ca)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roots) != 1 || roots[0].Subject.CommonName != "fixture root" {
+			t.Errorf("%s: saved CA %v", name, certificateNames(roots))
+		}
+
+		// The full chain split the same way, whatever the CA order.
+		fullchain := filepath.Join(tempDir(t), "fullchain.pem")
+		if err = writeCertificates(fullchain, append(roots, certs...)); err != nil {
+			t.Fatal(err)
+		}
+		split := newTestFiles(t)
+		if err = ImportFullChain(fullchain, split.cert, split.ca); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for _, f := range [][2]string{{files.cert, split.cert}, {files.ca, split.ca}} {
+			want, _ := ioutil.ReadFile(f[0])
+			got, _ := ioutil.ReadFile(f[1])
+			if !bytes.Equal(want, got) {
+				t.Errorf("%s: ImportFullChain wrote %s differently", name, filepath.Base(f[1]))
+			}
+		}
+	}
+
+	// A chain missing its intermediate does not verify.
+	_, leaf, caCerts, err := DecodePKCS12(readFixture(t, "ec.p12"), fixturePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roots []*x509.Certificate
+	for _, cert := range caCerts {
+		if cert.Subject.CommonName == "fixture root" {
+			roots = append(roots, cert)
+		}
+	}
+	if _, _, err = orderChain(leaf, roots); err == nil {
+		t.Errorf("chain without its intermediate accepted")
+	}
+}
+
+// TestPKCS12OpenSSLInterop has openssl read a file written by EncodePKCS12.
+func TestPKCS12OpenSSLInterop(t *testing.T) {
+	openssl, err := exec.LookPath("openssl")
+	if err != nil {
+		t.Skip("openssl not found")
+	}
+	s := newServer(t, DefaultSignPolicy())
+	files := newTestFiles(t)
+	if _, err = files.generate(serve(t, s), "node1", nil); err != nil {
+		t.Fatal(err)
+	}
+	p12 := filepath.Join(tempDir(t), "node.p12")
+	if err = ExportPKCS12(files.cert, files.key, files.ca, nil, p12, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(openssl, "pkcs12", "-in", p12, "-passin", "pass:secret", "-nodes").CombinedOutput()
+	if err != nil {
+		t.Fatalf("openssl: %v\n%s", err, out)
+	}
+	if n := strings.Count(string(out), "BEGIN CERTIFICATE"); n != 2 || !strings.Contains(string(out), "BEGIN PRIVATE KEY") {
+		t.Errorf("openssl read:\n%s", out)
+	}
+}
+
+func certificateNames(certs []*x509.Certificate) []string {
+	var names []string
+	for _, cert := range certs {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
@@ -0,0 +1,82 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// Degenerate "certs-only" PKCS#7 SignedData (RFC 5652 and RFC 7030 section
+// 4.1.3): a certificate bag without content nor signers, as exchanged by EST.
+
+var oidSignedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+// EncodeCertsOnly returns certs as a DER encoded certs-only PKCS#7.
+func EncodeCertsOnly(certs []*x509.Certificate) ([]byte, error) {
+	var raw []byte
+	for _, cert := range certs {
+		raw = append(raw, cert.Raw...)
+	}
+	emptySet := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+	sd, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidDataContentType},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos:      emptySet,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{ContentType: oidSignedDataContentType, Content: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd}})
+}
+
+// DecodeCertsOnly returns the certificates of a DER encoded PKCS#7
+// SignedData, ignoring anything else it holds.
+func DecodeCertsOnly(der []byte) ([]*x509.Certificate, error) {
+	var ci pkcs7ContentInfo
+	if err := unmarshalStrict(der, &ci); err != nil {
+		return nil, fmt.Errorf("Invalid PKCS#7: %v", err)
+	}
+	if !ci.ContentType.Equal(oidSignedDataContentType) {
+		return nil, fmt.Errorf("Unsupported PKCS#7 content type %v", ci.ContentType)
+	}
+	var sd pkcs7SignedData
+	if err := unmarshalStrict(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("Invalid PKCS#7 SignedData: %v", err)
+	}
+	if len(sd.Certificates.Bytes) == 0 {
+		return nil, errors.New("PKCS#7 holds no certificate")
+	}
+	return x509.ParseCertificates(sd.Certificates.Bytes)
+}
@@ -0,0 +1,98 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"fmt"
+)
+
+// EnrollStep identifies the progress reported by an enrollment.
+type EnrollStep int
+
+const (
+	// EnrollRequestCreated: the key and the CSR are ready.
+	EnrollRequestCreated EnrollStep = iota + 1
+	// EnrollConnected: the CA was reached.
+	EnrollConnected
+	// EnrollFallback: the PKI does not speak protocol v2, v1 is tried.
+	EnrollFallback
+	// EnrollPending: the request waits for manual approval and will be
+	// submitted again.
+	EnrollPending
+	// EnrollCertificateReceived: the CA issued the certificate.
+	EnrollCertificateReceived
+	// EnrollChainReceived: the CA certificates were received.
+	EnrollChainReceived
+	// EnrollVerified: the certificate chains to the CA root.
+	EnrollVerified
+	// EnrollSaved: the certificate, key and CA files were written.
+	EnrollSaved
+)
+
+var enrollStepNames = map[EnrollStep]string{
+	EnrollRequestCreated:      "request created",
+	EnrollConnected:           "connected",
+	EnrollFallback:            "fallback",
+	EnrollPending:             "pending",
+	EnrollCertificateReceived: "certificate received",
+	EnrollChainReceived:       "chain received",
+	EnrollVerified:            "verified",
+	EnrollSaved:               "saved",
+}
+
+func (s EnrollStep) String() string {
+	if name, ok := enrollStepNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("step %d", int(s))
+}
+
+// EnrollEvent is a progress report of an enrollment.
+type EnrollEvent struct {
+	Step EnrollStep
+	// Message is the human readable report, as printed by default.
+	Message string
+}
+
+// WithProgress sends the progress of the enrollment to progress instead of
+// printing it on stdout. progress is called from the enrolling goroutine;
+// forward the events to a channel to consume them elsewhere.
+func WithProgress(progress func(EnrollEvent)) GenerateOption {
+	return func(c *generateConfig) {
+		c.progress = progress
+	}
+}
+
+type progressKey struct{}
+
+// withProgress makes progress reachable by reportProgress from the enroll
+// functions running under ctx. A nil progress prints the messages.
+func withProgress(ctx context.Context, progress func(EnrollEvent)) context.Context {
+	if progress == nil {
+		progress = func(e EnrollEvent) {
+			fmt.Println(e.Message)
+		}
+	}
+	return context.WithValue(ctx, progressKey{}, progress)
+}
+
+// reportProgress reports step to the progress function of ctx, if any.
+func reportProgress(ctx context.Context, step EnrollStep, format string, args ...interface{}) {
+	if progress, ok := ctx.Value(progressKey{}).(func(EnrollEvent)); ok {
+		progress(EnrollEvent{Step: step, Message: fmt.Sprintf(format, args...)})
+	}
+}
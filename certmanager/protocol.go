@@ -0,0 +1,350 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+// Enrollment wire protocol.
+//
+// v1 is the historical exchange: the client sends a uint16 little endian
+// length followed by the DER CSR, the PKI answers with the same framing for
+// the issued certificate and then for its root certificate. There is no way
+// to report an error other than closing the connection.
+//
+// v2 starts every message with the 4 byte magic "EZBP" and a version byte.
+// Each frame is then a type byte, a uint32 big endian length and the payload.
+// The client sends a single FrameCSR. The PKI answers either with a
+// FrameCertificate followed by a FrameChain, or with a FrameError. A chain
+// payload is a list of uint32 length prefixed DER certificates, issuer of the
+// leaf first. An error payload is a uint16 code followed by a UTF-8 message.
+//
+// A PKI requiring manual approval answers a FramePending instead, whose
+// payload is the uint32 number of seconds to wait followed by the request
+// identifier. The client then submits the same CSR again, until it receives
+// the certificate or an error.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+)
+
+// MaxFrameSize bounds the payload accepted by ReadFrame.
+const MaxFrameSize = 16 << 20
+
+var protocolMagic = []byte("EZBP")
+
+// FrameType identifies the payload of a v2 frame.
+type FrameType byte
+
+const (
+	FrameCSR         FrameType = 1
+	FrameCertificate FrameType = 2
+	FrameChain       FrameType = 3
+	FrameError       FrameType = 4
+	FramePending     FrameType = 5
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameCSR:
+		return "csr"
+	case FrameCertificate:
+		return "certificate"
+	case FrameChain:
+		return "chain"
+	case FrameError:
+		return "error"
+	case FramePending:
+		return "pending"
+	}
+	return fmt.Sprintf("frame(%d)", byte(t))
+}
+
+// Error codes carried by a FrameError.
+const (
+	ErrCodeBadRequest         uint16 = 1
+	ErrCodeRejected           uint16 = 2
+	ErrCodeInternal           uint16 = 3
+	ErrCodeUnsupportedVersion uint16 = 4
+)
+
+// ProtocolError is an error reported by the PKI in a FrameError.
+type ProtocolError struct {
+	Code    uint16
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("PKI error %d: %s", e.Code, e.Message)
+}
+
+// asProtocolError returns err as reported to a client, errors of other
+// types becoming ErrCodeInternal.
+func asProtocolError(err error) *ProtocolError {
+	if perr, ok := err.(*ProtocolError); ok {
+		return perr
+	}
+	return &ProtocolError{Code: ErrCodeInternal, Message: err.Error()}
+}
+
+// PendingError is returned when the PKI holds a request for manual approval.
+// Submitting the same CSR again after RetryAfter returns the certificate
+// once the request is approved.
+type PendingError struct {
+	// ID identifies the request in the PKI approval queue, empty for EST.
+	ID         string
+	RetryAfter time.Duration
+}
+
+func (e *PendingError) Error() string {
+	if e.ID == "" {
+		return fmt.Sprintf("Request pending manual approval, retry in %s", e.RetryAfter)
+	}
+	return fmt.Sprintf("Request %s pending manual approval, retry in %s", e.ID, e.RetryAfter)
+}
+
+// errNotV2 is returned when the peer did not answer with the v2 magic.
+var errNotV2 = errors.New("peer does not speak enrollment protocol v2")
+
+// errHelloTimeout is returned by probeConn when the peer did not answer the
+// v2 hello in time.
+var errHelloTimeout = errors.New("peer did not answer the enrollment protocol v2 hello")
+
+// WriteHello writes the v2 magic and version.
+func WriteHello(w io.Writer) error {
+	_, err := w.Write(append(append([]byte{}, protocolMagic...), ProtocolV2))
+	return err
+}
+
+// ReadHello reads the v2 magic and returns the announced version.
+func ReadHello(r io.Reader) (byte, error) {
+	hello := make([]byte, len(protocolMagic)+1)
+	if _, err := io.ReadFull(r, hello); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(hello[:len(protocolMagic)], protocolMagic) {
+		return 0, errNotV2
+	}
+	return hello[len(protocolMagic)], nil
+}
+
+// WriteFrame writes a single v2 frame.
+func WriteFrame(w io.Writer, t FrameType, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("%s frame of %d bytes exceeds the %d bytes limit", t, len(payload), MaxFrameSize)
+	}
+	header := make([]byte, 5)
+	header[0] = byte(t)
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// ReadFrame reads a single v2 frame.
+func ReadFrame(r io.Reader) (FrameType, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxFrameSize {
+		return 0, nil, fmt.Errorf("%s frame of %d bytes exceeds the %d bytes limit", FrameType(header[0]), size, MaxFrameSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return FrameType(header[0]), payload, nil
+}
+
+// WriteErrorFrame writes a FrameError with code and message.
+func WriteErrorFrame(w io.Writer, code uint16, message string) error {
+	payload := make([]byte, 2, 2+len(message))
+	binary.BigEndian.PutUint16(payload, code)
+	return WriteFrame(w, FrameError, append(payload, message...))
+}
+
+// WritePendingFrame writes a FramePending for e.
+func WritePendingFrame(w io.Writer, e *PendingError) error {
+	payload := make([]byte, 4, 4+len(e.ID))
+	binary.BigEndian.PutUint32(payload, uint32(e.RetryAfter/time.Second))
+	return WriteFrame(w, FramePending, append(payload, e.ID...))
+}
+
+func parsePendingFrame(payload []byte) error {
+	if len(payload) < 4 {
+		return &ProtocolError{Code: ErrCodeInternal, Message: "malformed pending frame"}
+	}
+	return &PendingError{
+		ID:         string(payload[4:]),
+		RetryAfter: time.Duration(binary.BigEndian.Uint32(payload)) * time.Second,
+	}
+}
+
+func parseErrorFrame(payload []byte) error {
+	if len(payload) < 2 {
+		return &ProtocolError{Code: ErrCodeInternal, Message: "malformed error frame"}
+	}
+	return &ProtocolError{Code: binary.BigEndian.Uint16(payload), Message: string(payload[2:])}
+}
+
+func encodeChain(certs [][]byte) []byte {
+	var buf bytes.Buffer
+	size := make([]byte, 4)
+	for _, c := range certs {
+		binary.BigEndian.PutUint32(size, uint32(len(c)))
+		buf.Write(size)
+		buf.Write(c)
+	}
+	return buf.Bytes()
+}
+
+func decodeChain(payload []byte) ([][]byte, error) {
+	var certs [][]byte
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return nil, errors.New("truncated chain frame")
+		}
+		size := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		if uint32(len(payload)) < size {
+			return nil, errors.New("truncated chain frame")
+		}
+		certs = append(certs, payload[:size])
+		payload = payload[size:]
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("empty chain frame")
+	}
+	return certs, nil
+}
+
+// expectFrame reads the next frame and turns a FrameError into a
+// *ProtocolError and a FramePending into a *PendingError.
+func expectFrame(r io.Reader, want FrameType) ([]byte, error) {
+	t, payload, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case FrameError:
+		return nil, parseErrorFrame(payload)
+	case FramePending:
+		return nil, parsePendingFrame(payload)
+	}
+	if t != want {
+		return nil, fmt.Errorf("Expected %s frame, received %s", want, t)
+	}
+	return payload, nil
+}
+
+// readFrameV1 reads a v1 uint16 little endian length prefixed message.
+func readFrameV1(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.LittleEndian.Uint16(header))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func writeFrameV1(w io.Writer, b []byte) error {
+	if len(b) > 0xFFFF {
+		return fmt.Errorf("message of %d bytes does not fit a v1 header", len(b))
+	}
+	header := make([]byte, 2)
+	binary.LittleEndian.PutUint16(header, uint16(len(b)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// exchangeV1 sends csr and returns the issued certificate and root over an
+// established v1 connection.
+func exchangeV1(rw io.ReadWriter, csr []byte) ([]byte, [][]byte, error) {
+	if err := writeFrameV1(rw, csr); err != nil {
+		return nil, nil, err
+	}
+	if f, ok := rw.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return nil, nil, err
+		}
+	}
+	cert, err := readFrameV1(rw)
+	if err != nil {
+		return nil, nil, err
+	}
+	root, err := readFrameV1(rw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, [][]byte{root}, nil
+}
+
+// exchangeV2 sends csr and returns the issued certificate and chain over an
+// established v2 connection. errNotV2 is returned if the peer closed the
+// connection, did not answer in time or answered without the v2 magic.
+func exchangeV2(rw io.ReadWriter, csr []byte) ([]byte, [][]byte, error) {
+	if err := WriteHello(rw); err != nil {
+		return nil, nil, err
+	}
+	if err := WriteFrame(rw, FrameCSR, csr); err != nil {
+		return nil, nil, err
+	}
+	if f, ok := rw.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return nil, nil, err
+		}
+	}
+	version, err := ReadHello(rw)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errHelloTimeout || isConnReset(err) {
+			return nil, nil, errNotV2
+		}
+		return nil, nil, err
+	}
+	if version != ProtocolV2 {
+		return nil, nil, fmt.Errorf("Unsupported enrollment protocol version %d", version)
+	}
+	cert, err := expectFrame(rw, FrameCertificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := expectFrame(rw, FrameChain)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain, err := decodeChain(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, chain, nil
+}
@@ -0,0 +1,264 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
+)
+
+// Defaults of the Renewer settings left to zero.
+const (
+	defaultRenewAfter    = 2.0 / 3.0
+	defaultCheckInterval = time.Hour
+	defaultMinRetry      = time.Minute
+	defaultMaxRetry      = time.Hour
+)
+
+// Renewer keeps the certificate written by Generate valid by re-enrolling it
+// with the PKI once a fraction of its lifetime has elapsed.
+type Renewer struct {
+	PKI          string
+	CertFilename string
+	KeyFilename  string
+	CAFilename   string
+	// Fingerprint, when set, enrolls with GenerateTLS pinned to it.
+	Fingerprint string
+	// EST, when set, renews with ReenrollEST instead of the PKI protocol.
+	// Request is not used then since EST requires the identity to stay.
+	EST *ESTClient
+	// ACME, when set, renews with GenerateACME.
+	ACME *ACMEClient
+	// RenewAfter is the fraction of the certificate lifetime after which it
+	// is renewed. Defaults to 2/3, also used when it is not between 0 and 1.
+	RenewAfter float64
+	// CheckInterval bounds how long the certificate file goes unchecked, so
+	// a certificate replaced on disk is picked up. Defaults to one hour.
+	CheckInterval time.Duration
+	// MinRetry and MaxRetry bound the backoff between failed renewals.
+	// They default to one minute and one hour. The zero value of each
+	// setting selects its default, so a Renewer literal is usable.
+	MinRetry time.Duration
+	MaxRetry time.Duration
+	// Request builds the CSR sent for renewal. It defaults to a request
+	// carrying the common name and SANs of the current certificate.
+	Request func(current *x509.Certificate) *x509.CertificateRequest
+	// Options are passed to Generate, for instance to keep the renewed key
+	// encrypted.
+	Options []GenerateOption
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewRenewer returns a Renewer with default settings for the files written
+// by Generate.
+func NewRenewer(ezbpki, certFilename, keyFilename, caFilename string) *Renewer {
+	return &Renewer{
+		PKI:           ezbpki,
+		CertFilename:  certFilename,
+		KeyFilename:   keyFilename,
+		CAFilename:    caFilename,
+		RenewAfter:    defaultRenewAfter,
+		CheckInterval: defaultCheckInterval,
+		MinRetry:      defaultMinRetry,
+		MaxRetry:      defaultMaxRetry,
+	}
+}
+
+// Start runs the renewal loop in the background until Stop is called.
+func (r *Renewer) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.run(r.stop, r.done)
+	logmanager.Info(fmt.Sprintf("Certificate renewer started for %s", r.CertFilename))
+}
+
+// Stop ends the renewal loop and waits for it to exit.
+func (r *Renewer) Stop() {
+	r.mu.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+	logmanager.Info(fmt.Sprintf("Certificate renewer stopped for %s", r.CertFilename))
+}
+
+// NextRenewal returns when the certificate on disk is due for renewal.
+func (r *Renewer) NextRenewal() (time.Time, error) {
+	cert, err := loadCertificate(r.CertFilename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return r.renewalTime(cert), nil
+}
+
+func (r *Renewer) renewalTime(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(time.Duration(float64(lifetime) * r.renewAfter()))
+}
+
+func (r *Renewer) renewAfter() float64 {
+	if r.RenewAfter <= 0 || r.RenewAfter > 1 {
+		return defaultRenewAfter
+	}
+	return r.RenewAfter
+}
+
+func (r *Renewer) checkInterval() time.Duration {
+	if r.CheckInterval <= 0 {
+		return defaultCheckInterval
+	}
+	return r.CheckInterval
+}
+
+func (r *Renewer) minRetry() time.Duration {
+	if r.MinRetry <= 0 {
+		return defaultMinRetry
+	}
+	return r.MinRetry
+}
+
+// maxRetry is never below minRetry.
+func (r *Renewer) maxRetry() time.Duration {
+	max := r.MaxRetry
+	if max <= 0 {
+		max = defaultMaxRetry
+	}
+	if min := r.minRetry(); max < min {
+		return min
+	}
+	return max
+}
+
+// RenewNow re-enrolls immediately and swaps the new files in place of the
+// current ones.
+func (r *Renewer) RenewNow() error {
+	if r.EST != nil {
+		passphrase, err := newGenerateConfig(r.Options).keyPassphrase()
+		if err != nil {
+			return err
+		}
+		return ReenrollEST(r.EST, r.CertFilename, r.KeyFilename, r.CAFilename, passphrase, r.Options...)
+	}
+	current, err := loadCertificate(r.CertFilename)
+	if err != nil {
+		return err
+	}
+	request := r.Request
+	if request == nil {
+		request = requestFromCertificate
+	}
+
+	// Generate replaces the files as a unit and keeps the previous set as
+	// a backup, see Rollback.
+	if r.ACME != nil {
+		return GenerateACME(request(current), r.ACME, r.CertFilename, r.KeyFilename, r.CAFilename, r.Options...)
+	}
+	if r.Fingerprint != "" {
+		return GenerateTLS(request(current), r.PKI, r.Fingerprint, r.CertFilename, r.KeyFilename, r.CAFilename, r.Options...)
+	}
+	return Generate(request(current), r.PKI, r.CertFilename, r.KeyFilename, r.CAFilename, r.Options...)
+}
+
+func requestFromCertificate(cert *x509.Certificate) *x509.CertificateRequest {
+	var addresses []string
+	for _, ip := range cert.IPAddresses {
+		addresses = append(addresses, ip.String())
+	}
+	addresses = append(addresses, cert.DNSNames...)
+	options := []RequestOption{
+		WithSubject(cert.Subject),
+		WithURIs(cert.URIs...),
+		WithEmailAddresses(cert.EmailAddresses...),
+	}
+	if keyType, err := KeyTypeOf(cert.PublicKey); err == nil {
+		options = append(options, WithKeyType(keyType))
+	}
+	return NewCertificateRequest(cert.Subject.CommonName, 0, addresses, options...)
+}
+
+func (r *Renewer) run(stop, done chan struct{}) {
+	defer close(done)
+	failures := 0
+	for {
+		wait := r.checkInterval()
+		cert, err := loadCertificate(r.CertFilename)
+		if err != nil {
+			logmanager.Error(fmt.Sprintf("Certificate renewer cannot read %s: %v", r.CertFilename, err))
+		} else if due := r.renewalTime(cert); !time.Now().Before(due) {
+			logmanager.Info(fmt.Sprintf("Renewing certificate %s expiring %s", r.CertFilename, cert.NotAfter.Format(time.RFC3339)))
+			if err = r.RenewNow(); err != nil {
+				failures++
+				wait = r.backoff(failures)
+				level := logmanager.Warning
+				if time.Until(cert.NotAfter) < wait {
+					level = logmanager.Error
+				}
+				level(fmt.Sprintf("Certificate renewal of %s failed (attempt %d), retrying in %s: %v", r.CertFilename, failures, wait.Round(time.Second), err))
+			} else {
+				failures = 0
+				// Look again soon rather than immediately, so a PKI issuing
+				// certificates shorter than the renewal window is not
+				// hammered in a loop.
+				wait = r.minRetry()
+				logmanager.Info(fmt.Sprintf("Certificate %s renewed", r.CertFilename))
+			}
+		} else if until := time.Until(due); until < wait {
+			wait = until
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns a jittered exponential delay for the given number of
+// consecutive failures, so a fleet does not hammer a recovering PKI in step.
+func (r *Renewer) backoff(failures int) time.Duration {
+	d, max := r.minRetry(), r.maxRetry()
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
@@ -0,0 +1,48 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+// TestRenewerLiteralDefaults checks a Renewer built without NewRenewer waits
+// as long as one built with it, instead of spinning.
+func TestRenewerLiteralDefaults(t *testing.T) {
+	r := &Renewer{}
+	if d := r.checkInterval(); d != time.Hour {
+		t.Errorf("check interval %s", d)
+	}
+	for failures := 1; failures < 20; failures++ {
+		d := r.backoff(failures)
+		if d < 30*time.Second || d > time.Hour {
+			t.Errorf("backoff after %d failures: %s", failures, d)
+		}
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: start, NotAfter: start.Add(90 * time.Hour)}
+	if due := r.renewalTime(cert); !due.Equal(start.Add(60 * time.Hour)) {
+		t.Errorf("renewal due at %s", due)
+	}
+
+	// MaxRetry below MinRetry does not shorten the backoff.
+	r = &Renewer{MinRetry: time.Minute, MaxRetry: time.Second}
+	if d := r.backoff(5); d < 30*time.Second {
+		t.Errorf("backoff %s below MinRetry/2", d)
+	}
+}
@@ -0,0 +1,227 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	oidExtensionKeyUsage    = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+	// OIDRequestedValidity identifies the CSR extension carrying the
+	// certificate lifetime asked for, as an INTEGER number of seconds. No
+	// standard extension exists for this, so it lives in the IANA
+	// experimental arc; change it if your PKI expects another OID.
+	OIDRequestedValidity = asn1.ObjectIdentifier{1, 3, 6, 1, 3, 4242, 1}
+)
+
+var extKeyUsageOIDs = []struct {
+	usage x509.ExtKeyUsage
+	oid   asn1.ObjectIdentifier
+}{
+	{x509.ExtKeyUsageAny, asn1.ObjectIdentifier{2, 5, 29, 37, 0}},
+	{x509.ExtKeyUsageServerAuth, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}},
+	{x509.ExtKeyUsageClientAuth, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}},
+	{x509.ExtKeyUsageCodeSigning, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 3}},
+	{x509.ExtKeyUsageEmailProtection, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 4}},
+	{x509.ExtKeyUsageIPSECEndSystem, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 5}},
+	{x509.ExtKeyUsageIPSECTunnel, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 6}},
+	{x509.ExtKeyUsageIPSECUser, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 7}},
+	{x509.ExtKeyUsageTimeStamping, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 8}},
+	{x509.ExtKeyUsageOCSPSigning, asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 9}},
+}
+
+// WithSubject replaces the whole subject, including the Organization and
+// CommonName set by NewCertificateRequest.
+func WithSubject(subject pkix.Name) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		r.Subject = subject
+	}
+}
+
+// WithOrganization replaces the default "ezBastion" organization.
+func WithOrganization(o ...string) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		r.Subject.Organization = o
+	}
+}
+
+// WithOrganizationalUnit sets the subject OU.
+func WithOrganizationalUnit(ou ...string) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		r.Subject.OrganizationalUnit = ou
+	}
+}
+
+// WithCountry sets the subject C.
+func WithCountry(c ...string) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		r.Subject.Country = c
+	}
+}
+
+// WithLocality sets the subject L.
+func WithLocality(l ...string) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		r.Subject.Locality = l
+	}
+}
+
+// WithProvince sets the subject ST.
+func WithProvince(st ...string) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		r.Subject.Province = st
+	}
+}
+
+// WithURIs adds URI SANs.
+func WithURIs(uris ...*url.URL) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		r.URIs = append(r.URIs, uris...)
+	}
+}
+
+// WithSPIFFEID adds the URI SAN spiffe://trustDomain/path identifying a
+// workload.
+func WithSPIFFEID(trustDomain, path string) RequestOption {
+	return WithURIs(&url.URL{Scheme: "spiffe", Host: trustDomain, Path: "/" + strings.TrimPrefix(path, "/")})
+}
+
+// WithEmailAddresses adds email SANs.
+func WithEmailAddresses(emails ...string) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		r.EmailAddresses = append(r.EmailAddresses, emails...)
+	}
+}
+
+// WithKeyUsage asks for the given key usages.
+func WithKeyUsage(usage x509.KeyUsage) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		var bits asn1.BitString
+		for i := 0; i < 9; i++ {
+			if usage&(1<<uint(i)) != 0 {
+				bits.BitLength = i + 1
+			}
+		}
+		bits.Bytes = make([]byte, (bits.BitLength+7)/8)
+		for i := 0; i < bits.BitLength; i++ {
+			if usage&(1<<uint(i)) != 0 {
+				bits.Bytes[i/8] |= 0x80 >> uint(i%8)
+			}
+		}
+		b, _ := asn1.Marshal(bits)
+		setExtension(r, pkix.Extension{Id: oidExtensionKeyUsage, Critical: true, Value: b})
+	}
+}
+
+// WithExtKeyUsage asks for the given extended key usages. Usages without a
+// known OID are dropped.
+func WithExtKeyUsage(usages ...x509.ExtKeyUsage) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		var oids []asn1.ObjectIdentifier
+		for _, u := range usages {
+			for _, e := range extKeyUsageOIDs {
+				if e.usage == u {
+					oids = append(oids, e.oid)
+				}
+			}
+		}
+		b, _ := asn1.Marshal(oids)
+		setExtension(r, pkix.Extension{Id: oidExtensionExtKeyUsage, Value: b})
+	}
+}
+
+// WithValidity asks for a certificate valid for d. The PKI may issue a
+// shorter one.
+func WithValidity(d time.Duration) RequestOption {
+	return func(r *x509.CertificateRequest) {
+		b, _ := asn1.Marshal(int64(d / time.Second))
+		setExtension(r, pkix.Extension{Id: OIDRequestedValidity, Value: b})
+	}
+}
+
+func setExtension(r *x509.CertificateRequest, ext pkix.Extension) {
+	for i, e := range r.ExtraExtensions {
+		if e.Id.Equal(ext.Id) {
+			r.ExtraExtensions[i] = ext
+			return
+		}
+	}
+	r.ExtraExtensions = append(r.ExtraExtensions, ext)
+}
+
+// RequestedExtensions holds what a CSR asks for beyond its subject and SANs.
+// Zero values mean nothing was asked.
+type RequestedExtensions struct {
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+	Validity    time.Duration
+}
+
+// ParseRequestedExtensions reads the key usage, extended key usage and
+// requested validity extensions of a parsed CSR.
+func ParseRequestedExtensions(csr *x509.CertificateRequest) (RequestedExtensions, error) {
+	var req RequestedExtensions
+	for _, ext := range csr.Extensions {
+		switch {
+		case ext.Id.Equal(oidExtensionKeyUsage):
+			var bits asn1.BitString
+			if err := unmarshalStrict(ext.Value, &bits); err != nil {
+				return req, fmt.Errorf("Invalid key usage extension: %v", err)
+			}
+			for i := 0; i < 9; i++ {
+				if bits.At(i) != 0 {
+					req.KeyUsage |= 1 << uint(i)
+				}
+			}
+		case ext.Id.Equal(oidExtensionExtKeyUsage):
+			var oids []asn1.ObjectIdentifier
+			if err := unmarshalStrict(ext.Value, &oids); err != nil {
+				return req, fmt.Errorf("Invalid extended key usage extension: %v", err)
+			}
+			for _, oid := range oids {
+				known := false
+				for _, e := range extKeyUsageOIDs {
+					if e.oid.Equal(oid) {
+						req.ExtKeyUsage = append(req.ExtKeyUsage, e.usage)
+						known = true
+					}
+				}
+				if !known {
+					return req, fmt.Errorf("Unsupported extended key usage %v", oid)
+				}
+			}
+		case ext.Id.Equal(OIDRequestedValidity):
+			var seconds int64
+			if err := unmarshalStrict(ext.Value, &seconds); err != nil {
+				return req, fmt.Errorf("Invalid requested validity extension: %v", err)
+			}
+			if seconds <= 0 || seconds > int64(math.MaxInt64/time.Second) {
+				return req, fmt.Errorf("Invalid requested validity of %d seconds", seconds)
+			}
+			req.Validity = time.Duration(seconds) * time.Second
+		}
+	}
+	return req, nil
+}
@@ -0,0 +1,380 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
+	"golang.org/x/crypto/ocsp"
+)
+
+// RevocationMode tells what happens when the revocation status of a
+// certificate cannot be established.
+type RevocationMode int
+
+const (
+	// RevocationSoftFail accepts the certificate and logs a warning.
+	RevocationSoftFail RevocationMode = iota
+	// RevocationHardFail rejects the certificate.
+	RevocationHardFail
+)
+
+// maxRevocationResponse bounds the size of a downloaded CRL or OCSP response.
+const maxRevocationResponse = 32 << 20
+
+// defaultRevocationClient is used when RevocationChecker.HTTPClient is nil.
+// Checks run inside TLS handshakes, so a source that never answers must not
+// hold them forever.
+var defaultRevocationClient = &http.Client{Timeout: 10 * time.Second}
+
+var oidCRLReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// errCRLOtherIssuer is returned for a CRL of another CA than the issuer
+// checked, which is not a failure: CRLSources may list the CRLs of every
+// CA of the chain.
+var errCRLOtherIssuer = errors.New("CRL of another issuer")
+
+// RevokedError is returned for a revoked certificate.
+type RevokedError struct {
+	Serial    string
+	RevokedAt time.Time
+	// Reason is the RFC 5280 CRLReason code.
+	Reason int
+}
+
+func (e *RevokedError) Error() string {
+	return fmt.Sprintf("Certificate %s revoked on %s (reason %d)", e.Serial, e.RevokedAt.Format(time.RFC3339), e.Reason)
+}
+
+// RevocationChecker checks certificates against CRLs and OCSP responders,
+// caching answers until they expire.
+type RevocationChecker struct {
+	// CRLSources are CRL file paths or http(s) URLs. When empty, the CRL
+	// distribution points of the checked certificate are used.
+	CRLSources []string
+	// OCSPServer overrides the OCSP responder named in the certificate.
+	OCSPServer string
+	// DisableOCSP skips OCSP, for instance on isolated networks.
+	DisableOCSP bool
+	Mode        RevocationMode
+	// CacheTTL caps how long a CRL or OCSP answer is reused, even if it
+	// claims a later next update. Defaults to one hour.
+	CacheTTL time.Duration
+	// FailureTTL is how long a CRL or OCSP answer that could not be
+	// obtained is not asked again, so an unreachable source does not
+	// delay every handshake. Defaults to one minute.
+	FailureTTL time.Duration
+	// HTTPClient downloads CRLs and queries OCSP responders. It should
+	// have a timeout; nil uses a client timing out after 10 seconds.
+	HTTPClient *http.Client
+
+	mu   sync.Mutex
+	crls map[string]*cachedCRL
+	ocsp map[string]*cachedOCSP
+}
+
+// cachedCRL and cachedOCSP hold an answer or the error met getting it.
+type cachedCRL struct {
+	crl     *pkix.CertificateList
+	err     error
+	expires time.Time
+}
+
+type cachedOCSP struct {
+	resp    *ocsp.Response
+	err     error
+	expires time.Time
+}
+
+// NewRevocationChecker returns a soft-fail checker using the CRL sources
+// given, or the certificates' own distribution points and OCSP responders
+// when none are.
+func NewRevocationChecker(crlSources ...string) *RevocationChecker {
+	return &RevocationChecker{
+		CRLSources: crlSources,
+		CacheTTL:   time.Hour,
+		FailureTTL: time.Minute,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Check returns a *RevokedError if cert, issued by issuer, is revoked. When
+// no source can vouch for it the result depends on Mode.
+func (c *RevocationChecker) Check(cert, issuer *x509.Certificate) error {
+	var failures []string
+	checked := false
+
+	sources := c.CRLSources
+	if len(sources) == 0 {
+		sources = cert.CRLDistributionPoints
+	}
+	for _, source := range sources {
+		crl, err := c.crl(source, issuer)
+		if err == errCRLOtherIssuer {
+			continue
+		}
+		if err != nil {
+			failures = append(failures, err.Error())
+			continue
+		}
+		checked = true
+		for _, revoked := range crl.TBSCertList.RevokedCertificates {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return &RevokedError{
+					Serial:    formatSerial(cert.SerialNumber),
+					RevokedAt: revoked.RevocationTime,
+					Reason:    crlReason(revoked.Extensions),
+				}
+			}
+		}
+	}
+
+	if !c.DisableOCSP {
+		servers := cert.OCSPServer
+		if c.OCSPServer != "" {
+			servers = []string{c.OCSPServer}
+		}
+		for _, server := range servers {
+			resp, err := c.ocspStatus(server, cert, issuer)
+			if err != nil {
+				failures = append(failures, err.Error())
+				continue
+			}
+			switch resp.Status {
+			case ocsp.Good:
+				checked = true
+			case ocsp.Revoked:
+				return &RevokedError{
+					Serial:    formatSerial(cert.SerialNumber),
+					RevokedAt: resp.RevokedAt,
+					Reason:    resp.RevocationReason,
+				}
+			default:
+				failures = append(failures, fmt.Sprintf("OCSP responder %s does not know the certificate", server))
+			}
+			if checked {
+				break
+			}
+		}
+	}
+
+	if checked {
+		return nil
+	}
+	msg := "no CRL or OCSP responder available"
+	if len(failures) > 0 {
+		msg = strings.Join(failures, "; ")
+	}
+	if c.Mode == RevocationHardFail {
+		return fmt.Errorf("Revocation status of %s unknown: %s", cert.Subject.CommonName, msg)
+	}
+	logmanager.Warning(fmt.Sprintf("Revocation status of %s unknown, accepting it: %s", cert.Subject.CommonName, msg))
+	return nil
+}
+
+// VerifyPeerCertificate returns a tls.Config.VerifyPeerCertificate hook
+// running Check on every certificate but the root of each verified chain,
+// so a revoked intermediate CA is refused too. The connection is accepted
+// when one chain passes. It must be used with normal chain verification
+// enabled.
+func (c *RevocationChecker) VerifyPeerCertificate() func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 {
+			return errors.New("No verified certificate chain to check for revocation")
+		}
+		var err error
+		for _, chain := range verifiedChains {
+			if err = c.checkChain(chain); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+}
+
+// checkChain runs Check on each certificate of chain with its issuer. A
+// trusted self-signed certificate alone has nothing to check.
+func (c *RevocationChecker) checkChain(chain []*x509.Certificate) error {
+	for i := 0; i < len(chain)-1; i++ {
+		if err := c.Check(chain[i], chain[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RevocationChecker) ttl() time.Duration {
+	if c.CacheTTL > 0 {
+		return c.CacheTTL
+	}
+	return time.Hour
+}
+
+func (c *RevocationChecker) failureTTL() time.Duration {
+	if c.FailureTTL > 0 {
+		return c.FailureTTL
+	}
+	return time.Minute
+}
+
+func (c *RevocationChecker) expiry(nextUpdate time.Time) time.Time {
+	expires := time.Now().Add(c.ttl())
+	if !nextUpdate.IsZero() && nextUpdate.Before(expires) {
+		expires = nextUpdate
+	}
+	return expires
+}
+
+func (c *RevocationChecker) crl(source string, issuer *x509.Certificate) (*pkix.CertificateList, error) {
+	key := source + "|" + string(issuer.Raw)
+	c.mu.Lock()
+	cached := c.crls[key]
+	c.mu.Unlock()
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached.crl, cached.err
+	}
+
+	crl, err := c.loadCRL(source, issuer)
+	entry := &cachedCRL{crl: crl, err: err, expires: time.Now().Add(c.failureTTL())}
+	if err == nil {
+		entry.expires = c.expiry(crl.TBSCertList.NextUpdate)
+	}
+	c.mu.Lock()
+	if c.crls == nil {
+		c.crls = make(map[string]*cachedCRL)
+	}
+	c.crls[key] = entry
+	c.mu.Unlock()
+	return crl, err
+}
+
+func (c *RevocationChecker) loadCRL(source string, issuer *x509.Certificate) (*pkix.CertificateList, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		data, err = c.fetch(http.MethodGet, source, "", nil)
+	} else {
+		data, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load CRL %s: %v", source, err)
+	}
+	if block, _ := pem.Decode(data); block != nil && block.Type == "X509 CRL" {
+		data = block.Bytes
+	}
+	crl, err := x509.ParseDERCRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse CRL %s: %v", source, err)
+	}
+	var issuerName pkix.RDNSequence
+	if _, err = asn1.Unmarshal(issuer.RawSubject, &issuerName); err == nil && crl.TBSCertList.Issuer.String() != issuerName.String() {
+		return nil, errCRLOtherIssuer
+	}
+	if err = issuer.CheckCRLSignature(crl); err != nil {
+		return nil, fmt.Errorf("CRL %s not signed by %s: %v", source, issuer.Subject.CommonName, err)
+	}
+	if crl.HasExpired(time.Now()) {
+		return nil, fmt.Errorf("CRL %s expired on %s", source, crl.TBSCertList.NextUpdate.Format(time.RFC3339))
+	}
+	return crl, nil
+}
+
+func (c *RevocationChecker) ocspStatus(server string, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	key := server + "|" + string(issuer.Raw) + "|" + cert.SerialNumber.String()
+	c.mu.Lock()
+	cached := c.ocsp[key]
+	c.mu.Unlock()
+	if cached != nil && time.Now().Before(cached.expires) {
+		return cached.resp, cached.err
+	}
+
+	resp, err := c.queryOCSP(server, cert, issuer)
+	entry := &cachedOCSP{resp: resp, err: err, expires: time.Now().Add(c.failureTTL())}
+	if err == nil {
+		entry.expires = c.expiry(resp.NextUpdate)
+	}
+	c.mu.Lock()
+	if c.ocsp == nil {
+		c.ocsp = make(map[string]*cachedOCSP)
+	}
+	c.ocsp[key] = entry
+	c.mu.Unlock()
+	return resp, err
+}
+
+func (c *RevocationChecker) queryOCSP(server string, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.fetch(http.MethodPost, server, "application/ocsp-request", req)
+	if err != nil {
+		return nil, fmt.Errorf("OCSP responder %s: %v", server, err)
+	}
+	resp, err := ocsp.ParseResponseForCert(data, cert, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("OCSP responder %s: %v", server, err)
+	}
+	return resp, nil
+}
+
+func (c *RevocationChecker) fetch(method, url, contentType string, body []byte) ([]byte, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = defaultRevocationClient
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxRevocationResponse))
+}
+
+func crlReason(extensions []pkix.Extension) int {
+	for _, ext := range extensions {
+		if ext.Id.Equal(oidCRLReasonCode) {
+			var reason asn1.Enumerated
+			if _, err := asn1.Unmarshal(ext.Value, &reason); err == nil {
+				return int(reason)
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,177 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// issueTestCertificate signs a certificate named cn with issuer, or a
+// self-signed one when issuer is nil.
+func issueTestCertificate(t *testing.T, cn string, serial int64, isCA bool, issuer *testCA) *testCA {
+	t.Helper()
+	key, err := KeyECDSAP256.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// writeTestCRL writes the CRL of ca revoking serials to a file.
+func writeTestCRL(t *testing.T, ca *testCA, serials ...int64) string {
+	t.Helper()
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	der, err := ca.cert.CreateCRL(rand.Reader, ca.key, revoked, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(tempDir(t), "ca.crl")
+	if err = ioutil.WriteFile(filename, der, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestVerifyPeerCertificateChain(t *testing.T) {
+	root := issueTestCertificate(t, "root", 1, true, nil)
+	inter := issueTestCertificate(t, "intermediate", 2, true, root)
+	leaf := issueTestCertificate(t, "leaf", 3, false, inter)
+	chains := [][]*x509.Certificate{{leaf.cert, inter.cert, root.cert}}
+	interCRL := writeTestCRL(t, inter)
+
+	c := NewRevocationChecker(writeTestCRL(t, root), interCRL)
+	c.DisableOCSP = true
+	c.Mode = RevocationHardFail
+	if err := c.VerifyPeerCertificate()(nil, chains); err != nil {
+		t.Fatalf("valid chain: %v", err)
+	}
+
+	c = NewRevocationChecker(writeTestCRL(t, root, 2), interCRL)
+	c.DisableOCSP = true
+	c.Mode = RevocationHardFail
+	err := c.VerifyPeerCertificate()(nil, chains)
+	if revoked, ok := err.(*RevokedError); !ok || revoked.Serial != formatSerial(big.NewInt(2)) {
+		t.Fatalf("expected the intermediate revoked, got %v", err)
+	}
+
+	// The CRL of the intermediate alone cannot vouch for it.
+	c = NewRevocationChecker(interCRL)
+	c.DisableOCSP = true
+	c.Mode = RevocationHardFail
+	if err = c.VerifyPeerCertificate()(nil, chains); err == nil {
+		t.Errorf("intermediate accepted without revocation status")
+	}
+}
+
+func TestRevocationFailureCache(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	root := issueTestCertificate(t, "root", 1, true, nil)
+	leaf := issueTestCertificate(t, "leaf", 3, false, root)
+	c := NewRevocationChecker(srv.URL + "/ca.crl")
+	c.OCSPServer = srv.URL + "/ocsp"
+	c.Mode = RevocationHardFail
+	for i := 0; i < 3; i++ {
+		if err := c.Check(leaf.cert, root.cert); err == nil {
+			t.Fatal("accepted with the CRL and OCSP responder down")
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("%d requests for 3 checks, expected one CRL and one OCSP request", n)
+	}
+
+	c.FailureTTL = time.Nanosecond
+	c.crls, c.ocsp = nil, nil
+	c.Check(leaf.cert, root.cert)
+	time.Sleep(time.Millisecond)
+	c.Check(leaf.cert, root.cert)
+	if n := atomic.LoadInt32(&hits); n != 6 {
+		t.Errorf("%d requests after the failures expired, expected 6", n)
+	}
+}
+
+func TestRevocationDefaultClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	saved := defaultRevocationClient
+	defaultRevocationClient = &http.Client{Timeout: 100 * time.Millisecond}
+	defer func() { defaultRevocationClient = saved }()
+
+	root := issueTestCertificate(t, "root", 1, true, nil)
+	leaf := issueTestCertificate(t, "leaf", 3, false, root)
+	c := &RevocationChecker{CRLSources: []string{srv.URL + "/ca.crl"}, DisableOCSP: true}
+	done := make(chan error, 1)
+	go func() { done <- c.Check(leaf.cert, root.cert) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("soft fail returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("check still waiting for a CRL source that never answers")
+	}
+}
@@ -0,0 +1,810 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
+)
+
+// SignPolicy describes what the local PKI signer accepts and what it puts in
+// the certificates it issues.
+type SignPolicy struct {
+	// Validity is the lifetime of issued certificates. A CSR asking for a
+	// shorter one with WithValidity gets it.
+	Validity time.Duration
+	// AllowedDNSNames restricts the DNS SANs a CSR may carry. A leading "*."
+	// matches exactly one label. An empty list allows any name.
+	AllowedDNSNames []string
+	// AllowedIPNets restricts the IP SANs a CSR may carry. An empty list
+	// allows any address.
+	AllowedIPNets []*net.IPNet
+	// KeyUsage and ExtKeyUsage are set on every issued certificate. A CSR
+	// asking for usages narrows them; asking for more is rejected.
+	KeyUsage    x509.KeyUsage
+	ExtKeyUsage []x509.ExtKeyUsage
+	// CRLDistributionPoints are the URLs of the CRL, see
+	// Server.ListenAndServeCRL, put in every issued certificate.
+	CRLDistributionPoints []string
+	// AllowedOrganizations restricts the subject O a CSR may carry. An
+	// empty list allows any organization.
+	AllowedOrganizations []string
+	// AllowedComponents restricts the component a CSR may claim, in its
+	// subject OU and in its SPIFFE IDs, see Identity. An empty list allows
+	// any component: the identities the certificates carry are then
+	// self-asserted by the requesters, and only Server.Approval stops a
+	// node from claiming to be ezb_admin.
+	AllowedComponents []string
+	// AllowedCommonNames restricts the subject CN a CSR may carry, in the
+	// syntax of path.Match. An empty list allows any name.
+	AllowedCommonNames []string
+	// AllowedURIs restricts the URI SANs a CSR may carry, in the syntax of
+	// path.Match, e.g. "spiffe://ezb.local/ezb_wks/*". An empty list allows
+	// any URI.
+	AllowedURIs []string
+}
+
+// DefaultSignPolicy returns a one year, any SAN policy issuing certificates
+// usable for both ends of an ezBastion mTLS link.
+func DefaultSignPolicy() SignPolicy {
+	return SignPolicy{
+		Validity:    365 * 24 * time.Hour,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+}
+
+// Check returns an error if csr asks for a SAN or a usage the policy does not
+// allow.
+func (p SignPolicy) Check(csr *x509.CertificateRequest) error {
+	req, err := ParseRequestedExtensions(csr)
+	if err != nil {
+		return err
+	}
+	if extra := req.KeyUsage &^ p.KeyUsage; extra != 0 {
+		return fmt.Errorf("Key usage %#x not allowed by policy", int(extra))
+	}
+	for _, u := range req.ExtKeyUsage {
+		allowed := false
+		for _, a := range p.ExtKeyUsage {
+			if a == u || a == x509.ExtKeyUsageAny {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("Extended key usage %d not allowed by policy", u)
+		}
+	}
+	if len(p.AllowedDNSNames) > 0 {
+		for _, name := range csr.DNSNames {
+			if !matchDNSName(p.AllowedDNSNames, name) {
+				return fmt.Errorf("DNS name %s not allowed by policy", name)
+			}
+		}
+	}
+	if len(p.AllowedIPNets) > 0 {
+		for _, ip := range csr.IPAddresses {
+			allowed := false
+			for _, n := range p.AllowedIPNets {
+				if n.Contains(ip) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return fmt.Errorf("IP address %s not allowed by policy", ip)
+			}
+		}
+	}
+	return p.checkIdentity(csr)
+}
+
+// checkIdentity applies the subject and URI rules, which decide the
+// Identity the issued certificate will carry.
+func (p SignPolicy) checkIdentity(csr *x509.CertificateRequest) error {
+	subject := csr.Subject
+	if len(p.AllowedOrganizations) > 0 {
+		for _, o := range subject.Organization {
+			if !containsString(p.AllowedOrganizations, o) {
+				return fmt.Errorf("Organization %s not allowed by policy", o)
+			}
+		}
+	}
+	if len(p.AllowedCommonNames) > 0 && !matchAny(p.AllowedCommonNames, subject.CommonName) {
+		return fmt.Errorf("Common name %s not allowed by policy", subject.CommonName)
+	}
+	if len(p.AllowedComponents) > 0 {
+		for _, ou := range subject.OrganizationalUnit {
+			if !containsString(p.AllowedComponents, ou) {
+				return fmt.Errorf("Component %s not allowed by policy", ou)
+			}
+		}
+	}
+	for _, uri := range csr.URIs {
+		if len(p.AllowedURIs) > 0 && !matchAny(p.AllowedURIs, uri.String()) {
+			return fmt.Errorf("URI %s not allowed by policy", uri)
+		}
+		if uri.Scheme != "spiffe" || len(p.AllowedComponents) == 0 {
+			continue
+		}
+		component := strings.SplitN(strings.TrimPrefix(uri.Path, "/"), "/", 2)[0]
+		if !containsString(p.AllowedComponents, component) {
+			return fmt.Errorf("Component %s of %s not allowed by policy", component, uri)
+		}
+	}
+	return nil
+}
+
+func matchDNSName(patterns []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == name {
+			return true
+		}
+		if strings.HasPrefix(p, "*.") {
+			i := strings.Index(name, ".")
+			if i > 0 && name[i:] == p[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DefaultConnTimeout bounds each connection handled by Server.
+const DefaultConnTimeout = 30 * time.Second
+
+// Server is a minimal PKI signer speaking the enrollment protocol used by
+// Generate. It is meant for offline development setups and integration
+// tests, not as a replacement for ezb_pki.
+type Server struct {
+	Policy SignPolicy
+	// Audit, when set, records every issued certificate. A certificate
+	// that cannot be recorded is not handed out.
+	Audit *AuditLog
+	// Approval, when set, holds every request for manual approval.
+	Approval *ApprovalQueue
+	// Revocations, when set, records every issued certificate so it can
+	// be revoked and listed in the CRL.
+	Revocations *RevocationDB
+	// CRLValidity is the time between the issue of a CRL and its next
+	// update. Defaults to DefaultCRLValidity.
+	CRLValidity time.Duration
+	// ConnTimeout bounds each enrollment connection, from accept to the
+	// last byte written. Defaults to DefaultConnTimeout.
+	ConnTimeout time.Duration
+
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+	// chain holds caCert followed by its issuers, the root last.
+	chain [][]byte
+
+	mu          sync.Mutex
+	listener    net.Listener
+	estListener net.Listener
+	crlListener net.Listener
+	closed      bool
+	quit        chan struct{}
+	wg          sync.WaitGroup
+
+	crlMu       sync.Mutex
+	crl         []byte
+	crlRefresh  time.Time
+	crlStamp    fileStamp
+	crlFilename string
+}
+
+// NewServer loads the signing CA from caCertFilename and caKeyFilename,
+// creating a new self-signed root with commonName when neither file exists.
+// The signing CA may be an intermediate, in which case caCertFilename lists
+// it first followed by its issuers up to the root, as written by
+// CreateIntermediateCA.
+func NewServer(caCertFilename, caKeyFilename, commonName string, policy SignPolicy) (*Server, error) {
+	_, errCert := os.Stat(caCertFilename)
+	_, errKey := os.Stat(caKeyFilename)
+	if os.IsNotExist(errCert) && os.IsNotExist(errKey) {
+		if err := createRootCA(caCertFilename, caKeyFilename, commonName); err != nil {
+			return nil, err
+		}
+		logmanager.Info(fmt.Sprintf("Created root CA %s", caCertFilename))
+	}
+	certs, err := loadCertificates(caCertFilename)
+	if err != nil {
+		return nil, err
+	}
+	caKey, err := LoadPrivateKey(caKeyFilename, nil)
+	if err != nil {
+		return nil, err
+	}
+	caCert := certs[0]
+	if !caCert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", caCertFilename)
+	}
+	if err = checkKeyMatch(caCert, caKey); err != nil {
+		return nil, err
+	}
+	chain, err := verifyCAChain(certs)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CA chain in %s: %v", caCertFilename, err)
+	}
+	return &Server{Policy: policy, CRLValidity: DefaultCRLValidity, ConnTimeout: DefaultConnTimeout, caCert: caCert, caKey: caKey, chain: chain, quit: make(chan struct{})}, nil
+}
+
+// CACertificate returns the CA certificate the server signs with. It is the
+// root unless the server issues from an intermediate.
+func (s *Server) CACertificate() *x509.Certificate {
+	return s.caCert
+}
+
+// RootCertificate returns the root of the server's CA chain.
+func (s *Server) RootCertificate() *x509.Certificate {
+	root, _ := x509.ParseCertificate(s.chain[len(s.chain)-1])
+	return root
+}
+
+// ListenAndServe listens on the TCP address addr and serves enrollment
+// requests until Close is called.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// ListenAndServeTLS is ListenAndServe over TLS. The server authenticates with
+// a certificate issued on the fly by its root CA, which clients pin by
+// fingerprint (see GenerateTLS).
+func (s *Server) ListenAndServeTLS(addr string) error {
+	config, err := s.tlsConfig(addr)
+	if err != nil {
+		return err
+	}
+	l, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// tlsConfig issues a server certificate valid for the host of addr, or for
+// the local host names when addr has none.
+func (s *Server) tlsConfig(addr string) (*tls.Config, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate private key: %v", err)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"ezBastion"},
+			CommonName:   s.caCert.Subject.CommonName + " enrollment",
+		},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if template.NotAfter.After(s.caCert.NotAfter) {
+		template.NotAfter = s.caCert.NotAfter
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		template.IPAddresses = []net.IP{ip}
+	} else if host != "" && ip == nil {
+		template.DNSNames = []string{host}
+	} else {
+		template.DNSNames = []string{"localhost"}
+		if hostname, err := os.Hostname(); err == nil {
+			template.DNSNames = append(template.DNSNames, hostname)
+		}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, s.caCert, &priv.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: append([][]byte{derBytes}, s.chain...),
+			PrivateKey:  priv,
+		}},
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// Serve accepts enrollment connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return errors.New("server closed")
+	}
+	s.listener = l
+	s.mu.Unlock()
+	logmanager.Info(fmt.Sprintf("PKI signer listening on %s", l.Addr()))
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// Addr returns the listening address, or nil before Serve is called.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops the listeners and waits for in-flight requests to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		close(s.quit)
+	}
+	s.closed = true
+	l := s.listener
+	estListener := s.estListener
+	crlListener := s.crlListener
+	s.mu.Unlock()
+	var err error
+	if l != nil {
+		err = l.Close()
+	}
+	if estListener != nil {
+		estListener.Close()
+	}
+	if crlListener != nil {
+		crlListener.Close()
+	}
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	timeout := s.ConnTimeout
+	if timeout <= 0 {
+		timeout = DefaultConnTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	remote := conn.RemoteAddr().String()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	var err error
+	if magic, _ := reader.Peek(len(protocolMagic)); bytes.Equal(magic, protocolMagic) {
+		err = s.handleV2(reader, writer, remote)
+	} else {
+		err = s.handleV1(reader, writer, remote)
+	}
+	// Flush even on failure so a v2 client receives the error frame.
+	if ferr := writer.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		logmanager.Error(fmt.Sprintf("PKI signer: request from %s failed: %v", remote, err))
+	}
+}
+
+func (s *Server) handleV1(r io.Reader, w io.Writer, remote string) error {
+	csrBytes, err := readFrameV1(r)
+	if err != nil {
+		return err
+	}
+	if s.Approval != nil {
+		return errors.New("protocol v1 clients cannot wait for manual approval")
+	}
+	certBytes, perr := s.sign(csrBytes, remote)
+	if perr != nil {
+		return perr
+	}
+	// v1 has room for the root only, so clients of an intermediate CA
+	// must speak v2.
+	for _, b := range [][]byte{certBytes, s.chain[len(s.chain)-1]} {
+		if err = writeFrameV1(w, b); err != nil {
+			return err
+		}
+	}
+	logmanager.Info(fmt.Sprintf("PKI signer: issued certificate to %s", remote))
+	return nil
+}
+
+func (s *Server) handleV2(r io.Reader, w io.Writer, remote string) error {
+	version, err := ReadHello(r)
+	if err != nil {
+		return err
+	}
+	if err = WriteHello(w); err != nil {
+		return err
+	}
+	// Answer the hello at once: a client probing for v2 falls back to v1
+	// when it waits too long, see DefaultHelloTimeout.
+	if f, ok := w.(interface{ Flush() error }); ok {
+		if err = f.Flush(); err != nil {
+			return err
+		}
+	}
+	if version != ProtocolV2 {
+		msg := fmt.Sprintf("unsupported protocol version %d", version)
+		WriteErrorFrame(w, ErrCodeUnsupportedVersion, msg)
+		return errors.New(msg)
+	}
+	csrBytes, err := expectFrame(r, FrameCSR)
+	if err != nil {
+		WriteErrorFrame(w, ErrCodeBadRequest, err.Error())
+		return err
+	}
+	certBytes, err := s.enroll(csrBytes, remote)
+	if pending, ok := err.(*PendingError); ok {
+		return WritePendingFrame(w, pending)
+	}
+	if err != nil {
+		perr := asProtocolError(err)
+		WriteErrorFrame(w, perr.Code, perr.Message)
+		return perr
+	}
+	if err = WriteFrame(w, FrameCertificate, certBytes); err != nil {
+		return err
+	}
+	if err = WriteFrame(w, FrameChain, encodeChain(s.chain)); err != nil {
+		return err
+	}
+	logmanager.Info(fmt.Sprintf("PKI signer: issued certificate to %s", remote))
+	return nil
+}
+
+// checkRequest parses a DER encoded CSR and checks it against the policy.
+func (s *Server) checkRequest(csrBytes []byte) (*x509.CertificateRequest, *ProtocolError) {
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return nil, &ProtocolError{Code: ErrCodeBadRequest, Message: err.Error()}
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, &ProtocolError{Code: ErrCodeBadRequest, Message: fmt.Sprintf("bad CSR signature: %v", err)}
+	}
+	if err = s.Policy.Check(csr); err != nil {
+		return nil, &ProtocolError{Code: ErrCodeRejected, Message: err.Error()}
+	}
+	return csr, nil
+}
+
+// sign checks a DER encoded CSR against the policy and returns the DER
+// encoded certificate issued for it. requester identifies the client in
+// the audit log.
+func (s *Server) sign(csrBytes []byte, requester string) ([]byte, *ProtocolError) {
+	csr, perr := s.checkRequest(csrBytes)
+	if perr != nil {
+		return nil, perr
+	}
+	// Check already parsed them successfully.
+	req, _ := ParseRequestedExtensions(csr)
+	validity := s.Policy.Validity
+	if req.Validity > 0 && req.Validity < validity {
+		validity = req.Validity
+	}
+	keyUsage := s.Policy.KeyUsage
+	if req.KeyUsage != 0 {
+		keyUsage = req.KeyUsage
+	}
+	extKeyUsage := s.Policy.ExtKeyUsage
+	if len(req.ExtKeyUsage) > 0 {
+		extKeyUsage = req.ExtKeyUsage
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, &ProtocolError{Code: ErrCodeInternal, Message: err.Error()}
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               csr.Subject,
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           extKeyUsage,
+		BasicConstraintsValid: true,
+		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
+		EmailAddresses:        csr.EmailAddresses,
+		URIs:                  csr.URIs,
+		CRLDistributionPoints: s.Policy.CRLDistributionPoints,
+	}
+	if template.NotAfter.After(s.caCert.NotAfter) {
+		template.NotAfter = s.caCert.NotAfter
+	}
+	if IsDevelopmentCertificate(s.caCert) {
+		template.ExtraExtensions = []pkix.Extension{developmentExtension()}
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, &ProtocolError{Code: ErrCodeInternal, Message: err.Error()}
+	}
+	cert, _ := x509.ParseCertificate(certBytes)
+	if s.Revocations != nil {
+		if err = s.Revocations.add(cert); err != nil {
+			return nil, &ProtocolError{Code: ErrCodeInternal, Message: err.Error()}
+		}
+	}
+	if s.Audit != nil {
+		if _, err = s.Audit.Record(cert, csrBytes, requester); err != nil {
+			// The certificate is never handed out, keep it out of the
+			// database too.
+			if s.Revocations != nil {
+				if rerr := s.Revocations.remove(cert); rerr != nil {
+					logmanager.Error(fmt.Sprintf("PKI signer: cannot remove unissued certificate %s: %v", formatSerial(cert.SerialNumber), rerr))
+				}
+			}
+			return nil, &ProtocolError{Code: ErrCodeInternal, Message: err.Error()}
+		}
+	}
+	return certBytes, nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serial, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate serial number: %v", err)
+	}
+	return serial, nil
+}
+
+func createRootCA(certFilename, keyFilename, commonName string, extensions ...pkix.Extension) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Failed to generate private key: %v", err)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"ezBastion"},
+			CommonName:   commonName,
+		},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		ExtraExtensions:       extensions,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	b, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal priv: %v", err)
+	}
+	if err = writePEM(keyFilename, "EC PRIVATE KEY", b, 0600); err != nil {
+		return err
+	}
+	return writePEM(certFilename, "CERTIFICATE", derBytes, 0644)
+}
+
+// CreateIntermediateCA issues an intermediate CA named commonName from the
+// CA in parentCertFilename and parentKeyFilename, which may itself be an
+// intermediate. certFilename receives the new certificate followed by the
+// parent chain, ready for NewServer.
+func CreateIntermediateCA(parentCertFilename, parentKeyFilename, certFilename, keyFilename, commonName string) error {
+	parents, err := loadCertificates(parentCertFilename)
+	if err != nil {
+		return err
+	}
+	parentKey, err := LoadPrivateKey(parentKeyFilename, nil)
+	if err != nil {
+		return err
+	}
+	parent := parents[0]
+	if !parent.IsCA {
+		return fmt.Errorf("%s is not a CA certificate", parentCertFilename)
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Failed to generate private key: %v", err)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"ezBastion"},
+			CommonName:   commonName,
+		},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	if template.NotAfter.After(parent.NotAfter) {
+		template.NotAfter = parent.NotAfter
+	}
+	if IsDevelopmentCertificate(parent) {
+		template.ExtraExtensions = []pkix.Extension{developmentExtension()}
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, parent, &priv.PublicKey, parentKey)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return err
+	}
+	b, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal priv: %v", err)
+	}
+	if err = writePEM(keyFilename, "EC PRIVATE KEY", b, 0600); err != nil {
+		return err
+	}
+	return writeCertificates(certFilename, append([]*x509.Certificate{cert}, parents...))
+}
+
+// verifyCAChain checks that each certificate of certs is a CA issued by the
+// next one and that the last is self-signed, and returns them DER encoded.
+func verifyCAChain(certs []*x509.Certificate) ([][]byte, error) {
+	chain := make([][]byte, len(certs))
+	for i, cert := range certs {
+		if !cert.IsCA {
+			return nil, fmt.Errorf("%s is not a CA certificate", cert.Subject.CommonName)
+		}
+		issuer := cert
+		if i < len(certs)-1 {
+			issuer = certs[i+1]
+		}
+		if err := cert.CheckSignatureFrom(issuer); err != nil {
+			return nil, fmt.Errorf("%s is not issued by %s: %v", cert.Subject.CommonName, issuer.Subject.CommonName, err)
+		}
+		chain[i] = cert.Raw
+	}
+	return chain, nil
+}
+
+func writePEM(filename, blockType string, b []byte, perm os.FileMode) error {
+	out, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("Failed to open %v for writing: %v", filename, err)
+	}
+	if err = pem.Encode(out, &pem.Block{Type: blockType, Bytes: b}); err != nil {
+		out.Close()
+		return fmt.Errorf("Failed to write %v: %v", filename, err)
+	}
+	return out.Close()
+}
+
+func loadCertificate(filename string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("No certificate found in %s", filename)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// loadCertificates returns every certificate of a PEM file, in file order.
+func loadCertificates(filename string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parsePEMCertificates(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v in %s", err, filename)
+	}
+	return certs, nil
+}
+
+// parsePEMCertificates returns every certificate of PEM data, in order.
+func parsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("No certificate found")
+	}
+	return certs, nil
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("Unsupported PEM block type %s", block.Type)
+}
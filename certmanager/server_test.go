@@ -0,0 +1,190 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// tempDir returns a folder removed at the end of the test.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "certmanager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// newServer returns a PKI signer with policy and a new root CA.
+func newServer(t *testing.T, policy SignPolicy) *Server {
+	t.Helper()
+	dir := tempDir(t)
+	s, err := NewServer(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), "test root", policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// serve runs s on a local port and returns its address.
+func serve(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+// quiet discards the progress of an enrollment.
+func quiet(EnrollEvent) {}
+
+type testFiles struct {
+	cert, key, ca string
+}
+
+func newTestFiles(t *testing.T) testFiles {
+	dir := tempDir(t)
+	return testFiles{filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key"), filepath.Join(dir, "node-ca.crt")}
+}
+
+func (f testFiles) generate(addr string, commonName string, addresses []string, options ...GenerateOption) (*EnrollResult, error) {
+	options = append([]GenerateOption{WithProgress(quiet)}, options...)
+	return GenerateContext(context.Background(), NewCertificateRequest(commonName, 0, addresses), addr, f.cert, f.key, f.ca, options...)
+}
+
+func TestGenerateRoundTrip(t *testing.T) {
+	for _, version := range []int{0, ProtocolV1, ProtocolV2} {
+		s := newServer(t, DefaultSignPolicy())
+		addr := serve(t, s)
+		files := newTestFiles(t)
+		result, err := files.generate(addr, "node1", []string{"node1.local", "127.0.0.1"}, WithProtocolVersion(version))
+		if err != nil {
+			t.Fatalf("protocol %d: %v", version, err)
+		}
+		if result.Certificate.Subject.CommonName != "node1" {
+			t.Errorf("protocol %d: issued to %q", version, result.Certificate.Subject.CommonName)
+		}
+		if !result.Root.Equal(s.RootCertificate()) {
+			t.Errorf("protocol %d: root is not the server root", version)
+		}
+		if err = ValidateCertificate(result.Certificate, result.Root); err != nil {
+			t.Errorf("protocol %d: %v", version, err)
+		}
+		if _, err = LoadX509KeyPair(files.cert, files.key, nil); err != nil {
+			t.Errorf("protocol %d: saved key pair: %v", version, err)
+		}
+	}
+}
+
+func TestGenerateErrorFrame(t *testing.T) {
+	policy := DefaultSignPolicy()
+	policy.AllowedDNSNames = []string{"*.ezb.local"}
+	addr := serve(t, newServer(t, policy))
+	files := newTestFiles(t)
+
+	_, err := files.generate(addr, "node1", []string{"node1.other"}, WithProtocolVersion(ProtocolV2))
+	var perr *ProtocolError
+	if !errors.As(err, &perr) || perr.Code != ErrCodeRejected {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+	if _, serr := os.Stat(files.cert); !os.IsNotExist(serr) {
+		t.Errorf("certificate saved after a rejection")
+	}
+	// v1 has no error frame: the connection is closed.
+	if _, err = files.generate(addr, "node1", []string{"node1.other"}, WithProtocolVersion(ProtocolV1)); err == nil {
+		t.Errorf("v1 request accepted")
+	}
+	if _, err = files.generate(addr, "node1", []string{"node1.ezb.local"}); err != nil {
+		t.Errorf("allowed name: %v", err)
+	}
+}
+
+func TestGeneratePendingFrame(t *testing.T) {
+	s := newServer(t, DefaultSignPolicy())
+	q, err := OpenApprovalQueue(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.RetryAfter = time.Second
+	s.Approval = q
+	addr := serve(t, s)
+	files := newTestFiles(t)
+
+	_, err = files.generate(addr, "node1", nil, WithApprovalTimeout(0))
+	var pending *PendingError
+	if !errors.As(err, &pending) || pending.RetryAfter != time.Second {
+		t.Fatalf("expected a pending request, got %v", err)
+	}
+	if _, err = q.Get(pending.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Approve the next request as soon as the client reports waiting.
+	approve := func(e EnrollEvent) {
+		if e.Step != EnrollPending {
+			return
+		}
+		reqs, err := q.List(ApprovalPending)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, req := range reqs {
+			if err = q.Approve(req.ID); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	result, err := files.generate(addr, "node2", nil, WithProgress(approve), WithApprovalTimeout(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Certificate.Subject.CommonName != "node2" {
+		t.Errorf("issued to %q", result.Certificate.Subject.CommonName)
+	}
+
+	if _, err = files.generate(addr, "node3", nil, WithProtocolVersion(ProtocolV1)); err == nil {
+		t.Errorf("v1 client accepted by a server requiring approval")
+	}
+}
+
+func TestServerConnTimeout(t *testing.T) {
+	s := newServer(t, DefaultSignPolicy())
+	s.ConnTimeout = 100 * time.Millisecond
+	conn, err := net.Dial("tcp", serve(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A client that never sends its request is dropped after ConnTimeout.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read data from an idle connection")
+	} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Fatal("idle connection still open")
+	}
+}
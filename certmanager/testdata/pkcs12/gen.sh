@@ -0,0 +1,43 @@
+#!/bin/sh
+# Regenerates the PKCS#12 fixtures of pkcs12_test.go with OpenSSL 3.
+# Password of every file: ezbastion.
+set -e
+cd "$(dirname "$0")"
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+openssl req -x509 -new -nodes -newkey ec -pkeyopt ec_paramgen_curve:P-256 -keyout "$tmp/root.key" \
+	-subj "/O=ezBastion/CN=fixture root" -days 36500 -out "$tmp/root.crt" \
+	-addext basicConstraints=critical,CA:true -addext keyUsage=critical,keyCertSign,cRLSign
+openssl req -new -nodes -newkey ec -pkeyopt ec_paramgen_curve:P-256 -keyout "$tmp/inter.key" \
+	-subj "/O=ezBastion/CN=fixture intermediate" -out "$tmp/inter.csr"
+printf 'basicConstraints=critical,CA:true\nkeyUsage=critical,keyCertSign,cRLSign\n' >"$tmp/ca.ext"
+openssl x509 -req -in "$tmp/inter.csr" -CA "$tmp/root.crt" -CAkey "$tmp/root.key" -CAcreateserial \
+	-days 36500 -extfile "$tmp/ca.ext" -out "$tmp/inter.crt"
+printf 'keyUsage=critical,digitalSignature,keyEncipherment\nextendedKeyUsage=clientAuth,serverAuth\nsubjectAltName=DNS:node1.ezb.local\n' >"$tmp/leaf.ext"
+for key in ec rsa; do
+	case $key in
+	ec) opt="-newkey ec -pkeyopt ec_paramgen_curve:P-256" ;;
+	rsa) opt="-newkey rsa:2048" ;;
+	esac
+	openssl req -new -nodes $opt -keyout "$tmp/$key.key" -subj "/O=ezBastion/CN=node1-$key" -out "$tmp/$key.csr"
+	openssl x509 -req -in "$tmp/$key.csr" -CA "$tmp/inter.crt" -CAkey "$tmp/inter.key" -CAcreateserial \
+		-days 36500 -extfile "$tmp/leaf.ext" -out "$tmp/$key.crt"
+done
+
+cat "$tmp/inter.crt" "$tmp/root.crt" >"$tmp/chain.pem"
+cat "$tmp/root.crt" "$tmp/inter.crt" >"$tmp/chain-rootfirst.pem"
+# OpenSSL 3 defaults: PBES2 AES-256-CBC, HMAC-SHA256 MAC.
+openssl pkcs12 -export -inkey "$tmp/ec.key" -in "$tmp/ec.crt" -certfile "$tmp/chain.pem" \
+	-name node1-ec -passout pass:ezbastion -out ec.p12
+openssl pkcs12 -export -inkey "$tmp/rsa.key" -in "$tmp/rsa.crt" -certfile "$tmp/chain.pem" \
+	-name node1-rsa -passout pass:ezbastion -out rsa.p12
+# Root before the intermediate, as some tools write it.
+openssl pkcs12 -export -inkey "$tmp/ec.key" -in "$tmp/ec.crt" -certfile "$tmp/chain-rootfirst.pem" \
+	-name node1-ec -passout pass:ezbastion -out rootfirst.p12
+# SHA-1 MAC, as written by older Windows and Java.
+openssl pkcs12 -export -inkey "$tmp/ec.key" -in "$tmp/ec.crt" -certfile "$tmp/chain.pem" \
+	-macalg sha1 -passout pass:ezbastion -out macsha1.p12
+# RC2/3DES, not supported.
+openssl pkcs12 -export -legacy -inkey "$tmp/ec.key" -in "$tmp/ec.crt" -certfile "$tmp/chain.pem" \
+	-passout pass:ezbastion -out legacy.p12
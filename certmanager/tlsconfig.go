@@ -0,0 +1,190 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
+)
+
+// reloadCheckInterval limits how often the key pair files are stat'ed.
+const reloadCheckInterval = time.Second
+
+// KeyPairReloader serves the key pair written by Generate to TLS handshakes,
+// loading it again whenever the files change on disk (for instance after a
+// Renewer run).
+type KeyPairReloader struct {
+	certFilename string
+	keyFilename  string
+	passphrase   []byte
+	store        KeyStore
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certStamp fileStamp
+	keyStamp  fileStamp
+	checked   time.Time
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampOf(filename string) (fileStamp, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// NewKeyPairReloader loads the key pair once and returns a reloader for it.
+// passphrase decrypts an encrypted key and may be nil.
+func NewKeyPairReloader(certFilename, keyFilename string, passphrase []byte) (*KeyPairReloader, error) {
+	k := &KeyPairReloader{certFilename: certFilename, keyFilename: keyFilename, passphrase: passphrase}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// NewKeyPairReloaderFrom is NewKeyPairReloader for a key file written by
+// store, such as a PKCS11KeyStore.
+func NewKeyPairReloaderFrom(store KeyStore, certFilename, keyFilename string) (*KeyPairReloader, error) {
+	k := &KeyPairReloader{certFilename: certFilename, keyFilename: keyFilename, store: store}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *KeyPairReloader) reload() error {
+	certStamp, err := stampOf(k.certFilename)
+	if err != nil {
+		return err
+	}
+	keyStamp, err := stampOf(k.keyFilename)
+	if err != nil {
+		return err
+	}
+	var cert tls.Certificate
+	if k.store != nil {
+		cert, err = LoadX509KeyPairFrom(k.store, k.certFilename, k.keyFilename)
+	} else {
+		cert, err = LoadX509KeyPair(k.certFilename, k.keyFilename, k.passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	k.cert = &cert
+	k.certStamp = certStamp
+	k.keyStamp = keyStamp
+	return nil
+}
+
+// Certificate returns the current key pair, reloading it first if the files
+// changed. A pair that fails to load, typically because the certificate and
+// key are caught mid-replacement, is logged and the previous one kept.
+func (k *KeyPairReloader) Certificate() *tls.Certificate {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if time.Since(k.checked) < reloadCheckInterval {
+		return k.cert
+	}
+	k.checked = time.Now()
+	certStamp, errCert := stampOf(k.certFilename)
+	keyStamp, errKey := stampOf(k.keyFilename)
+	if errCert != nil || errKey != nil || (certStamp == k.certStamp && keyStamp == k.keyStamp) {
+		return k.cert
+	}
+	if err := k.reload(); err != nil {
+		logmanager.Warning(fmt.Sprintf("Keeping previous certificate, cannot reload %s: %v", k.certFilename, err))
+		return k.cert
+	}
+	logmanager.Info(fmt.Sprintf("Reloaded certificate %s", k.certFilename))
+	return k.cert
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (k *KeyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+func (k *KeyPairReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return k.Certificate(), nil
+}
+
+// LoadCAPool returns a certificate pool holding every certificate of the
+// PEM file written by Generate as caFileName.
+func LoadCAPool(caFilename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFilename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("No certificate found in %s", caFilename)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig returns a mutual TLS server configuration requiring client
+// certificates issued by the saved CA and serving a key pair reloaded when
+// the files change. passphrase decrypts an encrypted key and may be nil.
+func ServerTLSConfig(certFilename, keyFilename, caFilename string, passphrase []byte) (*tls.Config, error) {
+	pool, err := LoadCAPool(caFilename)
+	if err != nil {
+		return nil, err
+	}
+	k, err := NewKeyPairReloader(certFilename, keyFilename, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: k.GetCertificate,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      pool,
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
+
+// ClientTLSConfig returns a mutual TLS client configuration trusting the
+// saved CA and presenting a key pair reloaded when the files change.
+// passphrase decrypts an encrypted key and may be nil.
+func ClientTLSConfig(certFilename, keyFilename, caFilename string, passphrase []byte) (*tls.Config, error) {
+	pool, err := LoadCAPool(caFilename)
+	if err != nil {
+		return nil, err
+	}
+	k, err := NewKeyPairReloader(certFilename, keyFilename, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetClientCertificate: k.GetClientCertificate,
+		RootCAs:              pool,
+		MinVersion:           tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,158 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/ezBastion/ezb_lib/ez_stdio"
+)
+
+// Fingerprint returns the SHA-256 fingerprint of cert as colon separated
+// uppercase hex, the form shown to operators and stored in configuration.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToUpper(fp)
+	fp = strings.Replace(fp, ":", "", -1)
+	return strings.Replace(fp, " ", "", -1)
+}
+
+// GenerateTLS is Generate over a TLS connection to the PKI. The PKI root
+// certificate must match fingerprint, its SHA-256 fingerprint as returned by
+// Fingerprint. When fingerprint is empty the operator is shown the presented
+// root and asked to trust it (trust on first use). Nothing is written when
+// the PKI cannot be authenticated.
+func GenerateTLS(certificate *x509.CertificateRequest, ezbpki, fingerprint, certFilename, keyFilename, caFileName string, options ...GenerateOption) error {
+	_, err := GenerateTLSContext(context.Background(), certificate, ezbpki, fingerprint, certFilename, keyFilename, caFileName, options...)
+	return err
+}
+
+// GenerateTLSContext is GenerateTLS bounded by ctx and reporting what it
+// saved, like GenerateContext.
+func GenerateTLSContext(ctx context.Context, certificate *x509.CertificateRequest, ezbpki, fingerprint, certFilename, keyFilename, caFileName string, options ...GenerateOption) (*EnrollResult, error) {
+	pin := &pkiPin{fingerprint: normalizeFingerprint(fingerprint)}
+	config := &tls.Config{
+		// The PKI is authenticated by its pinned root, not by the web PKI
+		// and hostname; see pkiPin.verify.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: pin.verify,
+		MinVersion:            tls.VersionTLS12,
+	}
+	dial := func(ctx context.Context) (net.Conn, error) {
+		conn, err := dialContext(ctx, ezbpki)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		// The handshake may wait for the operator to trust the root, so
+		// only ctx bounds it.
+		stop := watchConn(ctx, tlsConn, 0)
+		err = tlsConn.Handshake()
+		stop()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return generate(ctx, certificate, dialEnroll(dial), pin.checkRoot, certFilename, keyFilename, caFileName, options)
+}
+
+// pkiPin authenticates the PKI against a pinned root fingerprint, asking the
+// operator to pin one on first use.
+type pkiPin struct {
+	mu          sync.Mutex
+	fingerprint string
+}
+
+func (p *pkiPin) verify(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return errors.New("PKI presented no certificate")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var root *x509.Certificate
+	if p.fingerprint == "" {
+		root = certs[len(certs)-1]
+		if !root.IsCA {
+			return errors.New("PKI did not present its root certificate")
+		}
+		question := fmt.Sprintf("PKI root certificate %q has SHA-256 fingerprint\n%s\nTrust it?", root.Subject.CommonName, Fingerprint(root))
+		if !ez_stdio.AskForConfirmation(question) {
+			return errors.New("PKI root certificate not trusted")
+		}
+		p.fingerprint = normalizeFingerprint(Fingerprint(root))
+	} else {
+		for _, cert := range certs {
+			if normalizeFingerprint(Fingerprint(cert)) == p.fingerprint {
+				root = cert
+				break
+			}
+		}
+		if root == nil {
+			return errors.New("PKI certificate does not match the pinned fingerprint")
+		}
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// checkRoot refuses a root certificate returned by the enrollment exchange
+// that is not the pinned one.
+func (p *pkiPin) checkRoot(root *x509.Certificate) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if normalizeFingerprint(Fingerprint(root)) != p.fingerprint {
+		return fmt.Errorf("Root certificate %s does not match the pinned fingerprint", Fingerprint(root))
+	}
+	return nil
+}
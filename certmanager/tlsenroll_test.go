@@ -0,0 +1,90 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package certmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+// serveTLS runs s on a local port over TLS, as ListenAndServeTLS does, and
+// returns its address.
+func serveTLS(t *testing.T, s *Server) string {
+	t.Helper()
+	config, err := s.tlsConfig("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(tls.NewListener(l, config))
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func TestGenerateTLSPin(t *testing.T) {
+	s := newServer(t, DefaultSignPolicy())
+	addr := serveTLS(t, s)
+	fingerprint := Fingerprint(s.RootCertificate())
+	request := NewCertificateRequest("node1", 0, nil)
+
+	for _, pin := range []string{
+		fingerprint,
+		strings.ToLower(fingerprint),
+		strings.Replace(fingerprint, ":", "", -1),
+		strings.Replace(strings.ToLower(fingerprint), ":", " ", -1),
+	} {
+		files := newTestFiles(t)
+		result, err := GenerateTLSContext(context.Background(), request, addr, pin, files.cert, files.key, files.ca, WithProgress(quiet))
+		if err != nil {
+			t.Fatalf("pin %s: %v", pin, err)
+		}
+		if !result.Root.Equal(s.RootCertificate()) {
+			t.Errorf("pin %s: saved another root", pin)
+		}
+	}
+
+	other := newServer(t, DefaultSignPolicy())
+	files := newTestFiles(t)
+	_, err := GenerateTLSContext(context.Background(), request, addr, Fingerprint(other.RootCertificate()), files.cert, files.key, files.ca, WithProgress(quiet))
+	if err == nil || !strings.Contains(err.Error(), "pinned fingerprint") {
+		t.Fatalf("expected a pin mismatch, got %v", err)
+	}
+	for _, filename := range []string{files.cert, files.key, files.ca} {
+		if _, err = os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("%s written after a pin mismatch", filename)
+		}
+	}
+}
+
+func TestPKIPinCheckRoot(t *testing.T) {
+	root := newServer(t, DefaultSignPolicy()).RootCertificate()
+	pin := &pkiPin{fingerprint: normalizeFingerprint(strings.ToLower(Fingerprint(root)))}
+	if err := pin.checkRoot(root); err != nil {
+		t.Error(err)
+	}
+	// A PKI answering the exchange with another root than the pinned one
+	// is refused.
+	if err := pin.checkRoot(newServer(t, DefaultSignPolicy()).RootCertificate()); err == nil {
+		t.Error("another root accepted")
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"strings"
 
 	"github.com/ezBastion/ezb_lib/logmanager"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // askForConfirmation : Reads the stdin for an confirmation aka answer - ONLY yes/no
@@ -90,3 +91,23 @@ func AskForStringValue(s string) string {
 		return response
 	}
 }
+
+// AskForSecret : Reads a secret from the terminal without echoing it
+func AskForSecret(s string) string {
+	logmanager.Debug(fmt.Sprintf("AskForSecret : %s", s))
+	fmt.Printf("%s ", s)
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		response, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			fmt.Println(err)
+		}
+		return strings.TrimRight(response, "\r\n")
+	}
+	response, err := terminal.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		fmt.Println(err)
+	}
+	return string(response)
+}
@@ -0,0 +1,281 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package logmanager
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Logger writes the log of one component with its own level, outputs and
+// fields, so several components of a process, or parallel tests, do not
+// disturb each other. The package functions log through the default
+// Logger, configured by SetLogLevel.
+type Logger struct {
+	logger *log.Logger
+
+	mu     sync.RWMutex
+	fields log.Fields
+	// eventLog copies the lines to the Windows event log once
+	// StartWindowsEvent opened it.
+	eventLog bool
+}
+
+type config struct {
+	level        string
+	outputs      []io.Writer
+	reportCaller bool
+	fields       log.Fields
+	eventLog     bool
+}
+
+// Option configures a Logger created by New.
+type Option func(*config)
+
+// WithLevel sets the level: "debug", "info", "warning", "error" or
+// "critical". Unknown names fall back to "info" with a warning. The
+// default is "info".
+func WithLevel(level string) Option {
+	return func(c *config) {
+		c.level = level
+	}
+}
+
+// WithFile writes the log to fileName in exPath, rotated after maxSize
+// megabytes, keeping maxBackups old files for maxAge days.
+func WithFile(exPath, fileName string, maxSize, maxBackups, maxAge int) Option {
+	return func(c *config) {
+		c.outputs = append(c.outputs, &lumberjack.Logger{
+			Filename:   exPath + string(os.PathSeparator) + fileName,
+			MaxSize:    maxSize,
+			MaxBackups: maxBackups,
+			MaxAge:     maxAge,
+		})
+	}
+}
+
+// WithOutput writes the log to w too. Without WithFile nor WithOutput the
+// log goes to stderr.
+func WithOutput(w io.Writer) Option {
+	return func(c *config) {
+		c.outputs = append(c.outputs, w)
+	}
+}
+
+// WithReportCaller adds the calling method and line to every line.
+func WithReportCaller(enabled bool) Option {
+	return func(c *config) {
+		c.reportCaller = enabled
+	}
+}
+
+// WithField adds key to every line, e.g. the name of the component.
+func WithField(key string, value interface{}) Option {
+	return func(c *config) {
+		c.fields[key] = value
+	}
+}
+
+// WithEventLog tells whether the lines are copied to the Windows event
+// log opened by StartWindowsEvent, the default. Ignored on other systems.
+func WithEventLog(enabled bool) Option {
+	return func(c *config) {
+		c.eventLog = enabled
+	}
+}
+
+// New returns a Logger writing JSON lines as configured by options.
+func New(options ...Option) *Logger {
+	l := &Logger{logger: log.New()}
+	l.configure(options)
+	return l
+}
+
+// std is the Logger of the package functions. It drives the standard
+// logrus logger, as they always did, for code logging with logrus directly.
+var std = &Logger{logger: log.StandardLogger(), fields: log.Fields{}, eventLog: true}
+
+// Default returns the Logger used by the package functions.
+func Default() *Logger {
+	return std
+}
+
+func (l *Logger) configure(options []Option) {
+	c := config{level: "info", fields: log.Fields{}, eventLog: true}
+	for _, option := range options {
+		option(&c)
+	}
+	lvl, known := parseLevel(c.level)
+	l.logger.SetFormatter(&log.JSONFormatter{})
+	l.logger.SetLevel(lvl)
+	l.logger.SetReportCaller(c.reportCaller)
+	switch len(c.outputs) {
+	case 0:
+		l.logger.SetOutput(os.Stderr)
+	case 1:
+		l.logger.SetOutput(c.outputs[0])
+	default:
+		l.logger.SetOutput(io.MultiWriter(c.outputs...))
+	}
+	l.mu.Lock()
+	l.fields = c.fields
+	l.eventLog = c.eventLog
+	l.mu.Unlock()
+	if !known {
+		l.Warning(fmt.Sprintf("ezb_lib/logmanager: bad log level name %q, set to info", c.level))
+	}
+}
+
+func parseLevel(name string) (log.Level, bool) {
+	switch name {
+	case "debug":
+		return log.DebugLevel, true
+	case "info":
+		return log.InfoLevel, true
+	case "warning":
+		return log.WarnLevel, true
+	case "error":
+		return log.ErrorLevel, true
+	case "critical":
+		return log.FatalLevel, true
+	}
+	return log.InfoLevel, false
+}
+
+// Level returns the name of the level of l. It is read from the logrus
+// logger, so Loggers returned by With follow a change of their parent.
+func (l *Logger) Level() string {
+	switch l.logger.GetLevel() {
+	case log.DebugLevel, log.TraceLevel:
+		return "debug"
+	case log.WarnLevel:
+		return "warning"
+	case log.ErrorLevel:
+		return "error"
+	case log.FatalLevel, log.PanicLevel:
+		return "critical"
+	}
+	return "info"
+}
+
+// With returns a Logger adding key to the lines of l, sharing its level and
+// outputs.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	fields := make(log.Fields, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Logger{logger: l.logger, fields: fields, eventLog: l.eventLog}
+}
+
+func (l *Logger) entry() *log.Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.logger.WithFields(l.fields)
+}
+
+// Debug logs a debug event.
+func (l *Logger) Debug(logline string) error {
+	l.entry().Debugln(logline)
+	l.forwardEvent(log.DebugLevel, logline)
+	return nil
+}
+
+// Info logs an info event, also printed on stdout when forceStdout is true.
+func (l *Logger) Info(logline string, forceStdout ...bool) error {
+	l.entry().Infoln(logline)
+	l.forwardEvent(log.InfoLevel, logline)
+	if len(forceStdout) > 0 && forceStdout[0] {
+		fmt.Println(logline)
+	}
+	return nil
+}
+
+// Warning logs a warning event.
+func (l *Logger) Warning(logline string) error {
+	l.entry().Warnln(logline)
+	l.forwardEvent(log.WarnLevel, logline)
+	return nil
+}
+
+// Error logs an error event.
+func (l *Logger) Error(logline string) error {
+	l.entry().Errorln(logline)
+	l.forwardEvent(log.ErrorLevel, logline)
+	return nil
+}
+
+// Fatal logs logline and exits.
+func (l *Logger) Fatal(logline string) {
+	l.entry().Fatal(logline)
+}
+
+// SetLogLevel configures the default Logger of the package functions, see
+// New.
+func SetLogLevel(LogLevel string, exPath string, fileName string, maxSize int, maxBackups int, maxAge int, interactive bool, reportcaller bool, jsontostdout bool) error {
+	options := []Option{
+		WithLevel(LogLevel),
+		WithReportCaller(reportcaller),
+		WithFile(exPath, fileName, maxSize, maxBackups, maxAge),
+	}
+	if jsontostdout {
+		options = append(options, WithOutput(os.Stderr))
+	}
+	std.configure(options)
+	std.Info("Log system initialized.")
+	return nil
+}
+
+// WithFields adds the field s1 to the following lines of the package
+// functions.
+func WithFields(s1 string, s2 string) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.fields[s1] = s2
+}
+
+// Debug logs a debug event with the default Logger.
+func Debug(logline string) error {
+	return std.Debug(logline)
+}
+
+// Info logs an info event with the default Logger.
+func Info(logline string, forceStdout ...bool) error {
+	return std.Info(logline, forceStdout...)
+}
+
+// Error logs an error event with the default Logger.
+func Error(logline string) error {
+	return std.Error(logline)
+}
+
+// Warning logs a warning event with the default Logger.
+func Warning(logline string) error {
+	return std.Warning(logline)
+}
+
+// Fatal logs logline with the default Logger and exits.
+func Fatal(logline string) {
+	std.Fatal(logline)
+}
@@ -0,0 +1,105 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package logmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// readLines decodes the JSON lines written to buf.
+func readLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(line, &fields); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+func TestLoggersInParallel(t *testing.T) {
+	for _, tc := range []struct {
+		component string
+		level     string
+		lines     int
+	}{
+		{"pki", "debug", 4 * 100},
+		{"api", "warning", 2 * 100},
+	} {
+		tc := tc
+		t.Run(tc.component, func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
+			l := New(WithLevel(tc.level), WithOutput(&buf), WithField("component", tc.component), WithEventLog(false))
+			for i := 0; i < 100; i++ {
+				l.Debug(fmt.Sprint("debug ", i))
+				l.Info(fmt.Sprint("info ", i))
+				l.Warning(fmt.Sprint("warning ", i))
+				l.Error(fmt.Sprint("error ", i))
+			}
+			if l.Level() != tc.level {
+				t.Errorf("level %s, expected %s", l.Level(), tc.level)
+			}
+			lines := readLines(t, &buf)
+			if len(lines) != tc.lines {
+				t.Errorf("%d lines at level %s, expected %d", len(lines), tc.level, tc.lines)
+			}
+			for _, line := range lines {
+				if line["component"] != tc.component {
+					t.Fatalf("line of another logger: %v", line)
+				}
+			}
+		})
+	}
+}
+
+func TestLoggerWithSharesLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(WithOutput(&buf), WithEventLog(false))
+	child := l.With("request", "1")
+	l.configure([]Option{WithLevel("error"), WithOutput(&buf), WithEventLog(false)})
+	if child.Level() != "error" {
+		t.Errorf("child kept level %s after its parent moved to error", child.Level())
+	}
+	child.Warning("dropped")
+	child.Error("kept")
+	lines := readLines(t, &buf)
+	if len(lines) != 1 || lines[0]["msg"] != "kept" || lines[0]["request"] != "1" {
+		t.Errorf("child wrote %v", lines)
+	}
+	if len(l.fields) != 0 {
+		t.Errorf("parent got the fields of its child: %v", l.fields)
+	}
+
+	// An unknown name falls back to info, and says so.
+	buf.Reset()
+	l.configure([]Option{WithLevel("verbose"), WithOutput(&buf), WithEventLog(false)})
+	if l.Level() != "info" {
+		t.Errorf("level %s for an unknown name", l.Level())
+	}
+	if lines = readLines(t, &buf); len(lines) != 1 || lines[0]["level"] != "warning" {
+		t.Errorf("no warning for an unknown name: %v", lines)
+	}
+}
@@ -17,15 +17,11 @@
 package logmanager
 
 import (
-	"fmt"
-	"io"
-	"os"
 	"path"
 	"runtime"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 type callInfo struct {
@@ -35,52 +31,6 @@ type callInfo struct {
 	line        int
 }
 
-// EventLog management
-var level string
-
-// SetLogLevel set logrus level
-func SetLogLevel(LogLevel string, exPath string, fileName string, maxSize int, maxBackups int, maxAge int, interactive bool, reportcaller bool, jsontostdout bool) error {
-	log.SetFormatter(&log.JSONFormatter{})
-	level = LogLevel
-	switch LogLevel {
-	case "debug":
-		log.SetLevel(log.DebugLevel)
-	case "info":
-		log.SetLevel(log.InfoLevel)
-	case "warning":
-		log.SetLevel(log.WarnLevel)
-	case "error":
-		log.SetLevel(log.ErrorLevel)
-	case "critical":
-		log.SetLevel(log.FatalLevel)
-	default:
-		fmt.Errorf("ezb_lib/logmanager/SetLogLevel() failed: Bad log level name, set to Info")
-		log.SetLevel(log.InfoLevel)
-	}
-
-	// Adding the method and line caller, easier to debug
-	log.SetReportCaller(reportcaller)
-	abspathfilename := exPath + string(os.PathSeparator) + fileName
-
-	lj := &lumberjack.Logger{
-		Filename:   abspathfilename,
-		MaxSize:    maxSize,
-		MaxBackups: maxBackups,
-		MaxAge:     maxAge,
-	}
-
-	if jsontostdout {
-		mWriter := io.MultiWriter(os.Stderr, lj)
-		log.SetOutput(mWriter)
-	} else {
-		log.SetOutput(lj)
-	}
-	log.Info("Log system initialized.")
-
-	return nil
-
-}
-
 func retrieveCallInfo() *callInfo {
 	pc, file, line, _ := runtime.Caller(2)
 	_, fileName := path.Split(file)
@@ -104,42 +54,6 @@ func retrieveCallInfo() *callInfo {
 	}
 }
 
-func WithFields(s1 string, s2 string) {
-	log.WithFields(log.Fields{s1: s2})
-}
-
-// Info logs an info event into the windows eventlog system
-func Debug(logline string) error {
-	log.Debugln(logline)
-	return nil
-}
-
-func Info(logline string, forceStdout ...bool) error {
-	log.Infoln(logline)
-	output := false
-	if len(forceStdout) > 0 {
-		output = forceStdout[0]
-	}
-
-	if output {
-		fmt.Println(logline)
-	}
-
-	return nil
-}
-
-// Error logs an error event into the windows eventlog system
-func Error(logline string) error {
-	log.Errorln(logline)
-	return nil
-}
-
-// Warning logs an warning event into the windows eventlog system
-func Warning(logline string) error {
-	log.Warnln(logline)
-	return nil
-}
-
-func Fatal(logline string) {
-	log.Fatal(logline)
-}
+// forwardEvent copies the lines to the Windows event log, nothing to do
+// here.
+func (l *Logger) forwardEvent(severity log.Level, logline string) {}
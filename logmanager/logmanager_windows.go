@@ -17,16 +17,12 @@
 package logmanager
 
 import (
-	"fmt"
-	"io"
-	"os"
 	"path"
 	"runtime"
 	"strings"
 
 	ezbevent "github.com/ezBastion/ezb_lib/eventlogmanager"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 type callInfo struct {
@@ -36,52 +32,6 @@ type callInfo struct {
 	line        int
 }
 
-// EventLog management
-var level string
-
-// SetLogLevel set logrus level
-func SetLogLevel(LogLevel string, exPath string, fileName string, maxSize int, maxBackups int, maxAge int, interactive bool, reportcaller bool, jsontostdout bool) error {
-	log.SetFormatter(&log.JSONFormatter{})
-	level = LogLevel
-	switch LogLevel {
-	case "debug":
-		log.SetLevel(log.DebugLevel)
-	case "info":
-		log.SetLevel(log.InfoLevel)
-	case "warning":
-		log.SetLevel(log.WarnLevel)
-	case "error":
-		log.SetLevel(log.ErrorLevel)
-	case "critical":
-		log.SetLevel(log.FatalLevel)
-	default:
-		fmt.Errorf("ezb_lib/logmanager/SetLogLevel() failed: Bad log level name, set to Info")
-		log.SetLevel(log.InfoLevel)
-	}
-
-	// Adding the method and line caller, easier to debug
-	log.SetReportCaller(reportcaller)
-	abspathfilename := exPath + string(os.PathSeparator) + fileName
-
-	lj := &lumberjack.Logger{
-		Filename:   abspathfilename,
-		MaxSize:    maxSize,
-		MaxBackups: maxBackups,
-		MaxAge:     maxAge,
-	}
-
-	if jsontostdout {
-		mWriter := io.MultiWriter(os.Stderr, lj)
-		log.SetOutput(mWriter)
-	} else {
-		log.SetOutput(lj)
-	}
-	log.Info("Log system initialized.")
-
-	return nil
-
-}
-
 func retrieveCallInfo() *callInfo {
 	pc, file, line, _ := runtime.Caller(2)
 	_, fileName := path.Split(file)
@@ -105,73 +55,38 @@ func retrieveCallInfo() *callInfo {
 	}
 }
 
-func WithFields(s1 string, s2 string) {
-	log.WithFields(log.Fields{s1: s2})
-}
-
 func StartWindowsEvent(name string) {
-		if ezbevent.Status == 0 {
-			ezbevent.Open(name)
-		}
-	
-}
-
-// Info logs an info event into the windows eventlog system
-func Debug(logline string) error {
-	log.Debugln(logline)
-	if level == "debug" {
-			if ezbevent.Status == 0 {
-				ezbevent.Elog.Info(1, "DEBUG : "+logline)
-			}
-		}
+	if ezbevent.Status == 0 {
+		ezbevent.Open(name)
 	}
-	return nil
 }
 
-func Info(logline string, forceStdout ...bool) error {
-	log.Infoln(logline)
-	output := false
-	if len(forceStdout) > 0 {
-		output = forceStdout[0]
+// forwardEvent copies logline to the Windows event log, when open, if the
+// level of l lets events of severity through.
+func (l *Logger) forwardEvent(severity log.Level, logline string) {
+	level := l.Level()
+	l.mu.RLock()
+	enabled := l.eventLog
+	l.mu.RUnlock()
+	if !enabled || ezbevent.Status != 0 {
+		return
 	}
-
-	if output {
-		fmt.Println(logline)
-	}
-	if level == "debug" || (level == "info") {
-		if ezbevent.Status == 0 {
+	switch severity {
+	case log.DebugLevel:
+		if level == "debug" {
+			ezbevent.Elog.Info(1, "DEBUG : "+logline)
+		}
+	case log.InfoLevel:
+		if level == "debug" || level == "info" {
 			ezbevent.Elog.Info(1, logline)
 		}
-	}
-	return nil
-}
-
-
-
-
-// Error logs an error event into the windows eventlog system
-func Error(logline string) error {
-	log.Errorln(logline)
-	if (level == "info") || (level == "warning") || (level == "error") || (level == "debug") {
-		if ezbevent.Status == 0 {
+	case log.WarnLevel:
+		if level == "debug" || level == "info" || level == "warning" {
+			ezbevent.Elog.Warning(1, logline)
+		}
+	case log.ErrorLevel:
+		if level == "info" || level == "warning" || level == "error" || level == "debug" {
 			ezbevent.Elog.Error(1, logline)
 		}
-		
-	}
-	return nil
-}
-
-// Warning logs an warning event into the windows eventlog system
-func Warning(logline string) error {
-	log.Warnln(logline)
-	if (level == "debug") || (level == "info") || (level == "warning") {
-		if ezbevent.Status == 0 {
-			ezbevent.Elog.Warning(1, logline)
-		}	
 	}
-	return nil
-}
-
-func Fatal(logline string) {
-	log.Fatal(logline)
 }
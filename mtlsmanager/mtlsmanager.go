@@ -0,0 +1,256 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package mtlsmanager builds the mutual TLS HTTP servers and clients of the
+// ezBastion services around the certificates created by certmanager.
+package mtlsmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/certmanager"
+	"github.com/ezBastion/ezb_lib/logmanager"
+)
+
+// CAName is the base name of the CA file shared by the services of a
+// deployment.
+const CAName = "ezb_pki"
+
+// Files locates the key pair of a service and the CA it trusts.
+type Files struct {
+	CertFilename string
+	KeyFilename  string
+	CAFilename   string
+	// Passphrase decrypts an encrypted key and may be nil.
+	Passphrase []byte
+	// KeyStore, when set, loads the key instead, e.g. a
+	// certmanager.PKCS11KeyStore.
+	KeyStore certmanager.KeyStore
+}
+
+// ServiceFiles returns the files of service name in the cert folder created
+// by setupmanager.CheckFolder under exPath: <name>.crt, <name>.key and the
+// CA file CAName.crt.
+func ServiceFiles(exPath, name string) Files {
+	dir := path.Join(exPath, "cert")
+	return Files{
+		CertFilename: path.Join(dir, name+".crt"),
+		KeyFilename:  path.Join(dir, name+".key"),
+		CAFilename:   path.Join(dir, CAName+".crt"),
+	}
+}
+
+// reloader returns a reloader serving the key pair, so services keep running
+// across certmanager.Renewer runs.
+func (f Files) reloader() (*certmanager.KeyPairReloader, error) {
+	if f.KeyStore != nil {
+		return certmanager.NewKeyPairReloaderFrom(f.KeyStore, f.CertFilename, f.KeyFilename)
+	}
+	return certmanager.NewKeyPairReloader(f.CertFilename, f.KeyFilename, f.Passphrase)
+}
+
+// NewServer returns an HTTPS server for addr requiring client certificates
+// issued by the CA. handler is wrapped with WithPeer and LogRequests. Start
+// it with ListenAndServeTLS("", ""); the key pair comes from TLSConfig.
+func NewServer(addr string, files Files, handler http.Handler) (*http.Server, error) {
+	pool, err := certmanager.LoadCAPool(files.CAFilename)
+	if err != nil {
+		return nil, err
+	}
+	k, err := files.reloader()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Addr:    addr,
+		Handler: LogRequests(WithPeer(handler)),
+		TLSConfig: &tls.Config{
+			GetCertificate: k.GetCertificate,
+			ClientAuth:     tls.RequireAndVerifyClientCert,
+			ClientCAs:      pool,
+			MinVersion:     tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      time.Minute,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    1 << 20,
+		ErrorLog:          log.New(errorLogWriter{}, "", 0),
+	}, nil
+}
+
+// NewClient returns an HTTP client presenting the service key pair and
+// trusting only the CA.
+func NewClient(files Files) (*http.Client, error) {
+	pool, err := certmanager.LoadCAPool(files.CAFilename)
+	if err != nil {
+		return nil, err
+	}
+	k, err := files.reloader()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   10 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSClientConfig: &tls.Config{
+				GetClientCertificate: k.GetClientCertificate,
+				RootCAs:              pool,
+				MinVersion:           tls.VersionTLS12,
+			},
+			ForceAttemptHTTP2:     true,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			MaxIdleConnsPerHost:   10,
+		},
+		Timeout: time.Minute,
+	}, nil
+}
+
+// Peer describes the verified client certificate of a request.
+type Peer struct {
+	CommonName     string
+	DNSNames       []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	EmailAddresses []string
+	Certificate    *x509.Certificate
+	// Identity is the ezBastion identity of the certificate, nil when it
+	// carries none, see certmanager.IdentityOf.
+	Identity *certmanager.Identity
+}
+
+type peerKey struct{}
+
+// PeerFromContext returns the client certificate identity stored by
+// WithPeer.
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	peer, ok := ctx.Value(peerKey{}).(*Peer)
+	return peer, ok
+}
+
+// WithPeer stores the identity of the verified client certificate in the
+// request context, see PeerFromContext. Requests without one, which
+// NewServer refuses during the handshake, are passed on unchanged.
+func WithPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			cert := r.TLS.VerifiedChains[0][0]
+			peer := &Peer{
+				CommonName:     cert.Subject.CommonName,
+				DNSNames:       cert.DNSNames,
+				IPAddresses:    cert.IPAddresses,
+				URIs:           cert.URIs,
+				EmailAddresses: cert.EmailAddresses,
+				Certificate:    cert,
+			}
+			if id, err := certmanager.IdentityOf(cert); err == nil {
+				peer.Identity = &id
+			}
+			r = r.WithContext(context.WithValue(r.Context(), peerKey{}, peer))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireIdentity passes to next the requests whose peer identity is
+// accepted by rule, e.g. certmanager.MatchComponent(certmanager.ComponentWorker),
+// and answers the others with 403. It must run below WithPeer, as in the
+// handlers of NewServer.
+func RequireIdentity(rule certmanager.IdentityMatcher, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := PeerFromContext(r.Context())
+		if !ok || peer.Identity == nil || !rule(*peer.Identity) {
+			who := "unknown peer"
+			if ok {
+				who = fmt.Sprintf("%q", peer.CommonName)
+				if peer.Identity != nil {
+					who = peer.Identity.String()
+				}
+			}
+			logmanager.Warning(fmt.Sprintf("Denied %s %s to %s", r.Method, r.URL.Path, who))
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LogRequests logs every request through logmanager once it is served, with
+// the common name of the client certificate.
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		cn := "-"
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			cn = r.TLS.VerifiedChains[0][0].Subject.CommonName
+		}
+		logmanager.Info(fmt.Sprintf("%s %s %s %s %d %d %s", r.RemoteAddr, cn, r.Method, r.URL.RequestURI(), rec.status, rec.bytes, time.Since(start).Round(time.Millisecond)))
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// errorLogWriter sends the http.Server error log, mostly failed
+// handshakes, to logmanager.
+type errorLogWriter struct{}
+
+func (errorLogWriter) Write(p []byte) (int, error) {
+	logmanager.Warning(string(bytes.TrimSpace(p)))
+	return len(p), nil
+}
@@ -0,0 +1,160 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package mtlsmanager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ezBastion/ezb_lib/certmanager"
+)
+
+// tempDir returns a folder removed at the end of the test.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mtlsmanager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// newServiceFiles enrolls component under exPath, as ServiceFiles lays it
+// out, from a development CA shared by the services of exPath.
+func newServiceFiles(t *testing.T, exPath, component string) Files {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(exPath, "cert"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := ServiceFiles(exPath, component)
+	request := certmanager.NewCertificateRequest(component, 0, []string{"127.0.0.1"},
+		certmanager.WithIdentity(component, "ezb.local"),
+		certmanager.WithExtKeyUsage(x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth))
+	err := certmanager.GenerateOffline(request, filepath.Join(exPath, "dev-ca.crt"), filepath.Join(exPath, "dev-ca.key"),
+		files.CertFilename, files.KeyFilename, files.CAFilename, certmanager.WithProgress(func(certmanager.EnrollEvent) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// serveTLS runs the server returned by NewServer for files and handler on a
+// local port and returns its URL.
+func serveTLS(t *testing.T, files Files, handler http.Handler) string {
+	t.Helper()
+	srv, err := NewServer("127.0.0.1:0", files, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(l, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + l.Addr().String()
+}
+
+func get(t *testing.T, client *http.Client, url string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestClientServer(t *testing.T) {
+	exPath := tempDir(t)
+	server := newServiceFiles(t, exPath, certmanager.ComponentServer)
+	worker := newServiceFiles(t, exPath, certmanager.ComponentWorker)
+	sta := newServiceFiles(t, exPath, certmanager.ComponentSTA)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, ok := PeerFromContext(r.Context())
+		if !ok || peer.Identity == nil {
+			http.Error(w, "no peer", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, "%s %s", peer.CommonName, peer.Identity.TrustDomain)
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/peer", handler)
+	mux.Handle("/workers", RequireIdentity(certmanager.MatchComponent(certmanager.ComponentWorker), handler))
+	url := serveTLS(t, server, mux)
+
+	workerClient, err := NewClient(worker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staClient, err := NewClient(sta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		client *http.Client
+		path   string
+		status int
+		body   string
+	}{
+		{workerClient, "/peer", http.StatusOK, "ezb_wks ezb.local"},
+		{workerClient, "/workers", http.StatusOK, "ezb_wks ezb.local"},
+		{staClient, "/peer", http.StatusOK, "ezb_sta ezb.local"},
+		{staClient, "/workers", http.StatusForbidden, "forbidden\n"},
+	} {
+		status, body := get(t, tc.client, url+tc.path)
+		if status != tc.status || body != tc.body {
+			t.Errorf("%s: %d %q", tc.path, status, body)
+		}
+	}
+
+	// A client without certificate is refused during the handshake.
+	pool, err := certmanager.LoadCAPool(server.CAFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if _, err = anonymous.Get(url + "/peer"); err == nil {
+		t.Error("client without certificate served")
+	}
+}
+
+func TestRequireIdentityWithoutPeer(t *testing.T) {
+	served := false
+	handler := RequireIdentity(certmanager.MatchComponent(certmanager.ComponentWorker), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	}))
+	// Without TLS, WithPeer stores no peer and the request is refused.
+	rec := httptest.NewRecorder()
+	WithPeer(handler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/workers", nil))
+	if rec.Code != http.StatusForbidden || served {
+		t.Errorf("request without peer answered %d", rec.Code)
+	}
+}
@@ -0,0 +1,140 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package tokenmanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// JWK is a public key of a JSON Web Key Set, with the certificate chain
+// binding it to its owner.
+type JWK struct {
+	Kty     string   `json:"kty"`
+	Crv     string   `json:"crv"`
+	X       string   `json:"x"`
+	Y       string   `json:"y,omitempty"`
+	Kid     string   `json:"kid"`
+	Alg     string   `json:"alg"`
+	Use     string   `json:"use"`
+	X5c     []string `json:"x5c,omitempty"`
+	X5tS256 string   `json:"x5t#S256,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK returns the key of chain[0], followed by its intermediate CAs.
+func NewJWK(chain ...*x509.Certificate) (JWK, error) {
+	if len(chain) == 0 {
+		return JWK{}, fmt.Errorf("No certificate given")
+	}
+	cert := chain[0]
+	alg, err := algorithmFor(cert.PublicKey)
+	if err != nil {
+		return JWK{}, err
+	}
+	k := JWK{Alg: alg, Use: "sig", Kid: KeyID(cert), X5tS256: KeyID(cert)}
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		size := curveSize(pub.Curve)
+		x, y := make([]byte, size), make([]byte, size)
+		xb, yb := pub.X.Bytes(), pub.Y.Bytes()
+		copy(x[size-len(xb):], xb)
+		copy(y[size-len(yb):], yb)
+		k.Kty, k.Crv = "EC", pub.Curve.Params().Name
+		k.X, k.Y = encodeSegment(x), encodeSegment(y)
+	case ed25519.PublicKey:
+		k.Kty, k.Crv = "OKP", "Ed25519"
+		k.X = encodeSegment(pub)
+	}
+	for _, c := range chain {
+		k.X5c = append(k.X5c, base64.StdEncoding.EncodeToString(c.Raw))
+	}
+	return k, nil
+}
+
+// JWKS returns the key set publishing the current key of s.
+func (s *Signer) JWKS() (JWKS, error) {
+	keyPair, _, err := s.current()
+	if err != nil {
+		return JWKS{}, err
+	}
+	chain := []*x509.Certificate{keyPair.Leaf}
+	for _, der := range keyPair.Certificate[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return JWKS{}, err
+		}
+		chain = append(chain, cert)
+	}
+	k, err := NewJWK(chain...)
+	if err != nil {
+		return JWKS{}, err
+	}
+	return JWKS{Keys: []JWK{k}}, nil
+}
+
+// JWKSHandler serves the key set of signers, usually mounted on
+// /.well-known/jwks.json.
+func JWKSHandler(signers ...*Signer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var set JWKS
+		for _, s := range signers {
+			one, err := s.JWKS()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			set.Keys = append(set.Keys, one.Keys...)
+		}
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Header().Set("Cache-Control", "max-age=300")
+		json.NewEncoder(w).Encode(set)
+	})
+}
+
+// AddJWKS adds the keys of set, as published by JWKSHandler, to the
+// verifier, see AddCertificate. Every key must carry its certificate chain.
+func (v *Verifier) AddJWKS(set JWKS) error {
+	for _, k := range set.Keys {
+		if len(k.X5c) == 0 {
+			return fmt.Errorf("Key %q has no certificate", k.Kid)
+		}
+		chain, err := parseX5c(k.X5c)
+		if err != nil {
+			return err
+		}
+		want, err := NewJWK(chain...)
+		if err != nil {
+			return err
+		}
+		if k.Kty != want.Kty || k.Crv != want.Crv || k.X != want.X || k.Y != want.Y {
+			return fmt.Errorf("Key %q does not match its certificate", k.Kid)
+		}
+		if err = v.AddCertificate(chain...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package tokenmanager signs and verifies the JWT bearer tokens exchanged by
+// the ezBastion services with the keys and certificates created by
+// certmanager. A token carries the certificate chain of its signer, so a
+// peer verifies it against the CA it trusts, without sharing keys
+// beforehand.
+package tokenmanager
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/certmanager"
+)
+
+// Signature algorithms, as named in the JWT alg header.
+const (
+	ES256 = "ES256"
+	ES384 = "ES384"
+	ES512 = "ES512"
+	EdDSA = "EdDSA"
+)
+
+// DefaultTTL is the lifetime of the tokens signed without an expiry.
+const DefaultTTL = 5 * time.Minute
+
+// Claims are the claims of a token. Registered claims have their own field;
+// Private holds the others, such as the roles granted by the token.
+type Claims struct {
+	Issuer    string
+	Subject   string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+	ID        string
+	Private   map[string]interface{}
+}
+
+var registeredClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti"}
+
+// MarshalJSON encodes the claims as a JWT payload. A registered claim
+// overrides a private one of the same name.
+func (c Claims) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(c.Private)+len(registeredClaims))
+	for k, v := range c.Private {
+		m[k] = v
+	}
+	for _, k := range registeredClaims {
+		delete(m, k)
+	}
+	setString := func(k, v string) {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	setTime := func(k string, t time.Time) {
+		if !t.IsZero() {
+			m[k] = t.Unix()
+		}
+	}
+	setString("iss", c.Issuer)
+	setString("sub", c.Subject)
+	setString("jti", c.ID)
+	switch len(c.Audience) {
+	case 0:
+	case 1:
+		m["aud"] = c.Audience[0]
+	default:
+		m["aud"] = c.Audience
+	}
+	setTime("exp", c.ExpiresAt)
+	setTime("nbf", c.NotBefore)
+	setTime("iat", c.IssuedAt)
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON decodes a JWT payload.
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*c = Claims{}
+	var err error
+	getString := func(k string, v *string) {
+		if raw, ok := m[k]; ok && err == nil {
+			if e := json.Unmarshal(raw, v); e != nil {
+				err = fmt.Errorf("Invalid %s claim", k)
+			}
+			delete(m, k)
+		}
+	}
+	getTime := func(k string, t *time.Time) {
+		if raw, ok := m[k]; ok && err == nil {
+			var secs float64
+			if e := json.Unmarshal(raw, &secs); e != nil {
+				err = fmt.Errorf("Invalid %s claim", k)
+			}
+			*t = time.Unix(int64(secs), 0)
+			delete(m, k)
+		}
+	}
+	getString("iss", &c.Issuer)
+	getString("sub", &c.Subject)
+	getString("jti", &c.ID)
+	getTime("exp", &c.ExpiresAt)
+	getTime("nbf", &c.NotBefore)
+	getTime("iat", &c.IssuedAt)
+	if raw, ok := m["aud"]; ok && err == nil {
+		var one string
+		if json.Unmarshal(raw, &one) == nil {
+			c.Audience = []string{one}
+		} else if json.Unmarshal(raw, &c.Audience) != nil {
+			err = errors.New("Invalid aud claim")
+		}
+		delete(m, "aud")
+	}
+	if err != nil {
+		return err
+	}
+	if len(m) > 0 {
+		c.Private = make(map[string]interface{}, len(m))
+		for k, raw := range m {
+			var v interface{}
+			if err = json.Unmarshal(raw, &v); err != nil {
+				return err
+			}
+			c.Private[k] = v
+		}
+	}
+	return nil
+}
+
+// header is the JOSE header of the tokens.
+type header struct {
+	Alg  string   `json:"alg"`
+	Typ  string   `json:"typ,omitempty"`
+	Kid  string   `json:"kid,omitempty"`
+	X5c  []string `json:"x5c,omitempty"`
+	Crit []string `json:"crit,omitempty"`
+}
+
+// Signer signs tokens with the key pair of a service. Its tokens are issued
+// by the common name of the certificate.
+type Signer struct {
+	// TTL is the lifetime of the tokens signed without an expiry.
+	TTL time.Duration
+
+	keyPair func() *tls.Certificate
+}
+
+// NewSigner returns a signer for keyPair, as loaded by
+// certmanager.LoadX509KeyPair. The key must be ECDSA or Ed25519.
+func NewSigner(keyPair tls.Certificate) (*Signer, error) {
+	return newSigner(func() *tls.Certificate { return &keyPair })
+}
+
+// NewReloadingSigner returns a signer following the key pair of k, so it
+// keeps signing with a valid certificate across certmanager.Renewer runs.
+func NewReloadingSigner(k *certmanager.KeyPairReloader) (*Signer, error) {
+	return newSigner(k.Certificate)
+}
+
+func newSigner(keyPair func() *tls.Certificate) (*Signer, error) {
+	s := &Signer{TTL: DefaultTTL, keyPair: keyPair}
+	if _, _, err := s.current(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// current returns the key pair to sign with, its leaf and algorithm.
+func (s *Signer) current() (*tls.Certificate, string, error) {
+	keyPair := s.keyPair()
+	if keyPair == nil || keyPair.Leaf == nil {
+		return nil, "", errors.New("Signer has no certificate")
+	}
+	if _, ok := keyPair.PrivateKey.(crypto.Signer); !ok {
+		return nil, "", errors.New("Signer has no private key")
+	}
+	alg, err := algorithmFor(keyPair.Leaf.PublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return keyPair, alg, nil
+}
+
+// Certificate returns the certificate currently signing the tokens.
+func (s *Signer) Certificate() *x509.Certificate {
+	return s.keyPair().Leaf
+}
+
+// Sign returns a token for claims. The issuer, issue time, expiry, after
+// TTL, and a random ID are filled in when missing; the audience is
+// required.
+func (s *Signer) Sign(claims Claims) (string, error) {
+	keyPair, alg, err := s.current()
+	if err != nil {
+		return "", err
+	}
+	cert := keyPair.Leaf
+	if len(claims.Audience) == 0 {
+		return "", errors.New("Token needs an audience")
+	}
+	switch claims.Issuer {
+	case "":
+		claims.Issuer = cert.Subject.CommonName
+	case cert.Subject.CommonName:
+	default:
+		return "", fmt.Errorf("Issuer %q does not match certificate %q", claims.Issuer, cert.Subject.CommonName)
+	}
+	if claims.IssuedAt.IsZero() {
+		claims.IssuedAt = time.Now()
+	}
+	if claims.ExpiresAt.IsZero() {
+		ttl := s.TTL
+		if ttl <= 0 {
+			ttl = DefaultTTL
+		}
+		claims.ExpiresAt = claims.IssuedAt.Add(ttl)
+	}
+	if claims.ID == "" {
+		id := make([]byte, 16)
+		if _, err = rand.Read(id); err != nil {
+			return "", err
+		}
+		claims.ID = hex.EncodeToString(id)
+	}
+
+	h := header{Alg: alg, Typ: "JWT", Kid: KeyID(cert)}
+	for _, der := range keyPair.Certificate {
+		h.X5c = append(h.X5c, base64.StdEncoding.EncodeToString(der))
+	}
+	headerJSON, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encodeSegment(headerJSON) + "." + encodeSegment(claimsJSON)
+	sig, err := sign(keyPair.PrivateKey.(crypto.Signer), alg, []byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("Failed to sign token: %v", err)
+	}
+	return signingInput + "." + encodeSegment(sig), nil
+}
+
+// KeyID returns the key ID of the tokens signed with cert: the base64url
+// SHA-256 thumbprint of the certificate, as in the x5t#S256 header.
+func KeyID(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return encodeSegment(sum[:])
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// algorithmFor returns the algorithm signing with the private key of pub.
+func algorithmFor(pub crypto.PublicKey) (string, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return ES256, nil
+		case elliptic.P384():
+			return ES384, nil
+		case elliptic.P521():
+			return ES512, nil
+		}
+	case ed25519.PublicKey:
+		return EdDSA, nil
+	}
+	return "", fmt.Errorf("Unsupported key type %T for tokens, use ECDSA or Ed25519", pub)
+}
+
+func hashFor(alg string) crypto.Hash {
+	switch alg {
+	case ES384:
+		return crypto.SHA384
+	case ES512:
+		return crypto.SHA512
+	case EdDSA:
+		return crypto.Hash(0)
+	}
+	return crypto.SHA256
+}
+
+// sign signs input with priv. ECDSA signatures are converted from ASN.1 to
+// the fixed size r||s form of JWS.
+func sign(priv crypto.Signer, alg string, input []byte) ([]byte, error) {
+	hash := hashFor(alg)
+	digest := input
+	if hash != 0 {
+		h := hash.New()
+		h.Write(input)
+		digest = h.Sum(nil)
+	}
+	sig, err := priv.Sign(rand.Reader, digest, hash)
+	if err != nil || alg == EdDSA {
+		return sig, err
+	}
+	var esig struct {
+		R, S *big.Int
+	}
+	if _, err = asn1.Unmarshal(sig, &esig); err != nil {
+		return nil, err
+	}
+	size := curveSize(priv.Public().(*ecdsa.PublicKey).Curve)
+	out := make([]byte, 2*size)
+	r, sb := esig.R.Bytes(), esig.S.Bytes()
+	copy(out[size-len(r):size], r)
+	copy(out[2*size-len(sb):], sb)
+	return out, nil
+}
+
+// verifySignature checks sig over input with pub for alg.
+func verifySignature(pub crypto.PublicKey, alg string, input, sig []byte) error {
+	want, err := algorithmFor(pub)
+	if err != nil {
+		return err
+	}
+	if want != alg {
+		return fmt.Errorf("Token algorithm %s does not match the %s certificate key", alg, want)
+	}
+	if alg == EdDSA {
+		if !ed25519.Verify(pub.(ed25519.PublicKey), input, sig) {
+			return errors.New("Invalid token signature")
+		}
+		return nil
+	}
+	key := pub.(*ecdsa.PublicKey)
+	size := curveSize(key.Curve)
+	if len(sig) != 2*size {
+		return errors.New("Invalid token signature")
+	}
+	h := hashFor(alg).New()
+	h.Write(input)
+	r := new(big.Int).SetBytes(sig[:size])
+	s := new(big.Int).SetBytes(sig[size:])
+	if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+		return errors.New("Invalid token signature")
+	}
+	return nil
+}
+
+func curveSize(curve elliptic.Curve) int {
+	return (curve.Params().BitSize + 7) / 8
+}
@@ -0,0 +1,294 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package tokenmanager
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/certmanager"
+)
+
+// tempDir returns a folder removed at the end of the test.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "tokenmanager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// newTestSigner enrolls cn with a key of keyType from the development CA of
+// dir, created on first use, and returns its signer and the CA pool.
+func newTestSigner(t *testing.T, dir, cn string, keyType certmanager.KeyType) (*Signer, *Verifier) {
+	t.Helper()
+	certFile, keyFile, caFile := filepath.Join(dir, cn+".crt"), filepath.Join(dir, cn+".key"), filepath.Join(dir, "ca.crt")
+	request := certmanager.NewCertificateRequest(cn, 0, nil, certmanager.WithKeyType(keyType))
+	err := certmanager.GenerateOffline(request, filepath.Join(dir, "dev.crt"), filepath.Join(dir, "dev.key"),
+		certFile, keyFile, caFile, certmanager.WithProgress(func(certmanager.EnrollEvent) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPair, err := certmanager.LoadX509KeyPair(certFile, keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSigner(keyPair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, err := certmanager.LoadCAPool(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, NewVerifier(roots, "ezb_srv")
+}
+
+// signToken signs claims under h with the key of s as is, without the checks
+// and defaults of Sign.
+func signToken(t *testing.T, s *Signer, h header, claims Claims) string {
+	t.Helper()
+	headerJSON, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := encodeSegment(headerJSON) + "." + encodeSegment(claimsJSON)
+	alg, _ := algorithmFor(s.Certificate().PublicKey)
+	sig, err := sign(s.keyPair().PrivateKey.(crypto.Signer), alg, []byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + encodeSegment(sig)
+}
+
+// signedHeader returns the header Sign writes for s.
+func signedHeader(s *Signer) header {
+	alg, _ := algorithmFor(s.Certificate().PublicKey)
+	h := header{Alg: alg, Typ: "JWT", Kid: KeyID(s.Certificate())}
+	for _, der := range s.keyPair().Certificate {
+		h.X5c = append(h.X5c, base64.StdEncoding.EncodeToString(der))
+	}
+	return h
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	dir := tempDir(t)
+	for _, tc := range []struct {
+		keyType certmanager.KeyType
+		alg     string
+	}{
+		{certmanager.KeyECDSAP256, ES256},
+		{certmanager.KeyECDSAP384, ES384},
+		{certmanager.KeyEd25519, EdDSA},
+	} {
+		s, v := newTestSigner(t, dir, "node-"+string(tc.keyType), tc.keyType)
+		token, err := s.Sign(Claims{Subject: "bob", Audience: []string{"ezb_srv"}, Private: map[string]interface{}{"roles": []string{"admin"}}})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.keyType, err)
+		}
+		got, err := v.Verify(token)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.keyType, err)
+		}
+		if got.Algorithm != tc.alg || got.Claims.Issuer != "node-"+string(tc.keyType) || got.Claims.Subject != "bob" {
+			t.Errorf("%s: verified %s token %+v", tc.keyType, got.Algorithm, got.Claims)
+		}
+		if got.Claims.ExpiresAt.Sub(got.Claims.IssuedAt) != DefaultTTL {
+			t.Errorf("%s: token valid for %s", tc.keyType, got.Claims.ExpiresAt.Sub(got.Claims.IssuedAt))
+		}
+
+		// A changed claim breaks the signature.
+		parts := strings.Split(token, ".")
+		claims, _ := decodeSegment(parts[1])
+		forged := strings.Replace(string(claims), `"bob"`, `"eve"`, 1)
+		if _, err = v.Verify(parts[0] + "." + encodeSegment([]byte(forged)) + "." + parts[2]); err == nil {
+			t.Errorf("%s: tampered claims accepted", tc.keyType)
+		}
+	}
+}
+
+func TestVerifyAlgorithm(t *testing.T) {
+	s, v := newTestSigner(t, tempDir(t), "node1", certmanager.KeyECDSAP256)
+	claims := Claims{Issuer: "node1", Audience: []string{"ezb_srv"}, ExpiresAt: time.Now().Add(time.Minute)}
+	for _, alg := range []string{"none", "HS256", ES384, EdDSA} {
+		h := signedHeader(s)
+		h.Alg = alg
+		if _, err := v.Verify(signToken(t, s, h, claims)); err == nil {
+			t.Errorf("token with alg %s accepted", alg)
+		}
+	}
+
+	// The header is signed: changing its alg afterwards breaks the token.
+	token, err := s.Sign(Claims{Audience: []string{"ezb_srv"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	headerJSON, _ := decodeSegment(parts[0])
+	tampered := strings.Replace(string(headerJSON), `"ES256"`, `"ES384"`, 1)
+	if _, err = v.Verify(encodeSegment([]byte(tampered)) + "." + parts[1] + "." + parts[2]); err == nil {
+		t.Error("tampered alg accepted")
+	}
+	sig, _ := decodeSegment(parts[2])
+	if err = verifySignature(s.Certificate().PublicKey, ES384, []byte(parts[0]+"."+parts[1]), sig); err == nil {
+		t.Error("ES256 signature verified as ES384")
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	s, v := newTestSigner(t, tempDir(t), "node1", certmanager.KeyECDSAP256)
+	now := time.Now().Truncate(time.Second)
+	v.Now = func() time.Time { return now }
+	v.Skew = time.Minute
+	inside, outside := v.Skew-time.Second, v.Skew+time.Second
+	for _, tc := range []struct {
+		name   string
+		claims Claims
+		ok     bool
+	}{
+		{"valid", Claims{}, true},
+		{"expired", Claims{IssuedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-outside)}, false},
+		{"expired within skew", Claims{IssuedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-inside)}, true},
+		{"nbf within skew", Claims{NotBefore: now.Add(inside)}, true},
+		{"nbf beyond skew", Claims{NotBefore: now.Add(outside)}, false},
+		{"iat within skew", Claims{IssuedAt: now.Add(inside), ExpiresAt: now.Add(time.Hour)}, true},
+		{"iat beyond skew", Claims{IssuedAt: now.Add(outside), ExpiresAt: now.Add(time.Hour)}, false},
+		{"other audience", Claims{Audience: []string{"other"}}, false},
+		{"several audiences", Claims{Audience: []string{"other", "ezb_srv"}}, true},
+	} {
+		claims := tc.claims
+		if claims.Audience == nil {
+			claims.Audience = []string{"ezb_srv"}
+		}
+		if claims.IssuedAt.IsZero() {
+			claims.IssuedAt = now
+		}
+		token, err := s.Sign(claims)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if _, err = v.Verify(token); (err == nil) != tc.ok {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+
+	// Sign refuses another issuer; a token claiming one anyway is refused.
+	claims := Claims{Issuer: "node2", Audience: []string{"ezb_srv"}, ExpiresAt: now.Add(time.Minute)}
+	if _, err := s.Sign(claims); err == nil {
+		t.Error("signed for another issuer")
+	}
+	if _, err := v.Verify(signToken(t, s, signedHeader(s), claims)); err == nil {
+		t.Error("issuer other than the certificate accepted")
+	}
+	v.Issuers = []string{"node2"}
+	token, err := s.Sign(Claims{Audience: []string{"ezb_srv"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = v.Verify(token); err == nil {
+		t.Error("issuer outside Issuers accepted")
+	}
+}
+
+func TestVerifySigner(t *testing.T) {
+	dir := tempDir(t)
+	s, v := newTestSigner(t, dir, "node1", certmanager.KeyECDSAP256)
+	other, _ := newTestSigner(t, dir, "node2", certmanager.KeyECDSAP256)
+	claims := Claims{Issuer: "node1", Audience: []string{"ezb_srv"}, ExpiresAt: time.Now().Add(time.Minute)}
+
+	// A signer from another CA.
+	_, foreign := newTestSigner(t, tempDir(t), "node1", certmanager.KeyECDSAP256)
+	token, err := s.Sign(Claims{Audience: []string{"ezb_srv"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = foreign.Verify(token); err == nil {
+		t.Error("certificate of another CA accepted")
+	}
+
+	h := signedHeader(s)
+	h.Kid = KeyID(other.Certificate())
+	if _, err = v.Verify(signToken(t, s, h, claims)); err == nil {
+		t.Error("kid of another certificate accepted")
+	}
+
+	h = signedHeader(s)
+	h.X5c = nil
+	kidOnly := signToken(t, s, h, claims)
+	if _, err = v.Verify(kidOnly); err == nil {
+		t.Error("unknown kid without x5c accepted")
+	}
+	if err = v.AddCertificate(s.Certificate()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = v.Verify(kidOnly); err != nil {
+		t.Errorf("kid of an added certificate: %v", err)
+	}
+
+	h = signedHeader(s)
+	h.Crit = []string{"exp"}
+	if _, err = v.Verify(signToken(t, s, h, claims)); err == nil {
+		t.Error("critical header accepted")
+	}
+}
+
+func TestAddJWKS(t *testing.T) {
+	dir := tempDir(t)
+	s, v := newTestSigner(t, dir, "node1", certmanager.KeyECDSAP256)
+	other, _ := newTestSigner(t, dir, "node2", certmanager.KeyEd25519)
+	set, err := s.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSet, err := other.JWKS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mismatched := JWKS{Keys: []JWK{set.Keys[0]}}
+	mismatched.Keys[0].X5c = otherSet.Keys[0].X5c
+	if err = v.AddJWKS(mismatched); err == nil {
+		t.Error("key not matching its x5c added")
+	}
+	noChain := JWKS{Keys: []JWK{set.Keys[0]}}
+	noChain.Keys[0].X5c = nil
+	if err = v.AddJWKS(noChain); err == nil {
+		t.Error("key without x5c added")
+	}
+
+	if err = v.AddJWKS(JWKS{Keys: append(set.Keys, otherSet.Keys...)}); err != nil {
+		t.Fatal(err)
+	}
+	h := signedHeader(other)
+	h.X5c = nil
+	claims := Claims{Issuer: "node2", Audience: []string{"ezb_srv"}, ExpiresAt: time.Now().Add(time.Minute)}
+	if _, err = v.Verify(signToken(t, other, h, claims)); err != nil {
+		t.Errorf("kid published in the key set: %v", err)
+	}
+}
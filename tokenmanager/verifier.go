@@ -0,0 +1,278 @@
+// This file is part of ezBastion.
+
+//     ezBastion is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU Affero General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+
+//     ezBastion is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU Affero General Public License for more details.
+
+//     You should have received a copy of the GNU Affero General Public License
+//     along with ezBastion.  If not, see <https://www.gnu.org/licenses/>.
+
+package tokenmanager
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezBastion/ezb_lib/logmanager"
+)
+
+// DefaultSkew is the clock difference tolerated between services.
+const DefaultSkew = time.Minute
+
+// Token is a verified token.
+type Token struct {
+	Claims Claims
+	// Certificate is the verified certificate of the signer.
+	Certificate *x509.Certificate
+	Algorithm   string
+}
+
+// Verifier checks the tokens of the peers whose certificates chain to Roots.
+type Verifier struct {
+	// Roots are the CAs trusted to issue signer certificates, usually the
+	// CA file written by certmanager.Generate, see
+	// certmanager.LoadCAPool.
+	Roots *x509.CertPool
+	// Audience must be one of the audiences of the token, usually the name
+	// of the verifying service.
+	Audience string
+	// Issuers, when set, restricts the accepted issuers. The issuer must
+	// always be the common name of the signing certificate.
+	Issuers []string
+	// Skew is the clock difference tolerated on exp, nbf and iat.
+	Skew time.Duration
+	// Now returns the current time. Defaults to time.Now.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	certs map[string][]*x509.Certificate
+}
+
+// NewVerifier returns a verifier accepting the tokens for audience signed
+// by certificates issued from roots.
+func NewVerifier(roots *x509.CertPool, audience string) *Verifier {
+	return &Verifier{Roots: roots, Audience: audience, Skew: DefaultSkew}
+}
+
+// AddCertificate lets the verifier check the tokens that carry the key ID of
+// chain[0] but no certificate. chain holds the signer certificate followed
+// by its intermediate CAs; it is verified against Roots for every token.
+func (v *Verifier) AddCertificate(chain ...*x509.Certificate) error {
+	if len(chain) == 0 {
+		return errors.New("No certificate given")
+	}
+	if _, err := v.verifyChain(chain, v.now()); err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.certs == nil {
+		v.certs = make(map[string][]*x509.Certificate)
+	}
+	v.certs[KeyID(chain[0])] = chain
+	return nil
+}
+
+func (v *Verifier) now() time.Time {
+	if v.Now != nil {
+		return v.Now()
+	}
+	return time.Now()
+}
+
+func (v *Verifier) verifyChain(chain []*x509.Certificate, now time.Time) ([][]*x509.Certificate, error) {
+	if v.Roots == nil {
+		return nil, errors.New("Verifier has no trusted CA")
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		pool.AddCert(cert)
+	}
+	chains, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: pool,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Untrusted token signer %q: %v", chain[0].Subject.CommonName, err)
+	}
+	return chains, nil
+}
+
+// Verify checks the signature of token, its signer certificate and its
+// claims, and returns it.
+func (v *Verifier) Verify(token string) (*Token, error) {
+	if v.Audience == "" {
+		return nil, errors.New("Verifier has no audience")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token")
+	}
+	var h header
+	if err := decodeJSONSegment(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("Malformed token header: %v", err)
+	}
+	if len(h.Crit) > 0 {
+		return nil, fmt.Errorf("Unsupported critical token headers %v", h.Crit)
+	}
+	chain, err := v.signerChain(h)
+	if err != nil {
+		return nil, err
+	}
+	now := v.now()
+	if _, err = v.verifyChain(chain, now); err != nil {
+		return nil, err
+	}
+	sig, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, errors.New("Malformed token signature")
+	}
+	if err = verifySignature(chain[0].PublicKey, h.Alg, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err = decodeJSONSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("Malformed token claims: %v", err)
+	}
+	if err = v.checkClaims(claims, chain[0], now); err != nil {
+		return nil, err
+	}
+	return &Token{Claims: claims, Certificate: chain[0], Algorithm: h.Alg}, nil
+}
+
+// signerChain returns the certificate chain of the signer, from the x5c
+// header or the certificates added to the verifier.
+func (v *Verifier) signerChain(h header) ([]*x509.Certificate, error) {
+	if len(h.X5c) == 0 {
+		v.mu.Lock()
+		chain, ok := v.certs[h.Kid]
+		v.mu.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("Unknown token key %q", h.Kid)
+		}
+		return chain, nil
+	}
+	chain, err := parseX5c(h.X5c)
+	if err != nil {
+		return nil, err
+	}
+	if h.Kid != "" && h.Kid != KeyID(chain[0]) {
+		return nil, errors.New("Token key ID does not match its certificate")
+	}
+	return chain, nil
+}
+
+func parseX5c(x5c []string) ([]*x509.Certificate, error) {
+	chain := make([]*x509.Certificate, len(x5c))
+	for i, s := range x5c {
+		der, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed certificate %d in x5c: %v", i, err)
+		}
+		if chain[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, fmt.Errorf("Malformed certificate %d in x5c: %v", i, err)
+		}
+	}
+	return chain, nil
+}
+
+func (v *Verifier) checkClaims(c Claims, cert *x509.Certificate, now time.Time) error {
+	skew := v.Skew
+	if c.ExpiresAt.IsZero() {
+		return errors.New("Token has no expiry")
+	}
+	if !now.Before(c.ExpiresAt.Add(skew)) {
+		return fmt.Errorf("Token expired at %s", c.ExpiresAt.Format(time.RFC3339))
+	}
+	if !c.NotBefore.IsZero() && now.Add(skew).Before(c.NotBefore) {
+		return fmt.Errorf("Token not valid before %s", c.NotBefore.Format(time.RFC3339))
+	}
+	if !c.IssuedAt.IsZero() && now.Add(skew).Before(c.IssuedAt) {
+		return fmt.Errorf("Token issued in the future, at %s", c.IssuedAt.Format(time.RFC3339))
+	}
+	if !contains(c.Audience, v.Audience) {
+		return fmt.Errorf("Token is not for %q", v.Audience)
+	}
+	if c.Issuer != cert.Subject.CommonName {
+		return fmt.Errorf("Token issuer %q does not match its certificate %q", c.Issuer, cert.Subject.CommonName)
+	}
+	if len(v.Issuers) > 0 && !contains(v.Issuers, c.Issuer) {
+		return fmt.Errorf("Token issuer %q not accepted", c.Issuer)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeJSONSegment(s string, v interface{}) error {
+	b, err := decodeSegment(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+type tokenKey struct{}
+
+// TokenFromContext returns the token verified by Verifier.Handler.
+func TokenFromContext(ctx context.Context) (*Token, bool) {
+	token, ok := ctx.Value(tokenKey{}).(*Token)
+	return token, ok
+}
+
+// Handler passes to next the requests carrying a valid bearer token in the
+// Authorization header, stored in the request context, see
+// TokenFromContext. Other requests are answered with 401.
+func (v *Verifier) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		const prefix = "Bearer "
+		if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "bearer token required", http.StatusUnauthorized)
+			return
+		}
+		token, err := v.Verify(strings.TrimSpace(auth[len(prefix):]))
+		if err != nil {
+			logmanager.Warning(fmt.Sprintf("Rejected bearer token from %s: %v", r.RemoteAddr, err))
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)))
+	})
+}
+
+// SetBearer adds a token for audience signed by s to the Authorization
+// header of r.
+func (s *Signer) SetBearer(r *http.Request, audience string) error {
+	token, err := s.Sign(Claims{Audience: []string{audience}})
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}